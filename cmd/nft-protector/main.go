@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/Morwran/nft-protect/internal/app"
 	. "github.com/Morwran/nft-protect/internal/app/nft-protector" //nolint:revive
+	"github.com/Morwran/nft-protect/internal/config"
+	nft_protector "github.com/Morwran/nft-protect/internal/nft-protector"
 
 	"github.com/H-BF/corlib/logger"
 	gs "github.com/H-BF/corlib/pkg/patterns/graceful-shutdown"
@@ -14,13 +19,41 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "validate" {
+		os.Exit(validateConfig(os.Args[3:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "unlock" {
+		os.Exit(unlock())
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "freeze" || os.Args[1] == "thaw") {
+		os.Exit(toggleFreeze(os.Args[1] == "freeze"))
+	}
+	if err := ParseFlags(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	SetupContext()
 	ctx := app.Context()
 	logger.SetLevel(zap.InfoLevel)
 	logger.InfoKV(ctx, "-= HELLO =-", "version", app.GetVersion())
 
-	if err := SetupLogger(LogLevel); err != nil {
-		logger.Fatal(ctx, errors.WithMessage(err, "setup logger"))
+	if err := run(ctx); err != nil {
+		logger.Fatal(ctx, err)
+	}
+
+	logger.SetLevel(zap.InfoLevel)
+	logger.Info(ctx, "-= BYE =-")
+}
+
+// run runs the daemon until ctx is canceled or it fails. The protector is shut down by -shutdown
+// before run returns, so a failure doesn't skip the shutdown policy.
+func run(ctx context.Context) error {
+	if err := SetupLogger(Current.LogLevel); err != nil {
+		return errors.WithMessage(err, "setup logger")
 	}
 
 	gracefulDuration := 5 * time.Second
@@ -28,9 +61,41 @@ func main() {
 
 	protector, err := SetupProtector()
 	if err != nil {
-		logger.Fatal(ctx, errors.WithMessage(err, "setup protector"))
+		return errors.WithMessage(err, "setup protector")
+	}
+	defer ShutdownProtector(ctx, protector)
+	caps := protector.Capabilities()
+	logger.Infof(ctx, "protector capabilities: %s", caps)
+	if !caps.Enforcing {
+		logger.Warnf(ctx, "protector '%s' does not deny changes of protected tables, it only reports them", caps.Backend)
+	}
+
+	sinks, err := SetupSinks()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, s := range sinks {
+			_ = s.Close()
+		}
+	}()
+
+	ownerWatcher, err := SetupOwnerWatcher(protector)
+	if err != nil {
+		return errors.WithMessage(err, "setup owner watcher")
+	}
+	go func() {
+		if err := ownerWatcher.Run(ctx); err != nil {
+			logger.Error(ctx, errors.WithMessage(err, "owner watcher"))
+		}
+	}()
+
+	learner := SetupLearner()
+	var learnDone <-chan time.Time
+	if learner != nil {
+		logger.Infof(ctx, "learning processes which change protected tables for %s, nothing is denied", Current.Learn)
+		learnDone = time.After(Current.Learn)
 	}
-	defer protector.Close()
 
 	go func() {
 		defer close(errc)
@@ -53,21 +118,86 @@ Loop:
 				)
 			}
 		case jobErr = <-errc:
+		case <-ReloadRequests():
+			if err := Reload(ctx, protector, ownerWatcher); err != nil {
+				logger.Errorf(ctx, "the running configuration is kept: %v", err)
+			}
+			continue
+		case freeze := <-FreezeRequests():
+			if err := ToggleFreeze(ctx, protector, freeze); err != nil {
+				logger.Errorf(ctx, "failed to toggle the freeze: %v", err)
+			}
+			continue
+		case <-learnDone:
+			if jobErr = WriteLearned(learner); jobErr == nil {
+				logger.Infof(ctx, "suggested owners are written to '%s'", Current.LearnOutput)
+			}
 		case p, ok := <-protector.EvtReader():
 			if ok {
-				logger.Infof(ctx, "pid=%d, process=%s", p.Pid, p.Name)
+				if learner != nil && p.Reason != nft_protector.EventReasonTamper.String() &&
+					p.Reason != nft_protector.EventReasonFreeze.String() {
+					learner.Record(p)
+				}
+				for _, s := range sinks {
+					if err := s.Write(ctx, p); err != nil {
+						logger.Errorf(ctx, "failed to write event: %v", err)
+					}
+				}
 				continue
 			} else {
-				logger.Fatal(ctx, errors.New("event reader closed"))
+				return errors.New("event reader closed")
 			}
 		}
 		break Loop
 	}
 
-	if jobErr != nil {
-		logger.Fatal(ctx, jobErr)
+	return jobErr
+}
+
+// validateConfig checks the settings given the same way as to the daemon and prints every problem
+func validateConfig(args []string) int {
+	err := ValidateConfig(args)
+	var errs config.Errors
+	switch {
+	case err == nil:
+		fmt.Println("configuration is valid")
+		return 0
+	case errors.As(err, &errs):
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, err)
 	}
+	return 1
+}
 
-	logger.SetLevel(zap.InfoLevel)
-	logger.Info(ctx, "-= BYE =-")
+// toggleFreeze asks the running daemon to engage or lift the freeze
+func toggleFreeze(freeze bool) int {
+	sig, what := nft_protector.ThawSignal, "lift"
+	if freeze {
+		sig, what = nft_protector.FreezeSignal, "engage"
+	}
+	pid, err := nft_protector.SignalDaemon(sig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("the daemon %d is asked to %s the freeze\n", pid, what)
+	return 0
+}
+
+// unlock lifts the lockdown left by fail-closed shutdown and removes the pinned programs
+func unlock() int {
+	wasLocked, err := nft_protector.Unlock()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if wasLocked {
+		fmt.Println("lockdown is lifted, pinned programs are removed")
+	} else {
+		fmt.Println("no lockdown is engaged, pinned programs are removed")
+	}
+	return 0
 }
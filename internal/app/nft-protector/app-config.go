@@ -2,17 +2,243 @@ package nft_protector
 
 import (
 	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Morwran/nft-protect/internal/config"
+	nft_protector "github.com/Morwran/nft-protect/internal/nft-protector"
+
+	"github.com/pkg/errors"
 )
 
-var (
+// Settings of the app are layered: defaults < config file < environment < flags
+type Settings struct {
+	ConfigFile         string
 	LogLevel           string
-	ProtectedTableName string
+	ProtectedTables    string
 	ProtectorType      string
+	Mode               string
+	AuditTables        string
+	OwnerPids          string
+	OwnerNames         string
+	OwnerPidFiles      string
+	OwnerCgroups       string
+	OwnerExes          string
+	OwnerRefresh       time.Duration
+	PolicyFile         string
+	Sinks              string
+	RingbufSize        uint
+	RingbufReadTimeout time.Duration
+	Pin                bool
+	Shutdown           string
+	Guard              bool
+	ProtectFiles       bool
+	Updaters           string
+	BreakGlass         string
+	FreezeTimeout      time.Duration
+	Learn              time.Duration
+	LearnOutput        string
+
+	origins map[string]string // flag name -> where the value comes from
+}
+
+// envPrefix of environment variables, e.g. NFT_PROTECTOR_OWNER_PID overrides -owner-pid
+const envPrefix = "NFT_PROTECTOR_"
+
+var (
+	// Current are the settings in force, a reload replaces them as a whole
+	Current Settings
+
+	cmdArgs []string
 )
 
-func init() {
-	flag.StringVar(&LogLevel, "level", "INFO", "log level: INFO|DEBUG|WARN|ERROR|PANIC|FATAL")
-	flag.StringVar(&ProtectedTableName, "table", "", "protected table name")
-	flag.StringVar(&ProtectorType, "type", "nlbpf", "type of protection: lsm|nlbpf")
-	flag.Parse()
+func (s *Settings) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("nft-protector", flag.ContinueOnError)
+	fs.StringVar(&s.ConfigFile, "config", "", "YAML file with the settings, environment variables "+envPrefix+"<FLAG> and flags override its values; it is re-read on SIGHUP")
+	fs.StringVar(&s.LogLevel, "level", "INFO", "log level: INFO|DEBUG|WARN|ERROR|PANIC|FATAL")
+	fs.StringVar(&s.ProtectedTables, "table", "", "comma separated list of protected tables in form '[family] name', e.g. 'inet filter,nat,ip k8s-*'; family is one of ip|ip6|inet|arp|bridge|netdev|any; name matches exactly unless it is a glob with at most one '*' and any '?'; escape '*', '?' and '\\' in names by '\\' to match them literally; exact names win over globs and globs are tried in order")
+	fs.StringVar(&s.ProtectorType, "type", "nlbpf", "type of protection: lsm|fmodret deny changes of protected tables, nlbpf only detects them, auto picks the strongest one the kernel supports and falls back to a weaker one if it fails")
+	fs.StringVar(&s.Mode, "mode", "enforce", "mode of protection: enforce denies changes of protected tables, audit only reports changes which would be denied")
+	fs.StringVar(&s.AuditTables, "audit-table", "", "comma separated list of tables protected in audit mode regardless of -mode, in the same form as -table")
+	fs.StringVar(&s.OwnerPids, "owner-pid", "", "comma separated list of owner PIDs allowed to modify protected tables; if no owner is set the protector itself is the owner")
+	fs.StringVar(&s.OwnerNames, "owner-name", "", "comma separated list of owner process names")
+	fs.StringVar(&s.OwnerPidFiles, "owner-pidfile", "", "comma separated list of owner PID files")
+	fs.StringVar(&s.OwnerCgroups, "owner-cgroup", "", "comma separated list of owner cgroup v2 paths or system units, e.g. 'firewalld.service,/system.slice/fw-agent.service'; units are looked up in system.slice, other cgroups are given by path")
+	fs.StringVar(&s.OwnerExes, "owner-exe", "", "comma separated list of owner executables in form 'path[;sha256=<hex>][;parent=<path>]', e.g. '/usr/local/bin/fw-agent,/usr/sbin/nft;parent=/usr/local/bin/fw-agent'")
+	fs.DurationVar(&s.OwnerRefresh, "owner-refresh", 2*time.Second, "interval of re-resolving owners")
+	fs.StringVar(&s.PolicyFile, "policy", "", "YAML file with the ordered list of policy rules, the first rule matching the process, table, chain or set and operation gives allow, deny or audit; messages matching no rule are checked against owners and protected tables")
+	fs.StringVar(&s.Sinks, "sink", "log", "comma separated list of event sinks: log writes events to the log, json:<path> appends JSON lines to the file, json:- writes them to stdout")
+	fs.UintVar(&s.RingbufSize, "ringbuf-size", 0, "size of the events ring buffer in bytes, a power of 2 multiple of the page size; 0 keeps the built in size")
+	fs.DurationVar(&s.RingbufReadTimeout, "ringbuf-read-timeout", 2*time.Second, "how long reading of the events ring buffer blocks")
+	fs.BoolVar(&s.Pin, "pin", false, "pin maps and the link under "+nft_protector.PinPath+", so tables stay protected by the last loaded policy while the daemon is not running; the next instance takes them over")
+	fs.StringVar(&s.Shutdown, "shutdown", "open", "shutdown policy: open leaves tables unprotected after exit unless -pin keeps the last policy, closed implies -pin and locks down protected tables when the daemon exits or is killed, only owners other than PIDs may change them until 'nft-protector unlock'")
+	fs.BoolVar(&s.Guard, "guard", false, "deny SIGKILL, SIGSTOP and ptrace aimed at the protector and owner PIDs unless they come from the protector, owners or PID 1 (the service manager); SIGTERM still stops the daemon; works with lsm and fmodret while the daemon runs")
+	fs.BoolVar(&s.ProtectFiles, "protect-files", false, "make the config and policy files and the protector binary read-only for everybody but the protector and -updater executables, e.g. the package manager; works with lsm and fmodret while the daemon runs, files replaced by an updater are protected again on SIGHUP; "+nft_protector.PinPath+" is protected whenever pinning is on")
+	fs.StringVar(&s.Updaters, "updater", "", "comma separated list of executables allowed to modify files protected by -protect-files, in the same form as -owner-exe")
+	fs.StringVar(&s.BreakGlass, "break-glass", "", "comma separated list of executables allowed to change nftables while the freeze is engaged, in the same form as -owner-exe; the freeze denies every change by everybody else regardless of -mode, it is engaged by SIGUSR1 or 'nft-protector freeze' and lifted by SIGUSR2 or 'nft-protector thaw', with self-protection SIGUSR2 is accepted only from the service manager, owners and break-glass owners, e.g. 'systemctl kill -s SIGUSR2 <unit>'")
+	fs.DurationVar(&s.FreezeTimeout, "freeze-timeout", 0, "the freeze is lifted automatically after the given time, 0 keeps it until thaw")
+	fs.DurationVar(&s.Learn, "learn", 0, "learn processes which change protected tables for the given time in audit mode, then write suggested owners to -learn-output and exit")
+	fs.StringVar(&s.LearnOutput, "learn-output", "nft-protector-allowlist.yaml", "file the suggested owners are written to by -learn")
+	return fs
+}
+
+// ParseFlags loads the settings from the config file, the environment and the command line,
+// all problems are returned as config.Errors
+func ParseFlags(args []string) error {
+	s, errs := loadSettings(args)
+	if len(errs) == 0 {
+		errs = s.Validate()
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	Current, cmdArgs = s, args
+	return nil
+}
+
+// loadSettings layers the settings, all problems are returned with their locations
+func loadSettings(args []string) (s Settings, errs config.Errors) {
+	// the config file is given by the environment or the command line
+	var pre Settings
+	preFs := pre.flagSet()
+	preFs.SetOutput(io.Discard)
+	if err := preFs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			s.flagSet().Usage()
+		}
+		return s, config.Errors{{Location: "command line", Err: err}}
+	}
+	configFile := pre.ConfigFile
+	if !isFlagSet(preFs, "config") {
+		configFile = os.Getenv(envName("config"))
+	}
+
+	s.origins = make(map[string]string)
+	fs := s.flagSet()
+	set := func(name, value, origin string) {
+		if err := fs.Set(name, value); err != nil {
+			errs = append(errs, config.LocatedError{Location: origin, Err: errors.WithMessagef(err, "-%s", name)})
+			return
+		}
+		s.origins[name] = origin
+	}
+	if configFile != "" {
+		cfg, err := config.Load(configFile)
+		if err != nil {
+			errs = append(errs, locatedErrors(configFile, err)...)
+		}
+		for _, v := range fileValues(configFile, cfg) {
+			set(v.flag, v.value, cfg.Locations.Of(v.key))
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			set(f.Name, v, "env "+envName(f.Name))
+		}
+	})
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		errs = append(errs, config.LocatedError{Location: "command line", Err: err})
+	}
+	preFs.Visit(func(f *flag.Flag) {
+		s.origins[f.Name] = "flag -" + f.Name
+	})
+	return s, errs
+}
+
+// origin tells where the setting of the flag comes from
+func (s Settings) origin(name string) string {
+	if o, ok := s.origins[name]; ok {
+		return o
+	}
+	return "default -" + name
+}
+
+type fileValue struct {
+	key   string // key in the file
+	flag  string
+	value string
+}
+
+// fileValues are values of the config file in the form of flags
+func fileValues(path string, cfg config.Config) []fileValue {
+	var ret []fileValue
+	add := func(key, flag, value string) {
+		if value != "" {
+			ret = append(ret, fileValue{key: key, flag: flag, value: value})
+		}
+	}
+	join := func(items []string) string {
+		return strings.Join(items, ",")
+	}
+	pids := make([]string, 0, len(cfg.Owners.Pids))
+	for _, pid := range cfg.Owners.Pids {
+		pids = append(pids, strconv.FormatUint(uint64(pid), 10))
+	}
+	duration := func(d time.Duration) string {
+		if d == 0 {
+			return ""
+		}
+		return d.String()
+	}
+	policy := cfg.Policy
+	if policy != "" && !filepath.IsAbs(policy) {
+		policy = filepath.Join(filepath.Dir(path), policy) // relative to the config file
+	}
+
+	add("type", "type", cfg.Type)
+	add("mode", "mode", cfg.Mode)
+	add("log-level", "level", cfg.LogLevel)
+	add("tables", "table", join(cfg.Tables))
+	add("audit-tables", "audit-table", join(cfg.AuditTables))
+	add("owners.pids", "owner-pid", join(pids))
+	add("owners.names", "owner-name", join(cfg.Owners.Names))
+	add("owners.pidfiles", "owner-pidfile", join(cfg.Owners.PidFiles))
+	add("owners.cgroups", "owner-cgroup", join(cfg.Owners.Cgroups))
+	add("owners.exes", "owner-exe", join(cfg.Owners.Exes))
+	add("owner-refresh", "owner-refresh", duration(cfg.OwnerRefresh))
+	add("policy", "policy", policy)
+	add("sinks", "sink", join(cfg.Sinks))
+	if cfg.Ringbuf.Size != 0 {
+		add("ringbuf.size", "ringbuf-size", strconv.FormatUint(uint64(cfg.Ringbuf.Size), 10))
+	}
+	add("ringbuf.read-timeout", "ringbuf-read-timeout", duration(cfg.Ringbuf.ReadTimeout))
+	if cfg.Pin {
+		add("pin", "pin", "true")
+	}
+	add("shutdown", "shutdown", cfg.Shutdown)
+	if cfg.Guard {
+		add("guard", "guard", "true")
+	}
+	if cfg.ProtectFiles {
+		add("protect-files", "protect-files", "true")
+	}
+	add("updaters", "updater", join(cfg.Updaters))
+	add("break-glass", "break-glass", join(cfg.BreakGlass))
+	add("freeze-timeout", "freeze-timeout", duration(cfg.FreezeTimeout))
+	return ret
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) (ret bool) {
+	fs.Visit(func(f *flag.Flag) {
+		ret = ret || f.Name == name
+	})
+	return ret
+}
+
+// locatedErrors keeps located errors as they are and locates the rest at the file
+func locatedErrors(path string, err error) config.Errors {
+	var errs config.Errors
+	if errors.As(err, &errs) {
+		return errs
+	}
+	return config.Errors{{Location: path, Err: err}}
 }
@@ -0,0 +1,60 @@
+package nft_protector
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Morwran/nft-protect/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LoadSettings(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nft-protector.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`mode: audit
+log-level: DEBUG
+tables: [inet filter]
+policy: policy.yaml
+owners:
+  names: [fw-agent]
+pin: true
+protect-files: true
+updaters: [/usr/bin/dpkg]
+freeze-timeout: 10m
+`), 0o600))
+	t.Setenv(envName("config"), path)
+	t.Setenv(envName("level"), "WARN")
+	t.Setenv(envName("table"), "ip nat")
+
+	s, errs := loadSettings([]string{"-table", "inet fw"})
+	require.Empty(t, errs)
+	require.Equal(t, "audit", s.Mode, "file overrides defaults")
+	require.Equal(t, "WARN", s.LogLevel, "env overrides file")
+	require.Equal(t, "inet fw", s.ProtectedTables, "flags override env")
+	require.Equal(t, "fw-agent", s.OwnerNames)
+	require.Equal(t, filepath.Join(dir, "policy.yaml"), s.PolicyFile, "policy is relative to the config file")
+	require.Equal(t, "nlbpf", s.ProtectorType, "auto is opt-in")
+	require.True(t, s.Pin)
+	require.True(t, s.ProtectFiles)
+	require.Equal(t, "/usr/bin/dpkg", s.Updaters)
+	require.Equal(t, 10*time.Minute, s.FreezeTimeout)
+
+	require.Equal(t, path+":1:1", s.origin("mode"))
+	require.Equal(t, "env NFT_PROTECTOR_LEVEL", s.origin("level"))
+	require.Equal(t, "flag -table", s.origin("table"))
+	require.Equal(t, "default -type", s.origin("type"))
+
+	t.Setenv(envName("mode"), "enforc")
+	s, errs = loadSettings([]string{"-owner-refresh", "0s"})
+	require.Empty(t, errs)
+	errs = s.Validate()
+	locs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		locs = append(locs, e.Location)
+	}
+	require.Equal(t, []string{"env NFT_PROTECTOR_MODE", "flag -owner-refresh", path + ":4:1"}, locs)
+	require.ErrorIs(t, config.Errors(errs), os.ErrNotExist)
+}
@@ -0,0 +1,121 @@
+package nft_protector
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/Morwran/nft-protect/internal/config"
+	nft_protector "github.com/Morwran/nft-protect/internal/nft-protector"
+	"github.com/Morwran/nft-protect/internal/owner"
+	"github.com/Morwran/nft-protect/internal/sink"
+
+	"github.com/pkg/errors"
+)
+
+// ValidateConfig loads the settings as ParseFlags does and reports every problem found with its location
+func ValidateConfig(args []string) error {
+	s, errs := loadSettings(args)
+	errs = append(errs, s.Validate()...)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate reports every problem of the settings with its location
+func (s Settings) Validate() (errs config.Errors) {
+	check := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, config.LocatedError{Location: s.origin(name), Err: err})
+		}
+	}
+	_, err := protectorConstructor(s.ProtectorType)
+	check("type", err)
+	_, err = nft_protector.ParseMode(s.Mode)
+	check("mode", err)
+	_, err = parseLogLevel(s.LogLevel)
+	check("level", err)
+	for _, item := range splitList(s.ProtectedTables) {
+		_, err = nft_protector.ParseTableKey(item)
+		check("table", err)
+	}
+	for _, item := range splitList(s.AuditTables) {
+		_, err = nft_protector.ParseTableKey(item)
+		check("audit-table", err)
+	}
+	for _, item := range splitList(s.OwnerPids) {
+		_, err = parsePid(item)
+		check("owner-pid", err)
+	}
+	for _, item := range splitList(s.OwnerExes) {
+		_, err = owner.ParseExeResolver(item)
+		check("owner-exe", err)
+	}
+	for _, item := range splitList(s.Updaters) {
+		_, err = owner.ParseExeResolver(item)
+		check("updater", err)
+	}
+	for _, item := range splitList(s.BreakGlass) {
+		_, err = owner.ParseExeResolver(item)
+		check("break-glass", err)
+	}
+	if s.FreezeTimeout < 0 {
+		check("freeze-timeout", errors.Errorf("freeze timeout must not be negative but it is %s", s.FreezeTimeout))
+	}
+	if s.OwnerRefresh <= 0 {
+		check("owner-refresh", errors.Errorf("owner refresh interval must be positive but it is %s", s.OwnerRefresh))
+	}
+	errs = append(errs, s.validatePolicy()...)
+	for _, item := range splitList(s.Sinks) {
+		_, err = sink.ParseSpec(item)
+		check("sink", err)
+	}
+	switch {
+	case s.RingbufReadTimeout <= 0:
+		check("ringbuf-read-timeout", errors.Errorf("read timeout must be positive but it is %s", s.RingbufReadTimeout))
+	case s.RingbufSize > math.MaxUint32:
+		check("ringbuf-size", errors.Errorf("ring buffer size %d is too big", s.RingbufSize))
+	default:
+		check("ringbuf-size", s.eventsOptions().Validate())
+	}
+	_, err = nft_protector.ParseShutdownPolicy(s.Shutdown)
+	check("shutdown", err)
+	if s.Learn < 0 {
+		check("learn", errors.Errorf("learning time must not be negative but it is %s", s.Learn))
+	}
+	return errs
+}
+
+// validatePolicy compiles every rule of the policy file, problems of rules are located in the file
+func (s Settings) validatePolicy() (errs config.Errors) {
+	if s.PolicyFile == "" {
+		return nil
+	}
+	p, err := config.LoadPolicy(s.PolicyFile)
+	if err != nil {
+		return locatedErrors(s.origin("policy"), err)
+	}
+	policy := make(nft_protector.Policy, 0, len(p.Rules))
+	for i, r := range p.Rules {
+		rule, _, err := compileRule(r)
+		if err != nil {
+			loc := p.Locations.Of(fmt.Sprintf("rules[%d]", i))
+			errs = append(errs, config.LocatedError{Location: loc, Err: err})
+			continue
+		}
+		policy = append(policy, rule)
+	}
+	if len(errs) == 0 {
+		if err = policy.Validate(); err != nil {
+			errs = append(errs, config.LocatedError{Location: p.Locations.Of("rules"), Err: err})
+		}
+	}
+	return errs
+}
+
+func (s Settings) eventsOptions() nft_protector.EventsOptions {
+	return nft_protector.EventsOptions{
+		RingbufSize: uint32(s.RingbufSize),
+		ReadTimeout: s.RingbufReadTimeout,
+	}
+}
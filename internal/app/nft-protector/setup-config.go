@@ -0,0 +1,246 @@
+package nft_protector
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+
+	"github.com/Morwran/nft-protect/internal/config"
+	"github.com/Morwran/nft-protect/internal/model"
+	nft_protector "github.com/Morwran/nft-protect/internal/nft-protector"
+	"github.com/Morwran/nft-protect/internal/owner"
+
+	"github.com/pkg/errors"
+)
+
+// protectorConfig is what the state of the protector is built from
+type protectorConfig struct {
+	tables        []nft_protector.TableKey
+	audited       []nft_protector.TableKey
+	mode          nft_protector.Mode
+	resolvers     []owner.Resolver
+	policy        nft_protector.Policy
+	subjects      [][]owner.Resolver // cgroups and executables of each policy rule
+	files         []string           // protected by -protect-files
+	updaters      []owner.Resolver   // allowed to modify the files
+	fileIDs       []model.ExeID
+	updaterIDs    []model.ExeOwner
+	breakGlass    []owner.Resolver // allowed to change nftables in the freeze
+	breakGlassIDs []model.ExeOwner
+}
+
+// appliedConfig is the configuration the running protector is built from
+var appliedConfig protectorConfig
+
+// fileConfig is the settings in the form of the config file
+func fileConfig(s Settings) (cfg config.Config, err error) {
+	cfg.Type = s.ProtectorType
+	cfg.Mode = s.Mode
+	cfg.LogLevel = s.LogLevel
+	cfg.Tables = splitList(s.ProtectedTables)
+	cfg.AuditTables = splitList(s.AuditTables)
+	cfg.Owners = config.Owners{
+		Names:    splitList(s.OwnerNames),
+		PidFiles: splitList(s.OwnerPidFiles),
+		Cgroups:  splitList(s.OwnerCgroups),
+		Exes:     splitList(s.OwnerExes),
+	}
+	for _, item := range splitList(s.OwnerPids) {
+		pid, err := parsePid(item)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Owners.Pids = append(cfg.Owners.Pids, pid)
+	}
+	cfg.OwnerRefresh = s.OwnerRefresh
+	cfg.Policy = s.PolicyFile
+	cfg.Sinks = splitList(s.Sinks)
+	cfg.Ringbuf = config.Ringbuf{Size: uint32(s.RingbufSize), ReadTimeout: s.RingbufReadTimeout}
+	cfg.Pin = s.Pin
+	cfg.Shutdown = s.Shutdown
+	cfg.Guard = s.Guard
+	cfg.ProtectFiles = s.ProtectFiles
+	cfg.Updaters = splitList(s.Updaters)
+	cfg.BreakGlass = splitList(s.BreakGlass)
+	cfg.FreezeTimeout = s.FreezeTimeout
+	return cfg, nil
+}
+
+func parsePid(s string) (uint32, error) {
+	pid, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || pid == 0 {
+		return 0, errors.Errorf("invalid owner pid '%s'", s)
+	}
+	return uint32(pid), nil
+}
+
+// loadProtectorConfig builds the protector configuration from the settings and the policy file
+func loadProtectorConfig(s Settings) (c protectorConfig, err error) {
+	cfg, err := fileConfig(s)
+	if err != nil {
+		return c, err
+	}
+	if c.mode, err = nft_protector.ParseMode(s.Mode); err != nil {
+		return c, errors.WithMessage(err, "parse mode")
+	}
+	if s.Learn > 0 {
+		c.mode = nft_protector.ModeAudit // learning must not break anybody
+	}
+	if c.tables, err = parseTables(cfg.Tables); err != nil {
+		return c, errors.WithMessage(err, "parse protected tables")
+	}
+	if c.audited, err = parseTables(cfg.AuditTables); err != nil {
+		return c, errors.WithMessage(err, "parse audit tables")
+	}
+	if c.resolvers, err = ownerResolvers(cfg.Owners); err != nil {
+		return c, errors.WithMessage(err, "setup owners")
+	}
+	if c.policy, c.subjects, err = setupPolicy(s); err != nil {
+		return c, errors.WithMessage(err, "setup policy")
+	}
+	if c.breakGlass, c.breakGlassIDs, err = resolveExes(cfg.BreakGlass); err != nil {
+		return c, errors.WithMessage(err, "setup break-glass owners")
+	}
+	if s.ProtectFiles {
+		err = c.setupProtectedFiles(s, cfg.Updaters)
+	}
+	return c, errors.WithMessage(err, "setup protected files")
+}
+
+// resolveExes resolves executables given in the form of owner exes
+func resolveExes(items []string) (resolvers []owner.Resolver, exes []model.ExeOwner, err error) {
+	for _, item := range items {
+		r, err := owner.ParseExeResolver(item)
+		if err != nil {
+			return nil, nil, err
+		}
+		resolvers = append(resolvers, r)
+	}
+	resolved, err := owner.ResolveAll(resolvers...)
+	return resolvers, resolved.Exes, err
+}
+
+// setupProtectedFiles identifies the files and resolves the updaters, a missing file is not protected
+func (c *protectorConfig) setupProtectedFiles(s Settings, updaters []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{s.ConfigFile, s.PolicyFile, exe} { // the pinned objects are protected with pinning
+		if path != "" {
+			c.files = append(c.files, path)
+		}
+	}
+	for _, path := range c.files {
+		id, err := owner.FileID(path)
+		if err != nil {
+			return err
+		}
+		if !id.IsZero() {
+			c.fileIDs = append(c.fileIDs, id)
+		}
+	}
+	c.updaters, c.updaterIDs, err = resolveExes(updaters)
+	return err
+}
+
+// state of the protector with the resolved owners and subjects of policy rules
+func (c protectorConfig) state(owners model.Owners, subjects []model.Owners) nft_protector.State {
+	policy := slices.Clone(c.policy)
+	for i := range policy {
+		if i >= len(subjects) {
+			break
+		}
+		policy[i].Subject.CgroupIDs = subjects[i].CgroupIDs
+		if len(subjects[i].Exes) > 0 {
+			policy[i].Subject.Exe = subjects[i].Exes[0].Exe
+		}
+	}
+	return nft_protector.State{
+		Owners:     owners,
+		Tables:     append(slices.Clone(c.tables), c.audited...),
+		Audited:    c.audited,
+		Mode:       c.mode,
+		Policy:     policy,
+		Files:      c.fileIDs,
+		Updaters:   c.updaterIDs,
+		BreakGlass: c.breakGlassIDs,
+	}
+}
+
+// apply returns the function which pushes the state with the resolved owners and subjects into the protector
+func (c protectorConfig) apply(protector nft_protector.Protector) func(model.Owners, []model.Owners) error {
+	return func(owners model.Owners, subjects []model.Owners) error {
+		return protector.Reload(c.state(owners, subjects))
+	}
+}
+
+// diff describes what is changed by the next configuration
+func (c protectorConfig) diff(next protectorConfig) (changes []string) {
+	changes = appendListDiff(changes, "tables", toStrings(c.tables), toStrings(next.tables))
+	changes = appendListDiff(changes, "audit tables", toStrings(c.audited), toStrings(next.audited))
+	changes = appendListDiff(changes, "owners", toStrings(c.resolvers), toStrings(next.resolvers))
+	changes = appendListDiff(changes, "protected files", c.files, next.files)
+	changes = appendListDiff(changes, "updaters", toStrings(c.updaters), toStrings(next.updaters))
+	changes = appendListDiff(changes, "break-glass owners", toStrings(c.breakGlass), toStrings(next.breakGlass))
+	if c.mode != next.mode {
+		changes = append(changes, fmt.Sprintf("mode %s -> %s", c.mode, next.mode))
+	}
+	return appendRulesDiff(changes, c.policy, next.policy)
+}
+
+func appendListDiff(changes []string, what string, old, next []string) []string {
+	var added, removed []string
+	for _, s := range next {
+		if !slices.Contains(old, s) {
+			added = append(added, s)
+		}
+	}
+	for _, s := range old {
+		if !slices.Contains(next, s) {
+			removed = append(removed, s)
+		}
+	}
+	if len(added) > 0 {
+		changes = append(changes, fmt.Sprintf("%s added %q", what, added))
+	}
+	if len(removed) > 0 {
+		changes = append(changes, fmt.Sprintf("%s removed %q", what, removed))
+	}
+	return changes
+}
+
+func appendRulesDiff(changes []string, old, next nft_protector.Policy) []string {
+	ids := func(p nft_protector.Policy) (ret []string) {
+		for i := range p {
+			ret = append(ret, p.RuleID(uint16(i+1)))
+		}
+		return ret
+	}
+	oldIDs, nextIDs := ids(old), ids(next)
+	n := len(changes)
+	changes = appendListDiff(changes, "rules", oldIDs, nextIDs)
+	var modified []string
+	for i, id := range nextIDs {
+		if j := slices.Index(oldIDs, id); j >= 0 && !reflect.DeepEqual(old[j], next[i]) {
+			modified = append(modified, id)
+		}
+	}
+	if len(modified) > 0 {
+		changes = append(changes, fmt.Sprintf("rules modified %q", modified))
+	}
+	if len(changes) == n && !slices.Equal(oldIDs, nextIDs) {
+		changes = append(changes, "rules reordered")
+	}
+	return changes
+}
+
+func toStrings[T fmt.Stringer](items []T) []string {
+	ret := make([]string, 0, len(items))
+	for _, item := range items {
+		ret = append(ret, item.String())
+	}
+	return ret
+}
@@ -2,22 +2,57 @@ package nft_protector
 
 import (
 	"context"
+	"syscall"
 
 	"github.com/Morwran/nft-protect/internal/app"
+	nft_protector "github.com/Morwran/nft-protect/internal/nft-protector"
 
 	"github.com/H-BF/corlib/logger"
+	"github.com/H-BF/corlib/pkg/patterns/observer"
 	"github.com/H-BF/corlib/pkg/signals"
 	"go.uber.org/zap"
 )
 
-// SetupContext setup app ctx
+var (
+	reloadRequests = make(chan struct{}, 1)
+	freezeRequests = make(chan bool, 1)
+)
+
+// SetupContext setup app ctx, SIGHUP requests reload of the configuration instead of exit,
+// SIGUSR1 and SIGUSR2 request to engage and lift the freeze
 func SetupContext() {
 	ctx, cancel := context.WithCancel(context.Background())
-	signals.WhenSignalExit(func() error {
-		logger.SetLevel(zap.InfoLevel)
-		logger.Info(ctx, "caught application stop signal")
-		cancel()
-		return nil
-	})
+	// signals.WhenSignalExit treats SIGHUP as exit signal too, so exit signals are observed here
+	signals.SubjOfSignalsFromOS().ObserversAttach(observer.NewObserver(func(event observer.EventType) {
+		switch event.(signals.SignalFromOS).Signal {
+		case syscall.SIGTERM, syscall.SIGINT, syscall.SIGABRT:
+			logger.SetLevel(zap.InfoLevel)
+			logger.Info(ctx, "caught application stop signal")
+			cancel()
+		case syscall.SIGHUP:
+			logger.Info(ctx, "caught reload signal")
+			select {
+			case reloadRequests <- struct{}{}:
+			default: // reload is pending yet
+			}
+		case nft_protector.FreezeSignal, nft_protector.ThawSignal:
+			freeze := event.(signals.SignalFromOS).Signal == nft_protector.FreezeSignal
+			select {
+			case <-freezeRequests: // the latest request wins
+			default:
+			}
+			freezeRequests <- freeze
+		}
+	}, true, signals.SignalFromOS{}))
 	app.SetContext(ctx)
 }
+
+// FreezeRequests gets true when the freeze has to be engaged and false when it has to be lifted
+func FreezeRequests() <-chan bool {
+	return freezeRequests
+}
+
+// ReloadRequests is signaled when the configuration has to be re-read
+func ReloadRequests() <-chan struct{} {
+	return reloadRequests
+}
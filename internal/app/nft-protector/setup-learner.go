@@ -0,0 +1,23 @@
+package nft_protector
+
+import (
+	"github.com/Morwran/nft-protect/internal/owner"
+)
+
+// SetupLearner returns nil if learning is off
+func SetupLearner() *owner.Learner {
+	if Current.Learn <= 0 {
+		return nil
+	}
+	return owner.NewLearner()
+}
+
+// WriteLearned writes the settings in force together with the learned owners to the learn output,
+// so the file can be used as the config file
+func WriteLearned(l *owner.Learner) error {
+	cfg, err := fileConfig(Current)
+	if err != nil {
+		return err
+	}
+	return l.WriteSuggestion(Current.LearnOutput, cfg)
+}
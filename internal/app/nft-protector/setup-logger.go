@@ -7,10 +7,17 @@ import (
 
 // SetupLogger setup app logger
 func SetupLogger(lvl string) error {
-	var l logger.LogLevel
-	if e := l.UnmarshalText([]byte(lvl)); e != nil {
-		return errors.Wrapf(e, "recognize '%s' logger level from config", lvl)
+	l, err := parseLogLevel(lvl)
+	if err != nil {
+		return err
 	}
 	logger.SetLevel(l)
 	return nil
 }
+
+func parseLogLevel(lvl string) (l logger.LogLevel, err error) {
+	if e := l.UnmarshalText([]byte(lvl)); e != nil {
+		return l, errors.Wrapf(e, "recognize '%s' logger level from config", lvl)
+	}
+	return l, nil
+}
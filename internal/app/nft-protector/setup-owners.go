@@ -0,0 +1,50 @@
+package nft_protector
+
+import (
+	"os"
+
+	"github.com/Morwran/nft-protect/internal/config"
+	nft_protector "github.com/Morwran/nft-protect/internal/nft-protector"
+	"github.com/Morwran/nft-protect/internal/owner"
+
+	"github.com/pkg/errors"
+)
+
+// SetupOwnerWatcher setup watcher which keeps protector owners and subjects of policy rules up to date
+func SetupOwnerWatcher(protector nft_protector.Protector) (*owner.Watcher, error) {
+	if Current.OwnerRefresh <= 0 {
+		return nil, errors.Errorf("owner refresh interval must be positive but it is %s", Current.OwnerRefresh)
+	}
+	return &owner.Watcher{
+		Resolvers: appliedConfig.resolvers,
+		Subjects:  appliedConfig.subjects,
+		Interval:  Current.OwnerRefresh,
+		OnChange:  appliedConfig.apply(protector),
+	}, nil
+}
+
+func ownerResolvers(o config.Owners) (resolvers []owner.Resolver, err error) {
+	for _, pid := range o.Pids {
+		resolvers = append(resolvers, owner.PidResolver(pid))
+	}
+	for _, s := range o.Names {
+		resolvers = append(resolvers, owner.NameResolver(s))
+	}
+	for _, s := range o.PidFiles {
+		resolvers = append(resolvers, owner.PidFileResolver(s))
+	}
+	for _, s := range o.Cgroups {
+		resolvers = append(resolvers, owner.CgroupResolver(s))
+	}
+	for _, s := range o.Exes {
+		r, e := owner.ParseExeResolver(s)
+		if e != nil {
+			return nil, e
+		}
+		resolvers = append(resolvers, r)
+	}
+	if len(resolvers) == 0 {
+		resolvers = append(resolvers, owner.PidResolver(os.Getpid()))
+	}
+	return resolvers, nil
+}
@@ -0,0 +1,110 @@
+package nft_protector
+
+import (
+	"fmt"
+
+	"github.com/Morwran/nft-protect/internal/config"
+	"github.com/Morwran/nft-protect/internal/model"
+	nft_protector "github.com/Morwran/nft-protect/internal/nft-protector"
+	"github.com/Morwran/nft-protect/internal/owner"
+
+	"github.com/pkg/errors"
+)
+
+// setupPolicy loads the policy file if it is set, subjects are resolvers of cgroups and executables of each rule
+func setupPolicy(s Settings) (nft_protector.Policy, [][]owner.Resolver, error) {
+	if s.PolicyFile == "" {
+		return nil, nil, nil
+	}
+	cfg, err := config.LoadPolicy(s.PolicyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return compilePolicy(cfg)
+}
+
+func compilePolicy(cfg config.Policy) (nft_protector.Policy, [][]owner.Resolver, error) {
+	policy := make(nft_protector.Policy, 0, len(cfg.Rules))
+	subjects := make([][]owner.Resolver, 0, len(cfg.Rules))
+	for i, r := range cfg.Rules {
+		rule, resolvers, err := compileRule(r)
+		if err != nil {
+			id := r.ID
+			if id == "" {
+				id = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, nil, errors.WithMessagef(err, "policy rule '%s'", id)
+		}
+		policy = append(policy, rule)
+		subjects = append(subjects, resolvers)
+	}
+	return policy, subjects, policy.Validate()
+}
+
+// compileRule compiles the rule, its cgroup and executable are resolved by the returned resolvers
+// like owners, so they are kept up to date by the owner watcher
+func compileRule(r config.Rule) (rule nft_protector.Rule, resolvers []owner.Resolver, err error) {
+	rule.ID = r.ID
+	if rule.Verdict, err = nft_protector.ParseRuleVerdict(r.Verdict); err != nil {
+		return rule, nil, err
+	}
+	rule.Subject = nft_protector.RuleSubject{
+		Pid:    r.Subject.Pid,
+		Uid:    r.Subject.Uid,
+		Comm:   r.Subject.Comm,
+		Cgroup: r.Subject.Cgroup,
+	}
+	if r.Subject.Cgroup != "" {
+		cg := owner.CgroupResolver(r.Subject.Cgroup)
+		if _, err = owner.ResolveAll(cg); err != nil {
+			return rule, nil, err
+		}
+		resolvers = append(resolvers, cg)
+	}
+	if r.Subject.Exe != "" {
+		exe, err := ruleExeResolver(r.Subject.Exe)
+		if err != nil {
+			return rule, nil, err
+		}
+		rule.Subject.ExePath = exe.Path
+		resolvers = append(resolvers, exe)
+	}
+	rule.Object = nft_protector.RuleObject{
+		Table: r.Object.Table,
+		Chain: r.Object.Chain,
+		Set:   r.Object.Set,
+	}
+	if r.Object.Family != "" {
+		if rule.Object.Family, err = nft_protector.ParseFamily(r.Object.Family); err != nil {
+			return rule, nil, err
+		}
+	}
+	for _, op := range r.Operations {
+		t, err := nft_protector.ParseNftMsgType(op)
+		if err != nil {
+			return rule, nil, err
+		}
+		rule.Ops = append(rule.Ops, t)
+	}
+	return rule, resolvers, nil
+}
+
+// ruleExeResolver parses the executable of the rule, a missing one is an error to catch typos.
+// If it disappears later the rule matches nothing until it is back.
+func ruleExeResolver(s string) (*owner.ExeResolver, error) {
+	r, err := owner.ParseExeResolver(s)
+	if err != nil {
+		return nil, err
+	}
+	if r.Parent != "" {
+		return nil, errors.Errorf("executable '%s': parent is not supported in rules", r.Path)
+	}
+	var owners model.Owners
+	if err = r.Resolve(&owners); err != nil {
+		return nil, err
+	}
+	if len(owners.Exes) == 0 {
+		return nil, errors.Errorf("executable '%s' is not found", r.Path)
+	}
+	return r, nil
+}
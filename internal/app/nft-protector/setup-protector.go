@@ -1,33 +1,163 @@
 package nft_protector
 
 import (
-	"os"
+	"context"
 	"strings"
+	"sync"
 
+	"github.com/Morwran/nft-protect/internal/model"
 	nft_protector "github.com/Morwran/nft-protect/internal/nft-protector"
+	"github.com/Morwran/nft-protect/internal/owner"
 
+	"github.com/H-BF/corlib/logger"
 	"github.com/pkg/errors"
 )
 
-type protectConstrutor func(pid uint32, protectedTblName string) (nft_protector.Protector, error)
+type protectConstrutor func(opts nft_protector.Options, owners model.Owners, protectedTbls []nft_protector.TableKey) (nft_protector.Protector, error)
 
 var protectConstrutors = map[string]protectConstrutor{
-	"lsm":   setupLsmProtector,
-	"nlbpf": setupNlBpfProtector,
+	"auto":    setupAutoProtector,
+	"lsm":     setupLsmProtector,
+	"fmodret": setupFmodRetProtector,
+	"nlbpf":   setupNlBpfProtector,
 }
 
 func SetupProtector() (nft_protector.Protector, error) {
-	protector, ok := protectConstrutors[strings.ToLower(strings.TrimSpace(ProtectorType))]
+	protector, err := protectorConstructor(Current.ProtectorType)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := Current.protectorOptions()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadProtectorConfig(Current)
+	if err != nil {
+		return nil, err
+	}
+	owners, err := owner.ResolveAll(cfg.resolvers...)
+	if err != nil {
+		return nil, errors.WithMessage(err, "setup owners")
+	}
+	subjects, err := owner.ResolveEach(cfg.subjects)
+	if err != nil {
+		return nil, errors.WithMessage(err, "setup subjects of policy rules")
+	}
+	st := cfg.state(owners, subjects)
+	p, err := protector(opts, owners, st.Tables)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.Reload(st); err != nil {
+		_ = p.Close()
+		return nil, errors.WithMessage(err, "setup protector state")
+	}
+	appliedConfig = cfg
+	return p, nil
+}
+
+var onceShutdown sync.Once
+
+// ShutdownProtector closes the protector and logs what protects tables after exit
+func ShutdownProtector(ctx context.Context, p nft_protector.Protector) {
+	onceShutdown.Do(func() {
+		caps := p.Capabilities()
+		_ = p.Close()
+		shutdown, _ := nft_protector.ParseShutdownPolicy(Current.Shutdown)
+		switch {
+		case shutdown == nft_protector.ShutdownClosed:
+			logger.Infof(ctx, "fail-closed shutdown: protected tables are locked down on exit until 'nft-protector unlock'")
+		case Current.Pin:
+			logger.Infof(ctx, "fail-open shutdown: the pinned program keeps the last policy in force")
+		default:
+			logger.Infof(ctx, "fail-open shutdown: tables are not protected any more")
+		}
+		if !caps.Enforcing {
+			logger.Warnf(ctx, "protector '%s' does not deny changes, nothing is enforced after exit", caps.Backend)
+		}
+	})
+}
+
+// ToggleFreeze engages the freeze of nftables for -freeze-timeout or lifts it
+func ToggleFreeze(ctx context.Context, p nft_protector.Protector, freeze bool) error {
+	if !freeze {
+		if err := p.Thaw(); err != nil {
+			return err
+		}
+		logger.Info(ctx, "the freeze is lifted")
+		return nil
+	}
+	if err := p.Freeze(Current.FreezeTimeout); err != nil {
+		return err
+	}
+	until := "until thaw"
+	if Current.FreezeTimeout > 0 {
+		until = "for " + Current.FreezeTimeout.String()
+	}
+	logger.Warnf(ctx, "the freeze is engaged %s, only break-glass owners may change nftables", until)
+	if caps := p.Capabilities(); !caps.Enforcing {
+		logger.Warnf(ctx, "protector '%s' does not deny changes, the freeze is only reported", caps.Backend)
+	}
+	return nil
+}
+
+// protectorOptions are options of the backend, they are fixed until restart
+func (s Settings) protectorOptions() (nft_protector.Options, error) {
+	shutdown, err := nft_protector.ParseShutdownPolicy(s.Shutdown)
+	if err != nil {
+		return nft_protector.Options{}, err
+	}
+	opts := nft_protector.Options{
+		Events:       s.eventsOptions(),
+		Pin:          s.Pin || shutdown == nft_protector.ShutdownClosed,
+		Shutdown:     shutdown,
+		Guard:        s.Guard,
+		ProtectFiles: s.ProtectFiles,
+	}
+	return opts, errors.WithMessage(opts.Validate(), "setup protector options")
+}
+
+func protectorConstructor(typ string) (protectConstrutor, error) {
+	protector, ok := protectConstrutors[strings.ToLower(strings.TrimSpace(typ))]
 	if !ok {
-		return nil, errors.Errorf("unknown type of protection '%s'", ProtectorType)
+		return nil, errors.Errorf("unknown type of protection '%s'", typ)
+	}
+	return protector, nil
+}
+
+func parseTables(items []string) ([]nft_protector.TableKey, error) {
+	var ret []nft_protector.TableKey
+	for _, item := range items {
+		tbl, err := nft_protector.ParseTableKey(item)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, tbl)
+	}
+	return ret, nil
+}
+
+func splitList(s string) (ret []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
 	}
-	return protector(uint32(os.Getpid()), strings.TrimSpace(ProtectedTableName))
+	return ret
+}
+
+func setupAutoProtector(opts nft_protector.Options, owners model.Owners, protectedTbls []nft_protector.TableKey) (nft_protector.Protector, error) {
+	return nft_protector.NewAutoProtector(opts, owners, protectedTbls...)
+}
+
+func setupLsmProtector(opts nft_protector.Options, owners model.Owners, protectedTbls []nft_protector.TableKey) (nft_protector.Protector, error) {
+	return nft_protector.NewLsmEbpfProtector(opts, owners, protectedTbls...)
 }
 
-func setupLsmProtector(pid uint32, protectedTblName string) (nft_protector.Protector, error) {
-	return nft_protector.NewLsmEbpfProtector(pid, protectedTblName)
+func setupFmodRetProtector(opts nft_protector.Options, owners model.Owners, protectedTbls []nft_protector.TableKey) (nft_protector.Protector, error) {
+	return nft_protector.NewFmodRetProtector(opts, owners, protectedTbls...)
 }
 
-func setupNlBpfProtector(pid uint32, protectedTblName string) (nft_protector.Protector, error) {
-	return nft_protector.NewNlBpfProtector(pid, protectedTblName)
+func setupNlBpfProtector(opts nft_protector.Options, owners model.Owners, protectedTbls []nft_protector.TableKey) (nft_protector.Protector, error) {
+	return nft_protector.NewNlBpfProtector(opts, owners, protectedTbls...)
 }
@@ -0,0 +1,84 @@
+package nft_protector
+
+import (
+	"context"
+	"strings"
+
+	nft_protector "github.com/Morwran/nft-protect/internal/nft-protector"
+	"github.com/Morwran/nft-protect/internal/owner"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/pkg/errors"
+)
+
+// Reload re-reads the settings and pushes them into the running protector at once,
+// the running settings are kept if the new ones are invalid
+func Reload(ctx context.Context, protector nft_protector.Protector, watcher *owner.Watcher) error {
+	s, errs := loadSettings(cmdArgs)
+	if len(errs) == 0 {
+		errs = s.Validate()
+	}
+	if len(errs) > 0 {
+		return errors.WithMessage(errs, "load settings")
+	}
+	// the settings in force are kept until restart, so the configuration is built with them
+	restartOnly := Current.restartOnly(s)
+	s.ProtectorType, s.OwnerRefresh, s.Sinks = Current.ProtectorType, Current.OwnerRefresh, Current.Sinks
+	s.RingbufSize, s.RingbufReadTimeout, s.Pin = Current.RingbufSize, Current.RingbufReadTimeout, Current.Pin
+	s.Shutdown, s.Guard, s.ProtectFiles = Current.Shutdown, Current.Guard, Current.ProtectFiles
+	cfg, err := loadProtectorConfig(s)
+	if err != nil {
+		return errors.WithMessage(err, "load configuration")
+	}
+	err = watcher.Replace(cfg.resolvers, cfg.subjects, cfg.apply(protector))
+	if err != nil {
+		return errors.WithMessage(err, "apply configuration")
+	}
+	changes := appliedConfig.diff(cfg)
+	if s.LogLevel != Current.LogLevel {
+		changes = append(changes, "log level "+Current.LogLevel+" -> "+s.LogLevel)
+		_ = SetupLogger(s.LogLevel)
+	}
+	for _, name := range restartOnly {
+		logger.Warnf(ctx, "-%s is changed, it takes effect after restart", name)
+	}
+	appliedConfig, Current = cfg, s
+	if len(changes) == 0 {
+		logger.Info(ctx, "configuration is reloaded, nothing has changed")
+	} else {
+		logger.Infof(ctx, "configuration is reloaded: %s", strings.Join(changes, "; "))
+	}
+	return nil
+}
+
+// restartOnly returns flags of settings changed by next which are not applied by reload
+func (s Settings) restartOnly(next Settings) (ret []string) {
+	if s.ProtectorType != next.ProtectorType {
+		ret = append(ret, "type")
+	}
+	if s.OwnerRefresh != next.OwnerRefresh {
+		ret = append(ret, "owner-refresh")
+	}
+	if s.Sinks != next.Sinks {
+		ret = append(ret, "sink")
+	}
+	if s.RingbufSize != next.RingbufSize {
+		ret = append(ret, "ringbuf-size")
+	}
+	if s.RingbufReadTimeout != next.RingbufReadTimeout {
+		ret = append(ret, "ringbuf-read-timeout")
+	}
+	if s.Pin != next.Pin {
+		ret = append(ret, "pin")
+	}
+	if s.Shutdown != next.Shutdown {
+		ret = append(ret, "shutdown")
+	}
+	if s.Guard != next.Guard {
+		ret = append(ret, "guard")
+	}
+	if s.ProtectFiles != next.ProtectFiles {
+		ret = append(ret, "protect-files")
+	}
+	return ret
+}
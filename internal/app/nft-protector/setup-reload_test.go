@@ -0,0 +1,73 @@
+package nft_protector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	nft_protector "github.com/Morwran/nft-protect/internal/nft-protector"
+	"github.com/Morwran/nft-protect/internal/owner"
+
+	"github.com/stretchr/testify/require"
+)
+
+// reloadedProtector keeps the states pushed by Reload
+type reloadedProtector struct {
+	nft_protector.Protector
+	states []nft_protector.State
+}
+
+func (p *reloadedProtector) Reload(st nft_protector.State) error {
+	p.states = append(p.states, st)
+	return nil
+}
+
+func Test_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nft-protector.yaml")
+	writeConfig := func(data string) {
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	}
+	args, cur, applied := cmdArgs, Current, appliedConfig
+	t.Cleanup(func() {
+		cmdArgs, Current, appliedConfig = args, cur, applied
+	})
+
+	writeConfig("type: nlbpf\nmode: enforce\ntables: [inet filter]\n")
+	require.NoError(t, ParseFlags([]string{"-config", path}))
+	writeConfig("type: lsm\nmode: audit\ntables: [inet filter, ip nat]\nowner-refresh: 1m\npin: true\n")
+	var p reloadedProtector
+	require.NoError(t, Reload(context.Background(), &p, &owner.Watcher{}))
+	require.Len(t, p.states, 1)
+	require.Equal(t, nft_protector.ModeAudit, p.states[0].Mode, "mode is applied")
+	require.Len(t, p.states[0].Tables, 2, "tables are applied")
+	require.Equal(t, "audit", Current.Mode)
+	require.Equal(t, "nlbpf", Current.ProtectorType, "type is kept until restart")
+	require.Equal(t, 2*time.Second, Current.OwnerRefresh, "owner refresh is kept until restart")
+	require.False(t, Current.Pin, "pinning is kept until restart")
+
+	writeConfig("type: nlbpf\nmode: enforc\n")
+	require.Error(t, Reload(context.Background(), &p, &owner.Watcher{}))
+	require.Len(t, p.states, 1, "invalid settings are not applied")
+	require.Equal(t, "audit", Current.Mode)
+}
+
+func Test_SettingsRestartOnly(t *testing.T) {
+	cur := Settings{
+		ProtectorType: "auto",
+		OwnerRefresh:  time.Second,
+		Mode:          "enforce",
+		LogLevel:      "INFO",
+		Shutdown:      "open",
+	}
+	next := cur
+	next.Mode, next.LogLevel, next.ProtectedTables = "audit", "DEBUG", "inet filter"
+	require.Empty(t, cur.restartOnly(next), "reload applies mode, log level and tables")
+
+	next.ProtectorType, next.OwnerRefresh, next.Sinks = "lsm", time.Minute, "json:-"
+	next.RingbufSize, next.RingbufReadTimeout = 1<<20, time.Minute
+	next.Pin, next.Shutdown, next.Guard, next.ProtectFiles = true, "closed", true, true
+	require.Equal(t, []string{"type", "owner-refresh", "sink", "ringbuf-size", "ringbuf-read-timeout",
+		"pin", "shutdown", "guard", "protect-files"}, cur.restartOnly(next))
+}
@@ -0,0 +1,27 @@
+package nft_protector
+
+import (
+	"github.com/Morwran/nft-protect/internal/sink"
+
+	"github.com/pkg/errors"
+)
+
+// SetupSinks opens sinks events are written to
+func SetupSinks() ([]sink.Sink, error) {
+	var ret []sink.Sink
+	for _, item := range splitList(Current.Sinks) {
+		spec, err := sink.ParseSpec(item)
+		if err == nil {
+			var s sink.Sink
+			if s, err = spec.Open(); err == nil {
+				ret = append(ret, s)
+				continue
+			}
+		}
+		for _, s := range ret {
+			_ = s.Close()
+		}
+		return nil, errors.WithMessage(err, "setup sinks")
+	}
+	return ret, nil
+}
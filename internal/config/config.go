@@ -0,0 +1,209 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// Config is the file configuration of nft-protector, values are in the same form as the flags.
+	// Flags and environment variables override the values of the file.
+	Config struct {
+		Type          string        `yaml:"type,omitempty"`
+		Mode          string        `yaml:"mode,omitempty"`
+		LogLevel      string        `yaml:"log-level,omitempty"`
+		Tables        []string      `yaml:"tables,omitempty"`
+		AuditTables   []string      `yaml:"audit-tables,omitempty"`
+		Owners        Owners        `yaml:"owners,omitempty"`
+		OwnerRefresh  time.Duration `yaml:"owner-refresh,omitempty"`
+		Policy        string        `yaml:"policy,omitempty"`
+		Sinks         []string      `yaml:"sinks,omitempty"`
+		Ringbuf       Ringbuf       `yaml:"ringbuf,omitempty"`
+		Pin           bool          `yaml:"pin,omitempty"`
+		Shutdown      string        `yaml:"shutdown,omitempty"`
+		Guard         bool          `yaml:"guard,omitempty"`
+		ProtectFiles  bool          `yaml:"protect-files,omitempty"`
+		Updaters      []string      `yaml:"updaters,omitempty"`    // in the same form as owner exes
+		BreakGlass    []string      `yaml:"break-glass,omitempty"` // in the same form as owner exes
+		FreezeTimeout time.Duration `yaml:"freeze-timeout,omitempty"`
+
+		Locations Locations `yaml:"-"`
+	}
+
+	// Owners are processes allowed to modify protected tables
+	Owners struct {
+		Pids     []uint32 `yaml:"pids,omitempty"`
+		Names    []string `yaml:"names,omitempty"`
+		PidFiles []string `yaml:"pidfiles,omitempty"`
+		Cgroups  []string `yaml:"cgroups,omitempty"`
+		Exes     []string `yaml:"exes,omitempty"`
+	}
+
+	// Ringbuf are settings of the ring buffer events are read from
+	Ringbuf struct {
+		Size        uint32        `yaml:"size,omitempty"` // bytes, power of 2 multiple of the page size
+		ReadTimeout time.Duration `yaml:"read-timeout,omitempty"`
+	}
+
+	// Locations maps keys like 'owners.names' or 'rules[2]' to 'file:line:column'
+	Locations map[string]string
+
+	// LocatedError is the problem found at the location
+	LocatedError struct {
+		Location string
+		Err      error
+	}
+
+	// Errors are all problems found in the file
+	Errors []LocatedError
+)
+
+func (e LocatedError) Error() string {
+	return e.Location + ": " + e.Err.Error()
+}
+
+func (e LocatedError) Unwrap() error {
+	return e.Err
+}
+
+func (e Errors) Unwrap() []error {
+	ret := make([]error, 0, len(e))
+	for _, le := range e {
+		ret = append(ret, le)
+	}
+	return ret
+}
+
+func (e Errors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, le := range e {
+		lines = append(lines, le.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Of returns the location of the key, the closest known parent key or the file is returned if the key is unknown
+func (l Locations) Of(key string) string {
+	for k := key; k != ""; {
+		if loc, ok := l[k]; ok {
+			return loc
+		}
+		i := strings.LastIndexAny(k, ".[")
+		if i < 0 {
+			break
+		}
+		k = k[:i]
+	}
+	return l[""]
+}
+
+type (
+	// Policy is the ordered list of rules, the first matching rule decides
+	Policy struct {
+		Rules []Rule `yaml:"rules"`
+
+		Locations Locations `yaml:"-"`
+	}
+
+	// Rule gives the verdict to the subject changing the object by one of the operations,
+	// empty fields match anything
+	Rule struct {
+		ID         string      `yaml:"id,omitempty"`
+		Subject    RuleSubject `yaml:"subject,omitempty"`
+		Object     RuleObject  `yaml:"object,omitempty"`
+		Operations []string    `yaml:"operations,omitempty"` // e.g. NEWSETELEM, DELRULE
+		Verdict    string      `yaml:"verdict"`              // allow|deny|audit
+	}
+
+	RuleSubject struct {
+		Pid    uint32  `yaml:"pid,omitempty"`
+		Uid    *uint32 `yaml:"uid,omitempty"`
+		Comm   string  `yaml:"comm,omitempty"`
+		Cgroup string  `yaml:"cgroup,omitempty"` // in the same form as owner cgroup, re-resolved every owner-refresh
+		Exe    string  `yaml:"exe,omitempty"`    // in the same form as owner exe without parent, re-resolved too
+	}
+
+	RuleObject struct {
+		Family string `yaml:"family,omitempty"`
+		Table  string `yaml:"table,omitempty"`
+		Chain  string `yaml:"chain,omitempty"`
+		Set    string `yaml:"set,omitempty"`
+	}
+)
+
+// Load reads the configuration file, unknown fields are errors
+func Load(path string) (cfg Config, err error) {
+	cfg.Locations, err = decodeFile(path, &cfg)
+	return cfg, err
+}
+
+// LoadPolicy reads the policy file, unknown fields are errors
+func LoadPolicy(path string) (p Policy, err error) {
+	p.Locations, err = decodeFile(path, &p)
+	return p, err
+}
+
+// decodeFile decodes the file strictly and returns locations of its keys,
+// all problems of the file are returned as Errors
+func decodeFile(path string, v any) (Locations, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read '%s'", path)
+	}
+	locs := Locations{"": path}
+	var root yaml.Node
+	if err = yaml.Unmarshal(data, &root); err != nil {
+		return locs, Errors{{Location: path, Err: err}}
+	}
+	if len(root.Content) > 0 {
+		locate(locs, path, "", root.Content[0])
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(v)
+	var typeErr *yaml.TypeError
+	switch {
+	case err == nil || errors.Is(err, io.EOF):
+		return locs, nil
+	case errors.As(err, &typeErr):
+		errs := make(Errors, 0, len(typeErr.Errors))
+		for _, e := range typeErr.Errors {
+			// e.g. 'line 3: field foo not found in type config.Config'
+			loc := path
+			if line, msg, ok := strings.Cut(strings.TrimPrefix(e, "line "), ": "); ok && line != e {
+				loc, e = path+":"+line, msg
+			}
+			errs = append(errs, LocatedError{Location: loc, Err: errors.New(e)})
+		}
+		return locs, errs
+	}
+	return locs, Errors{{Location: path, Err: err}}
+}
+
+// locate records positions of keys and sequence items under the node
+func locate(locs Locations, path, key string, n *yaml.Node) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i].Value
+			if key != "" {
+				k = key + "." + k
+			}
+			locs[k] = fmt.Sprintf("%s:%d:%d", path, n.Content[i].Line, n.Content[i].Column)
+			locate(locs, path, k, n.Content[i+1])
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			k := fmt.Sprintf("%s[%d]", key, i)
+			locs[k] = fmt.Sprintf("%s:%d:%d", path, c.Line, c.Column)
+			locate(locs, path, k, c)
+		}
+	}
+}
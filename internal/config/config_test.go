@@ -0,0 +1,47 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Load(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nft-protector.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`mode: audit
+tables:
+  - inet filter
+  - nat
+owners:
+  names: [fw-agent]
+owner-refresh: 5s
+ringbuf:
+  size: 4096
+`), 0o600))
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	require.Equal(t, "audit", cfg.Mode)
+	require.Equal(t, []string{"inet filter", "nat"}, cfg.Tables)
+	require.Equal(t, []string{"fw-agent"}, cfg.Owners.Names)
+	require.Equal(t, 5*time.Second, cfg.OwnerRefresh)
+	require.Equal(t, uint32(4096), cfg.Ringbuf.Size)
+	require.Equal(t, path+":4:5", cfg.Locations.Of("tables[1]"))
+	require.Equal(t, path+":6:3", cfg.Locations.Of("owners.names"))
+	require.Equal(t, path, cfg.Locations.Of("sinks[0]"))
+
+	require.NoError(t, os.WriteFile(path, []byte(`mode: audit
+owners:
+  name: [fw-agent]
+table: nat
+`), 0o600))
+	_, err = Load(path)
+	var errs Errors
+	require.ErrorAs(t, err, &errs)
+	require.Len(t, errs, 2, "every unknown field is reported")
+	require.Equal(t, path+":3", errs[0].Location)
+	require.Equal(t, path+":4", errs[1].Location)
+}
@@ -12,12 +12,17 @@ import (
 	"github.com/shirou/gopsutil/v3/host"
 )
 
-const kernelModulesFile = "/proc/modules"
+const (
+	kernelModulesFile = "/proc/modules"
+	kernelSymbolsFile = "/proc/kallsyms"
+	activeLsmFile     = "/sys/kernel/security/lsm"
+)
 
 var (
 	kernelVersionRe = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
 	btfConfigRe     = regexp.MustCompile(`^CONFIG_DEBUG_INFO_BTF\s*=\s*y`)
 	lsmConfigRe     = regexp.MustCompile(`^CONFIG_BPF_LSM\s*=\s*y`)
+	securityRe      = regexp.MustCompile(`^CONFIG_SECURITY\s*=\s*y`)
 	lsmGrubOptionRe = regexp.MustCompile(`^GRUB_CMDLINE_LINUX_DEFAULT="[^"]*\blsm=bpf\b[^"]*"`)
 )
 
@@ -66,6 +71,47 @@ func CheckLsmBpfKernelSupport() error {
 	return errors.WithMessage(checkKernelConfigByRe(lsmConfigRe), "LSM BPF support")
 }
 
+// CheckSecurityKernelSupport checks the security_* hooks are real functions a program can be attached to
+func CheckSecurityKernelSupport() error {
+	return errors.WithMessage(checkKernelConfigByRe(securityRe), "security hooks support")
+}
+
+// CheckLsmBpfActive checks BPF LSM is in the list of active LSMs, otherwise LSM programs attach but are never called
+func CheckLsmBpfActive() error {
+	data, err := os.ReadFile(activeLsmFile)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to read %s", activeLsmFile)
+	}
+	for _, lsm := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		if lsm == "bpf" {
+			return nil
+		}
+	}
+	return errors.Errorf("BPF LSM is not active, active LSMs are '%s'", strings.TrimSpace(string(data)))
+}
+
+// CheckKernelSymbol checks the kernel or a loaded module has the symbol e.g. to attach a kprobe to it
+func CheckKernelSymbol(name string) error {
+	file, err := os.Open(kernelSymbolsFile)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to open %s", kernelSymbolsFile)
+	}
+	defer file.Close() //nolint:errcheck
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// address type name [module]
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[2] == name {
+			return nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return errors.WithMessagef(err, "error reading %s", kernelSymbolsFile)
+	}
+	return errors.Errorf("kernel symbol '%s' is not found", name)
+}
+
 func CheckLsmBpfGrubOption() error {
 	return errors.WithMessage(checkConfigByRe("/etc/default/grub", lsmGrubOptionRe), "LSM BPF grub option")
 }
@@ -1,12 +1,86 @@
 package model
 
+import (
+	"cmp"
+	"slices"
+)
+
 type (
 	ProcessInfo struct {
-		Pid  uint32
-		Name string
+		Pid      uint32
+		Name     string
+		Family   string
+		Table    string
+		MsgType  string
+		Reason   string
+		Verdict  string
+		Uid      uint32
+		CgroupID uint64
+		Exe      ExeID
+		Rule     string
+		// TargetPid is the process a tamper attempt is aimed at
+		TargetPid uint32
+		// File is the name of the protected file a tamper attempt is aimed at
+		File string
+	}
+
+	// Owners are identities of processes allowed to modify protected tables
+	Owners struct {
+		Pids      []uint32
+		CgroupIDs []uint64
+		Exes      []ExeOwner
+	}
+
+	// ExeID identifies executable file by inode and device as kernel sees it
+	ExeID struct {
+		Ino uint64
+		Dev uint32
+	}
+
+	// ExeOwner is an executable allowed to be an owner. If Parent is not zero
+	// the process also has to be launched by the Parent executable
+	ExeOwner struct {
+		Exe    ExeID
+		Parent ExeID
 	}
 )
 
 func (p *ProcessInfo) Reset() {
 	*p = ProcessInfo{}
 }
+
+// Normalize sorts identities and removes duplicates
+func (o *Owners) Normalize() {
+	slices.Sort(o.Pids)
+	o.Pids = slices.Compact(o.Pids)
+	slices.Sort(o.CgroupIDs)
+	o.CgroupIDs = slices.Compact(o.CgroupIDs)
+	slices.SortFunc(o.Exes, compareExeOwners)
+	o.Exes = slices.Compact(o.Exes)
+}
+
+// Equal checks if normalized owners are the same
+func (o Owners) Equal(other Owners) bool {
+	return slices.Equal(o.Pids, other.Pids) &&
+		slices.Equal(o.CgroupIDs, other.CgroupIDs) &&
+		slices.Equal(o.Exes, other.Exes)
+}
+
+// IsZero checks if exe id is not set
+func (id ExeID) IsZero() bool {
+	return id == ExeID{}
+}
+
+func compareExeIDs(a, b ExeID) int {
+	if c := cmp.Compare(a.Dev, b.Dev); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Ino, b.Ino)
+}
+
+func compareExeOwners(a, b ExeOwner) int {
+	if c := compareExeIDs(a.Exe, b.Exe); c != 0 {
+		return c
+	}
+	return compareExeIDs(a.Parent, b.Parent)
+}
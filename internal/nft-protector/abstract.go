@@ -2,6 +2,7 @@ package nft_protector
 
 import (
 	"context"
+	"time"
 
 	"github.com/Morwran/nft-protect/internal/model"
 )
@@ -13,5 +14,14 @@ type (
 		Run(context.Context) error
 		Close() error
 		EvtReader() <-chan model.ProcessInfo
+		AddProtectedTables(tables ...TableKey) error
+		RemoveProtectedTables(tables ...TableKey) error
+		SetOwners(model.Owners) error
+		SetMode(mode Mode, tables ...TableKey) error
+		SetPolicy(Policy) error
+		Reload(State) error
+		Freeze(d time.Duration) error
+		Thaw() error
+		Capabilities() Capabilities
 	}
 )
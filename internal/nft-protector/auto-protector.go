@@ -0,0 +1,271 @@
+package nft_protector
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/H-BF/corlib/pkg/queue"
+	"github.com/pkg/errors"
+)
+
+var _ Protector = (*autoProtector)(nil)
+
+type (
+	// bpfBackend is a protector built on bpfProtector
+	bpfBackend interface {
+		Protector
+		state() State
+		frozen() (left time.Duration, ok bool)
+	}
+
+	autoBackend struct {
+		name  string
+		build func(opts Options, owners model.Owners, protectedTbls []TableKey) (bpfBackend, error)
+	}
+
+	// autoProtector uses the strongest backend the kernel supports and
+	// falls back to the next one if the program can't be attached
+	autoProtector struct {
+		mu        sync.Mutex
+		opts      Options
+		cur       bpfBackend
+		idx       int
+		skipped   []string
+		que       queue.FIFO[model.ProcessInfo]
+		onceRun   sync.Once
+		onceClose sync.Once
+		closed    bool
+	}
+)
+
+// autoBackends are ordered from the strongest
+var autoBackends = []autoBackend{
+	{name: "lsm", build: func(opts Options, owners model.Owners, protectedTbls []TableKey) (bpfBackend, error) {
+		p, err := NewLsmEbpfProtector(opts, owners, protectedTbls...)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}},
+	{name: "fmodret", build: func(opts Options, owners model.Owners, protectedTbls []TableKey) (bpfBackend, error) {
+		p, err := NewFmodRetProtector(opts, owners, protectedTbls...)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}},
+	{name: "nlbpf", build: func(opts Options, owners model.Owners, protectedTbls []TableKey) (bpfBackend, error) {
+		p, err := NewNlBpfProtector(opts, owners, protectedTbls...)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}},
+}
+
+func NewAutoProtector(opts Options, owners model.Owners, protectedTbls ...TableKey) (*autoProtector, error) {
+	p := &autoProtector{
+		opts: opts,
+		idx:  -1,
+		que:  queue.NewFIFO[model.ProcessInfo](),
+	}
+	if err := p.next(owners, protectedTbls); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// next builds the first working backend after the current one
+func (p *autoProtector) next(owners model.Owners, protectedTbls []TableKey) error {
+	for p.idx++; p.idx < len(autoBackends); p.idx++ {
+		b := autoBackends[p.idx]
+		cur, err := b.build(p.opts, owners, protectedTbls)
+		if err == nil {
+			p.cur = cur
+			return nil
+		}
+		p.skipped = append(p.skipped, b.name+": "+err.Error())
+	}
+	return errors.Errorf("no protection backend is supported: %s", strings.Join(p.skipped, "; "))
+}
+
+func (p *autoProtector) current() bpfBackend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cur
+}
+
+// update applies the change to the current backend, it is serialized with the fallback
+// so the change is not lost while the state is moved to the next backend
+func (p *autoProtector) update(f func(cur bpfBackend) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return f(p.cur)
+}
+
+func (p *autoProtector) Run(ctx context.Context) error {
+	var doRun bool
+
+	p.onceRun.Do(func() {
+		doRun = true
+	})
+	if !doRun {
+		return errors.New("it has been run or closed yet")
+	}
+
+	log := logger.FromContext(ctx).Named("auto-protector")
+	for fellBack := false; ; fellBack = true {
+		cur := p.current()
+		caps := cur.Capabilities()
+		if len(p.skipped) == 0 {
+			log.Infof("'%s' backend is selected as the strongest one", caps.Backend)
+		} else {
+			log.Infof("'%s' backend is selected as stronger ones are not supported: %s",
+				caps.Backend, strings.Join(p.skipped, "; "))
+		}
+		if fellBack {
+			log.Infof("protector capabilities: %s", caps)
+		}
+		err := p.runBackend(ctx, cur)
+		if !errors.As(err, new(attachError)) {
+			return err
+		}
+		log.Warnf("'%s' backend failed to start, fall back: %v", caps.Backend, err)
+		if err = p.fallback(caps.Backend, err); err != nil {
+			return err
+		}
+	}
+}
+
+// runBackend runs the backend and forwards its events until it stops
+func (p *autoProtector) runBackend(ctx context.Context, cur bpfBackend) error {
+	done := make(chan struct{})
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for {
+			select {
+			case evt := <-cur.EvtReader():
+				p.que.Put(evt)
+			case <-done:
+				for { // events which came before the backend stopped
+					select {
+					case evt := <-cur.EvtReader():
+						p.que.Put(evt)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	err := cur.Run(ctx)
+	close(done)
+	<-forwarded
+	return err
+}
+
+func (p *autoProtector) fallback(failed string, reason error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("closed")
+	}
+	st := p.cur.state()
+	freezeLeft, frozen := p.cur.frozen()
+	_ = p.cur.Close()
+	p.skipped = append(p.skipped, failed+": "+reason.Error())
+	if err := p.next(st.Owners, st.Tables); err != nil {
+		return err
+	}
+	if err := p.cur.Reload(st); err != nil {
+		return err
+	}
+	if frozen {
+		return errors.WithMessage(p.cur.Freeze(freezeLeft), "failed to move the freeze to the fallback backend")
+	}
+	return nil
+}
+
+// EvtReader
+func (p *autoProtector) EvtReader() <-chan model.ProcessInfo {
+	return p.que.Reader()
+}
+
+// AddProtectedTables adds tables to the protected set while the program is attached
+func (p *autoProtector) AddProtectedTables(tables ...TableKey) error {
+	return p.update(func(cur bpfBackend) error {
+		return cur.AddProtectedTables(tables...)
+	})
+}
+
+// RemoveProtectedTables removes tables from the protected set while the program is attached
+func (p *autoProtector) RemoveProtectedTables(tables ...TableKey) error {
+	return p.update(func(cur bpfBackend) error {
+		return cur.RemoveProtectedTables(tables...)
+	})
+}
+
+// SetOwners replaces the set of processes allowed to modify protected tables
+func (p *autoProtector) SetOwners(owners model.Owners) error {
+	return p.update(func(cur bpfBackend) error {
+		return cur.SetOwners(owners)
+	})
+}
+
+// SetMode sets the mode of the protected tables or of the whole protector if no table is given
+func (p *autoProtector) SetMode(mode Mode, tables ...TableKey) error {
+	return p.update(func(cur bpfBackend) error {
+		return cur.SetMode(mode, tables...)
+	})
+}
+
+// SetPolicy replaces the policy rules
+func (p *autoProtector) SetPolicy(policy Policy) error {
+	return p.update(func(cur bpfBackend) error {
+		return cur.SetPolicy(policy)
+	})
+}
+
+// Reload replaces the whole state at once
+func (p *autoProtector) Reload(st State) error {
+	return p.update(func(cur bpfBackend) error {
+		return cur.Reload(st)
+	})
+}
+
+// Freeze denies every change of nf_tables by everybody but break-glass owners
+func (p *autoProtector) Freeze(d time.Duration) error {
+	return p.update(func(cur bpfBackend) error {
+		return cur.Freeze(d)
+	})
+}
+
+// Thaw lifts the freeze
+func (p *autoProtector) Thaw() error {
+	return p.update(func(cur bpfBackend) error {
+		return cur.Thaw()
+	})
+}
+
+// Capabilities of the backend in use
+func (p *autoProtector) Capabilities() Capabilities {
+	return p.current().Capabilities()
+}
+
+// Close
+func (p *autoProtector) Close() error {
+	p.onceClose.Do(func() {
+		p.onceRun.Do(func() {})
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.closed = true
+		_ = p.cur.Close()
+	})
+	return nil
+}
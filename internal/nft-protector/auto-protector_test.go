@@ -0,0 +1,109 @@
+package nft_protector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBackend struct {
+	name    string
+	runErr  error
+	owners  model.Owners
+	tables  []TableKey
+	events  chan model.ProcessInfo
+	mode    Mode
+	freeze  time.Duration
+	engaged bool
+	closed  bool
+}
+
+func (f *fakeBackend) Run(context.Context) error {
+	if f.runErr == nil {
+		f.events <- model.ProcessInfo{Name: f.name}
+	}
+	return f.runErr
+}
+func (f *fakeBackend) Close() error                        { f.closed = true; return nil }
+func (f *fakeBackend) EvtReader() <-chan model.ProcessInfo { return f.events }
+func (f *fakeBackend) AddProtectedTables(t ...TableKey) error {
+	f.tables = append(f.tables, t...)
+	return nil
+}
+func (f *fakeBackend) RemoveProtectedTables(...TableKey) error {
+	return nil
+}
+func (f *fakeBackend) SetOwners(o model.Owners) error { f.owners = o; return nil }
+func (f *fakeBackend) Capabilities() Capabilities     { return Capabilities{Backend: f.name} }
+func (f *fakeBackend) SetMode(m Mode, t ...TableKey) error {
+	if len(t) == 0 {
+		f.mode = m
+	}
+	return nil
+}
+func (f *fakeBackend) SetPolicy(Policy) error       { return nil }
+func (f *fakeBackend) Freeze(d time.Duration) error { f.freeze, f.engaged = d, true; return nil }
+func (f *fakeBackend) Thaw() error                  { f.freeze, f.engaged = 0, false; return nil }
+func (f *fakeBackend) frozen() (time.Duration, bool) {
+	return f.freeze, f.engaged
+}
+func (f *fakeBackend) Reload(st State) error {
+	f.owners, f.tables, f.mode = st.Owners, st.Tables, st.Mode
+	return nil
+}
+func (f *fakeBackend) state() State {
+	return State{Owners: f.owners, Tables: f.tables, Mode: f.mode}
+}
+
+func Test_AutoProtectorFallback(t *testing.T) {
+	var built []*fakeBackend
+	fake := func(name string, buildErr, runErr error) autoBackend {
+		return autoBackend{name: name, build: func(_ Options, owners model.Owners, tables []TableKey) (bpfBackend, error) {
+			if buildErr != nil {
+				return nil, buildErr
+			}
+			b := &fakeBackend{name: name, runErr: runErr, owners: owners, tables: tables,
+				events: make(chan model.ProcessInfo, 1)}
+			built = append(built, b)
+			return b, nil
+		}}
+	}
+	saved := autoBackends
+	defer func() { autoBackends = saved }()
+	autoBackends = []autoBackend{
+		fake("lsm", errors.New("not supported"), nil),
+		fake("fmodret", nil, attachError{errors.New("failed to attach")}),
+		fake("nlbpf", nil, nil),
+	}
+
+	tbl := TableKey{Family: FamilyInet, Name: "filter"}
+	p, err := NewAutoProtector(DefaultOptions(), model.Owners{Pids: []uint32{1}}, tbl)
+	require.NoError(t, err)
+	require.Equal(t, "fmodret", p.Capabilities().Backend)
+
+	owners := model.Owners{Pids: []uint32{2}}
+	require.NoError(t, p.SetOwners(owners))
+	require.NoError(t, p.SetMode(ModeAudit))
+	require.NoError(t, p.Freeze(time.Minute))
+	require.NoError(t, p.Run(context.Background()))
+	require.Equal(t, "nlbpf", p.Capabilities().Backend)
+	require.Len(t, built, 2)
+	require.True(t, built[0].closed)
+	require.Equal(t, owners, built[1].owners, "owners are moved to the fallback backend")
+	require.Equal(t, []TableKey{tbl}, built[1].tables, "tables are moved to the fallback backend")
+	require.Equal(t, ModeAudit, built[1].mode, "mode is moved to the fallback backend")
+	require.True(t, built[1].engaged, "the freeze is moved to the fallback backend")
+	require.Equal(t, time.Minute, built[1].freeze)
+	require.Equal(t, "nlbpf", (<-p.EvtReader()).Name)
+	require.NoError(t, p.Close())
+	require.True(t, built[1].closed)
+
+	autoBackends = []autoBackend{fake("lsm", errors.New("not supported"), nil)}
+	_, err = NewAutoProtector(DefaultOptions(), model.Owners{})
+	require.ErrorContains(t, err, "lsm: not supported")
+}
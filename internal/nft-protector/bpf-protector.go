@@ -0,0 +1,419 @@
+package nft_protector
+
+import (
+	"context"
+	"os"
+	"slices"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/Morwran/nft-protect/internal/model"
+	"github.com/Morwran/nft-protect/internal/owner"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/H-BF/corlib/pkg/queue"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/pkg/errors"
+)
+
+type (
+	// bpfProtector is the part common for all backends, they differ in the program and the way it is attached
+	bpfProtector struct {
+		opts      Options
+		pinPath   string   // PinPath unless it is tested
+		pinLock   *os.File // held while the protector uses the pinned objects
+		maps      bpfMaps
+		gens      *policyGenerations
+		prog      *ebpf.Program
+		exitProg  *ebpf.Program            // engages the lockdown and turns self-protection off when the daemon exits
+		selfProgs map[string]*ebpf.Program // deny to tamper with our objects
+		liveProgs map[string]*ebpf.Program // the guard and protection of files, they are not pinned
+		upgrading bool                     // maps of the previous version of the program are incompatible
+		migrated  []string                 // maps whose entries are copied from the previous version
+		caps      Capabilities
+		stateMu   sync.Mutex
+		pstate    policyState
+		que       queue.FIFO[model.ProcessInfo]
+		onceRun   sync.Once
+		onceClose sync.Once
+		stop      chan struct{}
+		stopped   chan struct{}
+	}
+
+	attachFunc func(prog *ebpf.Program) (link.Link, error)
+
+	// attachError is returned by Run when the program can't be attached, so another backend may be tried
+	attachError struct {
+		error
+	}
+)
+
+func (e attachError) Unwrap() error {
+	return e.error
+}
+
+func newBpfProtector(progName string, caps Capabilities, opts Options, owners model.Owners, protectedTbls []TableKey) (*bpfProtector, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, errors.WithMessage(err, "failed to lock memory for process")
+	}
+	pstate, err := newPolicyState(State{Owners: owners, Tables: protectedTbls})
+	if err != nil {
+		return nil, err
+	}
+	p := &bpfProtector{
+		opts:    opts,
+		pinPath: PinPath,
+		caps:    caps,
+		pstate:  pstate,
+		que:     queue.NewFIFO[model.ProcessInfo](),
+		stop:    make(chan struct{}),
+	}
+	if opts.Pin {
+		if p.pinLock, err = acquirePinPath(p.pinPath); err != nil {
+			return nil, errors.WithMessage(err, "failed to setup pinning")
+		}
+	}
+	if err = p.load(progName); err != nil {
+		p.releasePinPath()
+		return nil, errors.WithMessage(err, "failed to load bpf objects")
+	}
+	if opts.Pin {
+		// the pins are guarded by the files, so they can't be removed or replaced
+		p.gens.pinDir, err = owner.FileID(p.pinPath)
+	}
+	if err == nil {
+		err = putNftMsgDescs(p.maps.NftMsgMap)
+	}
+	if err == nil {
+		err = p.gens.load(p.pstate)
+	}
+	if err != nil {
+		p.closeObjs()
+		return nil, err
+	}
+	return p, nil
+}
+
+// load loads the maps and only the program of the backend,
+// so programs of other backends which the kernel may not support are not loaded
+func (p *bpfProtector) load(progName string) error {
+	spec, err := loadBpf()
+	if err != nil {
+		return err
+	}
+	if p.opts.Events.RingbufSize != 0 {
+		spec.Maps["events"].MaxEntries = p.opts.Events.RingbufSize
+	}
+	if _, ok := spec.Programs[progName]; !ok {
+		return errors.Errorf("program '%s' is not found", progName)
+	}
+	selfNames := selfProgNames[progName]
+	var liveNames []string
+	if len(selfNames) > 0 {
+		liveNames = append(liveNames, killProgNames[progName]...)
+	}
+	if p.opts.Guard {
+		liveNames = append(liveNames, guardProgNames[progName]...)
+	}
+	if p.opts.ProtectFiles || p.opts.Pin {
+		liveNames = append(liveNames, fileProgNames[progName]...)
+	}
+	keepExit := p.opts.Shutdown == ShutdownClosed || len(selfNames) > 0
+	for name := range spec.Programs {
+		if name != progName && !(keepExit && name == exitProgName) && !slices.Contains(selfNames, name) &&
+			!slices.Contains(liveNames, name) {
+			delete(spec.Programs, name)
+		}
+	}
+	var opts ebpf.CollectionOptions
+	if p.opts.Pin {
+		// the maps of the previous instance are reused, the inner maps are reached through the outer ones
+		if opts.Maps.PinPath, err = mapsPinPath(p.pinPath, spec.Maps); err != nil {
+			return err
+		}
+		for _, m := range spec.Maps {
+			m.Pinning = ebpf.PinByName
+		}
+		p.upgrading = opts.Maps.PinPath == upgradePinPath(p.pinPath)
+	}
+	coll, err := ebpf.NewCollectionWithOptions(spec, opts)
+	if err != nil {
+		p.abortUpgrade()
+		return err
+	}
+	defer coll.Close()
+	if p.upgrading {
+		if p.migrated, err = migrateMaps(p.pinPath, coll.Maps); err != nil {
+			p.abortUpgrade()
+			return err
+		}
+	}
+	if err = coll.Assign(&p.maps); err != nil {
+		return err
+	}
+	if p.gens, err = newPolicyGenerations(spec.Maps, &p.maps); err != nil {
+		_ = p.maps.Close()
+		return err
+	}
+	p.prog = coll.DetachProgram(progName)
+	if keepExit {
+		p.exitProg = coll.DetachProgram(exitProgName)
+	}
+	p.selfProgs = make(map[string]*ebpf.Program, len(selfNames))
+	for _, name := range selfNames {
+		p.selfProgs[name] = coll.DetachProgram(name)
+	}
+	p.liveProgs = make(map[string]*ebpf.Program, len(liveNames))
+	for _, name := range liveNames {
+		p.liveProgs[name] = coll.DetachProgram(name)
+	}
+	return nil
+}
+
+func (p *bpfProtector) run(ctx context.Context, name string, attach attachFunc) error {
+	var doRun bool
+
+	p.onceRun.Do(func() {
+		doRun = true
+	})
+	if !doRun {
+		return errors.New("it has been run or closed yet")
+	}
+	p.stopped = make(chan struct{})
+
+	log := logger.FromContext(ctx).Named(name)
+	defer func() {
+		log.Info("stop")
+		close(p.stopped)
+	}()
+	stopTracker, err := runTableHandleTracker(logger.ToContext(ctx, log), p.maps.TblHandleMap)
+	if err != nil {
+		return errors.WithMessage(err, "failed to track table handles")
+	}
+	defer stopTracker()
+	lnk, err := p.attach(log, attach)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = lnk.Close() }() // a pinned link stays attached
+	exitLnk, err := p.armLockdown(log)
+	if exitLnk != nil {
+		defer func() { _ = exitLnk.Close() }()
+	}
+	if err != nil {
+		return err
+	}
+	if exitLnk != nil {
+		for _, selfLnk := range p.protectSelf(log, lnk, exitLnk) {
+			defer func() { _ = selfLnk.Close() }()
+		}
+	}
+	log.Infof("start, shutdown policy is fail-%s", p.opts.Shutdown)
+	if _, frozen := p.frozen(); frozen {
+		log.Warn("the freeze engaged before restart is in force, only break-glass owners may change nf_tables")
+	}
+	return p.rcvEvent(logger.ToContext(ctx, log), func(event Event) error {
+		info := event.ToModel()
+		info.Rule = p.ruleID(event.RuleId)
+		p.que.Put(info)
+		return nil
+	})
+}
+
+// attach attaches the program next to the one of the previous instance and takes the pinned link over.
+// This is the way to upgrade the program, links of LSM, fmod_ret and kprobe programs can't be updated.
+// The maps of the previous version are replaced only when the new program is in force.
+func (p *bpfProtector) attach(log logger.TypeOfLogger, attach attachFunc) (link.Link, error) {
+	lnk, err := attach(p.prog)
+	if err != nil {
+		p.abortUpgrade()
+		return nil, attachError{err}
+	}
+	if err = verifyLink(lnk, p.prog); err != nil {
+		_ = lnk.Close()
+		p.abortUpgrade()
+		return nil, errors.WithMessage(err, "failed to verify the link")
+	}
+	takeOver(log, lnk, p.pinPath, p.opts.Pin)
+	if p.upgrading {
+		p.commitUpgrade(log)
+		log.Infof("maps are upgraded, migrated %v", p.migrated)
+	}
+	return lnk, nil
+}
+
+// EvtReader
+func (p *bpfProtector) EvtReader() <-chan model.ProcessInfo {
+	return p.que.Reader()
+}
+
+// AddProtectedTables adds tables to the protected set while the program is attached
+func (p *bpfProtector) AddProtectedTables(tables ...TableKey) error {
+	return p.update(func(s *policyState) error {
+		return s.tables.add(tables...)
+	})
+}
+
+// RemoveProtectedTables removes tables from the protected set while the program is attached
+func (p *bpfProtector) RemoveProtectedTables(tables ...TableKey) error {
+	return p.update(func(s *policyState) error {
+		s.tables.remove(tables...)
+		return nil
+	})
+}
+
+// SetOwners replaces the set of processes allowed to modify protected tables
+func (p *bpfProtector) SetOwners(owners model.Owners) error {
+	return p.update(func(s *policyState) error {
+		s.owners = owners
+		return nil
+	})
+}
+
+// SetMode sets the mode of the protected tables or of the whole protector if no table is given
+func (p *bpfProtector) SetMode(mode Mode, tables ...TableKey) error {
+	return p.update(func(s *policyState) error {
+		if len(tables) > 0 {
+			return s.tables.setMode(mode, tables...)
+		}
+		s.mode = mode
+		return nil
+	})
+}
+
+// SetPolicy replaces the policy rules
+func (p *bpfProtector) SetPolicy(policy Policy) error {
+	return p.update(func(s *policyState) error {
+		s.policy = policy
+		return nil
+	})
+}
+
+// Reload replaces the whole state at once
+func (p *bpfProtector) Reload(st State) error {
+	return p.update(func(s *policyState) (err error) {
+		*s, err = newPolicyState(st)
+		return err
+	})
+}
+
+// update applies the change to a copy of the state and loads it as a new generation,
+// nothing is changed if the new state is invalid or can't be loaded
+func (p *bpfProtector) update(f func(s *policyState) error) error {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	s := p.pstate.clone()
+	if err := f(&s); err != nil {
+		return err
+	}
+	if err := p.gens.load(s); err != nil {
+		return err
+	}
+	p.pstate = s
+	return nil
+}
+
+func (p *bpfProtector) ruleID(pos uint16) string {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	return p.pstate.policy.RuleID(pos)
+}
+
+// state returns the whole state, e.g. to build another backend with
+func (p *bpfProtector) state() State {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	return p.pstate.State()
+}
+
+// Capabilities tells what the protector is able to guarantee
+func (p *bpfProtector) Capabilities() Capabilities {
+	return p.caps
+}
+
+// Close
+func (p *bpfProtector) Close() error {
+	p.onceClose.Do(func() {
+		close(p.stop)
+		p.onceRun.Do(func() {})
+		if p.stopped != nil {
+			<-p.stopped
+		}
+		p.closeObjs()
+	})
+	return nil
+}
+
+func (p *bpfProtector) closeObjs() {
+	_ = p.prog.Close()
+	_ = p.exitProg.Close()
+	for _, prog := range p.selfProgs {
+		_ = prog.Close()
+	}
+	for _, prog := range p.liveProgs {
+		_ = prog.Close()
+	}
+	_ = p.maps.Close()
+	p.gens.Close()
+	p.releasePinPath()
+}
+
+// releasePinPath lets another protector use the pinned objects
+func (p *bpfProtector) releasePinPath() {
+	if p.pinLock != nil {
+		_ = p.pinLock.Close()
+		p.pinLock = nil
+	}
+}
+
+func (p *bpfProtector) rcvEvent(ctx context.Context, callback func(event Event) error) error {
+	log := logger.FromContext(ctx)
+	rd, err := ringbuf.NewReader(p.maps.Events)
+	if err != nil {
+		return errors.WithMessage(err, "opening ringbuf reader")
+	}
+	defer rd.Close()
+
+	var (
+		event  bpfEvent
+		record ringbuf.Record
+	)
+Loop:
+	for err == nil {
+		select {
+		case <-ctx.Done():
+			log.Info("will exit cause ctx canceled")
+			err = ctx.Err()
+			goto Loop
+		case <-p.stop:
+			break Loop
+		default:
+		}
+		rd.SetDeadline(time.Now().Add(p.opts.Events.ReadTimeout))
+		err = rd.ReadInto(&record)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err = nil
+				continue
+			}
+			err = errors.WithMessage(err, "reading events from reader")
+			goto Loop
+		}
+		if len(record.RawSample) == 0 {
+			continue
+		}
+
+		event = *(*bpfEvent)(unsafe.Pointer(&record.RawSample[0]))
+		if callback != nil {
+			err = callback(Event(event))
+		}
+	}
+	return err
+}
@@ -13,8 +13,101 @@ import (
 )
 
 type bpfEvent struct {
-	Pid  uint32
-	Comm [32]uint8
+	Pid       uint32
+	Comm      [32]uint8
+	Family    uint8
+	MsgType   uint8
+	Reason    uint8
+	Verdict   uint8
+	Table     [64]uint8
+	Uid       uint32
+	ExeDev    uint32
+	CgroupId  uint64
+	ExeIno    uint64
+	RuleId    uint16
+	_         [2]byte
+	TargetPid uint32
+}
+
+type bpfExeKey struct {
+	Ino uint64
+	Dev uint32
+	_   [4]byte
+}
+
+type bpfExeOwner struct{ Parent bpfExeKey }
+
+type bpfFreeze struct {
+	Until   uint64
+	Engaged uint32
+	_       [4]byte
+}
+
+type bpfLockdown struct {
+	Tgid    uint32
+	Engaged uint32
+}
+
+type bpfNftMsgDesc struct {
+	TblAttr    uint16
+	HandleAttr uint16
+	ObjAttr    uint16
+	Flags      uint8
+	ObjKind    uint8
+}
+
+type bpfPolicyRule struct {
+	Ops     uint64
+	ExeIno  uint64
+	ExeDev  uint32
+	Pid     uint32
+	Uid     uint32
+	Id      uint16
+	Verdict uint8
+	Subj    uint8
+	Obj     uint8
+	Family  uint8
+	ObjKind uint8
+	Comm    [16]uint8
+	Table   [64]uint8
+	Name    [64]uint8
+	_       [5]byte
+}
+
+type bpfRuleCgroupKey struct {
+	CgroupId uint64
+	Rule     uint32
+	Pad      uint32
+}
+
+type bpfSelf struct {
+	Tgid  uint32
+	Guard uint32
+}
+
+type bpfSelfObjKey struct {
+	Kind uint32
+	Id   uint32
+}
+
+type bpfTblHandleKey struct {
+	Handle uint64
+	Family uint8
+	_      [7]byte
+}
+
+type bpfTblKey struct {
+	Family uint8
+	Name   [64]uint8
+}
+
+type bpfTblPattern struct {
+	Family    uint8
+	PrefixLen uint8
+	SuffixLen uint8
+	HasStar   uint8
+	Flags     uint8
+	Text      [64]uint8
 }
 
 // loadBpf returns the embedded CollectionSpec for bpf.
@@ -58,17 +151,52 @@ type bpfSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfProgramSpecs struct {
-	KprobeNfnetlinkRcv *ebpf.ProgramSpec `ebpf:"kprobe_nfnetlink_rcv"`
-	LsmNetlinkSend     *ebpf.ProgramSpec `ebpf:"lsm_netlink_send"`
+	FmodRetBpf               *ebpf.ProgramSpec `ebpf:"fmod_ret_bpf"`
+	FmodRetBpfMap            *ebpf.ProgramSpec `ebpf:"fmod_ret_bpf_map"`
+	FmodRetBpfProg           *ebpf.ProgramSpec `ebpf:"fmod_ret_bpf_prog"`
+	FmodRetFileOpen          *ebpf.ProgramSpec `ebpf:"fmod_ret_file_open"`
+	FmodRetInodeRename       *ebpf.ProgramSpec `ebpf:"fmod_ret_inode_rename"`
+	FmodRetInodeUnlink       *ebpf.ProgramSpec `ebpf:"fmod_ret_inode_unlink"`
+	FmodRetNetlinkSend       *ebpf.ProgramSpec `ebpf:"fmod_ret_netlink_send"`
+	FmodRetPtraceAccessCheck *ebpf.ProgramSpec `ebpf:"fmod_ret_ptrace_access_check"`
+	FmodRetTaskKill          *ebpf.ProgramSpec `ebpf:"fmod_ret_task_kill"`
+	KprobeNfnetlinkRcv       *ebpf.ProgramSpec `ebpf:"kprobe_nfnetlink_rcv"`
+	LsmBpf                   *ebpf.ProgramSpec `ebpf:"lsm_bpf"`
+	LsmBpfMap                *ebpf.ProgramSpec `ebpf:"lsm_bpf_map"`
+	LsmBpfProg               *ebpf.ProgramSpec `ebpf:"lsm_bpf_prog"`
+	LsmFileOpen              *ebpf.ProgramSpec `ebpf:"lsm_file_open"`
+	LsmInodeRename           *ebpf.ProgramSpec `ebpf:"lsm_inode_rename"`
+	LsmInodeUnlink           *ebpf.ProgramSpec `ebpf:"lsm_inode_unlink"`
+	LsmNetlinkSend           *ebpf.ProgramSpec `ebpf:"lsm_netlink_send"`
+	LsmPtraceAccessCheck     *ebpf.ProgramSpec `ebpf:"lsm_ptrace_access_check"`
+	LsmTaskKill              *ebpf.ProgramSpec `ebpf:"lsm_task_kill"`
+	OnProtectorExit          *ebpf.ProgramSpec `ebpf:"on_protector_exit"`
 }
 
 // bpfMapSpecs contains maps before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfMapSpecs struct {
+	AllowedCgroupMap    *ebpf.MapSpec `ebpf:"allowed_cgroup_map"`
+	AllowedExeMap       *ebpf.MapSpec `ebpf:"allowed_exe_map"`
 	AllowedPidMap       *ebpf.MapSpec `ebpf:"allowed_pid_map"`
+	BreakGlassExeMap    *ebpf.MapSpec `ebpf:"break_glass_exe_map"`
 	Events              *ebpf.MapSpec `ebpf:"events"`
+	FreezeMap           *ebpf.MapSpec `ebpf:"freeze_map"`
+	LockdownMap         *ebpf.MapSpec `ebpf:"lockdown_map"`
+	ModeMap             *ebpf.MapSpec `ebpf:"mode_map"`
+	NftMsgMap           *ebpf.MapSpec `ebpf:"nft_msg_map"`
+	PolicyGenMap        *ebpf.MapSpec `ebpf:"policy_gen_map"`
+	PolicyRuleMap       *ebpf.MapSpec `ebpf:"policy_rule_map"`
+	ProtectedFamilyMap  *ebpf.MapSpec `ebpf:"protected_family_map"`
+	ProtectedFileMap    *ebpf.MapSpec `ebpf:"protected_file_map"`
+	ProtectedPatternMap *ebpf.MapSpec `ebpf:"protected_pattern_map"`
 	ProtectedTblNameMap *ebpf.MapSpec `ebpf:"protected_tbl_name_map"`
+	RuleCgroupMap       *ebpf.MapSpec `ebpf:"rule_cgroup_map"`
+	SelfMap             *ebpf.MapSpec `ebpf:"self_map"`
+	SelfObjMap          *ebpf.MapSpec `ebpf:"self_obj_map"`
+	TblHandleMap        *ebpf.MapSpec `ebpf:"tbl_handle_map"`
+	UpdaterExeMap       *ebpf.MapSpec `ebpf:"updater_exe_map"`
 }
 
 // bpfObjects contains all objects after they have been loaded into the kernel.
@@ -90,16 +218,50 @@ func (o *bpfObjects) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfMaps struct {
+	AllowedCgroupMap    *ebpf.Map `ebpf:"allowed_cgroup_map"`
+	AllowedExeMap       *ebpf.Map `ebpf:"allowed_exe_map"`
 	AllowedPidMap       *ebpf.Map `ebpf:"allowed_pid_map"`
+	BreakGlassExeMap    *ebpf.Map `ebpf:"break_glass_exe_map"`
 	Events              *ebpf.Map `ebpf:"events"`
+	FreezeMap           *ebpf.Map `ebpf:"freeze_map"`
+	LockdownMap         *ebpf.Map `ebpf:"lockdown_map"`
+	ModeMap             *ebpf.Map `ebpf:"mode_map"`
+	NftMsgMap           *ebpf.Map `ebpf:"nft_msg_map"`
+	PolicyGenMap        *ebpf.Map `ebpf:"policy_gen_map"`
+	PolicyRuleMap       *ebpf.Map `ebpf:"policy_rule_map"`
+	ProtectedFamilyMap  *ebpf.Map `ebpf:"protected_family_map"`
+	ProtectedFileMap    *ebpf.Map `ebpf:"protected_file_map"`
+	ProtectedPatternMap *ebpf.Map `ebpf:"protected_pattern_map"`
 	ProtectedTblNameMap *ebpf.Map `ebpf:"protected_tbl_name_map"`
+	RuleCgroupMap       *ebpf.Map `ebpf:"rule_cgroup_map"`
+	SelfMap             *ebpf.Map `ebpf:"self_map"`
+	SelfObjMap          *ebpf.Map `ebpf:"self_obj_map"`
+	TblHandleMap        *ebpf.Map `ebpf:"tbl_handle_map"`
+	UpdaterExeMap       *ebpf.Map `ebpf:"updater_exe_map"`
 }
 
 func (m *bpfMaps) Close() error {
 	return _BpfClose(
+		m.AllowedCgroupMap,
+		m.AllowedExeMap,
 		m.AllowedPidMap,
+		m.BreakGlassExeMap,
 		m.Events,
+		m.FreezeMap,
+		m.LockdownMap,
+		m.ModeMap,
+		m.NftMsgMap,
+		m.PolicyGenMap,
+		m.PolicyRuleMap,
+		m.ProtectedFamilyMap,
+		m.ProtectedFileMap,
+		m.ProtectedPatternMap,
 		m.ProtectedTblNameMap,
+		m.RuleCgroupMap,
+		m.SelfMap,
+		m.SelfObjMap,
+		m.TblHandleMap,
+		m.UpdaterExeMap,
 	)
 }
 
@@ -107,14 +269,50 @@ func (m *bpfMaps) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfPrograms struct {
-	KprobeNfnetlinkRcv *ebpf.Program `ebpf:"kprobe_nfnetlink_rcv"`
-	LsmNetlinkSend     *ebpf.Program `ebpf:"lsm_netlink_send"`
+	FmodRetBpf               *ebpf.Program `ebpf:"fmod_ret_bpf"`
+	FmodRetBpfMap            *ebpf.Program `ebpf:"fmod_ret_bpf_map"`
+	FmodRetBpfProg           *ebpf.Program `ebpf:"fmod_ret_bpf_prog"`
+	FmodRetFileOpen          *ebpf.Program `ebpf:"fmod_ret_file_open"`
+	FmodRetInodeRename       *ebpf.Program `ebpf:"fmod_ret_inode_rename"`
+	FmodRetInodeUnlink       *ebpf.Program `ebpf:"fmod_ret_inode_unlink"`
+	FmodRetNetlinkSend       *ebpf.Program `ebpf:"fmod_ret_netlink_send"`
+	FmodRetPtraceAccessCheck *ebpf.Program `ebpf:"fmod_ret_ptrace_access_check"`
+	FmodRetTaskKill          *ebpf.Program `ebpf:"fmod_ret_task_kill"`
+	KprobeNfnetlinkRcv       *ebpf.Program `ebpf:"kprobe_nfnetlink_rcv"`
+	LsmBpf                   *ebpf.Program `ebpf:"lsm_bpf"`
+	LsmBpfMap                *ebpf.Program `ebpf:"lsm_bpf_map"`
+	LsmBpfProg               *ebpf.Program `ebpf:"lsm_bpf_prog"`
+	LsmFileOpen              *ebpf.Program `ebpf:"lsm_file_open"`
+	LsmInodeRename           *ebpf.Program `ebpf:"lsm_inode_rename"`
+	LsmInodeUnlink           *ebpf.Program `ebpf:"lsm_inode_unlink"`
+	LsmNetlinkSend           *ebpf.Program `ebpf:"lsm_netlink_send"`
+	LsmPtraceAccessCheck     *ebpf.Program `ebpf:"lsm_ptrace_access_check"`
+	LsmTaskKill              *ebpf.Program `ebpf:"lsm_task_kill"`
+	OnProtectorExit          *ebpf.Program `ebpf:"on_protector_exit"`
 }
 
 func (p *bpfPrograms) Close() error {
 	return _BpfClose(
+		p.FmodRetBpf,
+		p.FmodRetBpfMap,
+		p.FmodRetBpfProg,
+		p.FmodRetFileOpen,
+		p.FmodRetInodeRename,
+		p.FmodRetInodeUnlink,
+		p.FmodRetNetlinkSend,
+		p.FmodRetPtraceAccessCheck,
+		p.FmodRetTaskKill,
 		p.KprobeNfnetlinkRcv,
+		p.LsmBpf,
+		p.LsmBpfMap,
+		p.LsmBpfProg,
+		p.LsmFileOpen,
+		p.LsmInodeRename,
+		p.LsmInodeUnlink,
 		p.LsmNetlinkSend,
+		p.LsmPtraceAccessCheck,
+		p.LsmTaskKill,
+		p.OnProtectorExit,
 	)
 }
 
@@ -0,0 +1,74 @@
+package nft_protector
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
+)
+
+type (
+	// Capabilities describes the guarantees the protector actually gives
+	Capabilities struct {
+		Backend string
+		// Enforcing is false for detect-only protectors, they report changes of protected tables but don't deny them
+		Enforcing bool
+		// Families of tables which can be protected
+		Families []Family
+		// MsgTypes are the nf_tables messages checked against protected tables
+		MsgTypes []NftMsgType
+		// WholeBatch is true when the batch is checked with bpf_loop, otherwise only the first
+		// 16 messages and 32 attributes of each are checked and a longer batch is denied
+		WholeBatch bool
+		// KernelFeatures the protector depends on
+		KernelFeatures []string
+	}
+)
+
+func newCapabilities(backend string, enforcing bool, kernelFeatures ...string) Capabilities {
+	c := Capabilities{
+		Backend:        backend,
+		Enforcing:      enforcing,
+		MsgTypes:       StateChangingNftMsgs(),
+		KernelFeatures: append([]string{"BTF", "nf_tables"}, kernelFeatures...),
+	}
+	for f := range familyNames {
+		if f != FamilyAny {
+			c.Families = append(c.Families, f)
+		}
+	}
+	slices.Sort(c.Families)
+	// bpf_loop is available for any program type, so probe it with the simplest one
+	if features.HaveProgramHelper(ebpf.Kprobe, asm.FnLoop) == nil {
+		c.WholeBatch = true
+		c.KernelFeatures = append(c.KernelFeatures, "bpf_loop")
+	}
+	return c
+}
+
+func (c Capabilities) String() string {
+	mode := "detect-only"
+	if c.Enforcing {
+		mode = "enforcing"
+	}
+	batch := "first 16 messages"
+	if c.WholeBatch {
+		batch = "whole"
+	}
+	families := make([]string, 0, len(c.Families))
+	for _, f := range c.Families {
+		families = append(families, f.String())
+	}
+	msgs := make([]string, 0, len(c.MsgTypes))
+	for _, t := range c.MsgTypes {
+		msgs = append(msgs, t.String())
+	}
+	return fmt.Sprintf("backend=%s mode=%s batch=%s families=%s messages=%s kernel=%s",
+		c.Backend, mode, batch,
+		strings.Join(families, ","),
+		strings.Join(msgs, ","),
+		strings.Join(c.KernelFeatures, ","))
+}
@@ -2,10 +2,13 @@ package nft_protector
 
 import (
 	"bytes"
+	"fmt"
 	"unsafe"
 
 	kernel_info "github.com/Morwran/nft-protect/internal/kernel-info"
 	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/cilium/ebpf"
 	"github.com/pkg/errors"
 )
 
@@ -13,11 +16,65 @@ var requiredKernelModules = []string{"nf_tables"}
 
 type Event bpfEvent
 
+// EventReason tells why the message was denied (enum event_reason)
+type EventReason uint8
+
+const (
+	// EventReasonProtectedTable the message changes a protected table
+	EventReasonProtectedTable EventReason = iota
+	// EventReasonWalkIncomplete the batch could not be checked to the end, so it is denied
+	EventReasonWalkIncomplete
+	// EventReasonRule the message matches a deny or audit policy rule
+	EventReasonRule
+	// EventReasonTamper the process tried to tamper with the protector, the message type is TamperOp
+	EventReasonTamper
+	// EventReasonFreeze the message changes nf_tables while the freeze is engaged
+	EventReasonFreeze
+	// EventReasonLongName the table name is too long to be checked against patterns, so it is denied
+	EventReasonLongName
+)
+
+func (r EventReason) String() string {
+	switch r {
+	case EventReasonProtectedTable:
+		return "protected-table"
+	case EventReasonWalkIncomplete:
+		return "walk-incomplete"
+	case EventReasonRule:
+		return "rule"
+	case EventReasonTamper:
+		return "tamper"
+	case EventReasonFreeze:
+		return "freeze"
+	case EventReasonLongName:
+		return "long-name"
+	}
+	return fmt.Sprintf("reason(%d)", uint8(r))
+}
+
 func (l *Event) ToModel() model.ProcessInfo {
-	return model.ProcessInfo{
-		Pid:  l.Pid,
-		Name: FastBytes2String(bytes.TrimRight(l.Comm[:], "\x00")),
+	info := model.ProcessInfo{
+		Pid:      l.Pid,
+		Name:     FastBytes2String(bytes.TrimRight(l.Comm[:], "\x00")),
+		Reason:   EventReason(l.Reason).String(),
+		Verdict:  Verdict(l.Verdict).String(),
+		Uid:      l.Uid,
+		CgroupID: l.CgroupId,
+		Exe:      model.ExeID{Ino: l.ExeIno, Dev: l.ExeDev},
+	}
+	if EventReason(l.Reason) == EventReasonTamper {
+		op := TamperOp(l.MsgType)
+		info.MsgType = op.String()
+		info.TargetPid = l.TargetPid
+		if op.IsFile() {
+			info.File = string(bytes.TrimRight(l.Table[:], "\x00"))
+		}
+		return info
 	}
+	tbl := tableKeyFromBpf(l.Family, l.Table[:])
+	info.Family, info.Table = tbl.Family.String(), tbl.Name
+	info.MsgType = NftMsgType(l.MsgType).String()
+	return info
 }
 
 func FastBytes2String(b []byte) string {
@@ -44,8 +101,94 @@ func ensureLsmSupport() (err error) {
 	if err = kernel_info.CheckLsmBpfKernelSupport(); err != nil {
 		return errors.WithMessage(err, "failed to check LSM BPF kernel support")
 	}
+	if err = kernel_info.CheckLsmBpfActive(); err != nil {
+		return err
+	}
 	if err = kernel_info.CheckLsmBpfGrubOption(); err != nil {
 		return errors.WithMessage(err, "failed to check LSM BPF grub option support")
 	}
 	return err
 }
+
+// ownersToBpf fills allowed_pid_map, allowed_cgroup_map and allowed_exe_map of the policy
+func ownersToBpf(c *policyContent, owners model.Owners) error {
+	c.pids = setToBpf(owners.Pids)
+	c.cgroups = setToBpf(owners.CgroupIDs)
+	exes, err := exesToBpf(owners.Exes)
+	c.exes = exes
+	return errors.WithMessage(err, "failed to setup allowed executables")
+}
+
+// setToBpf is the content of the hash map used as a set
+func setToBpf[K comparable](keys []K) map[K]uint8 {
+	ret := make(map[K]uint8, len(keys))
+	for _, k := range keys {
+		ret[k] = 1
+	}
+	return ret
+}
+
+// syncMap makes the hash map to contain exactly the given entries
+func syncMap[K comparable, V any](m *ebpf.Map, want map[K]V) error {
+	var (
+		key   K
+		val   V
+		stale []K
+	)
+	it := m.Iterate()
+	for it.Next(&key, &val) {
+		if _, ok := want[key]; !ok {
+			stale = append(stale, key)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	for k, v := range want {
+		if err := m.Put(k, v); err != nil {
+			return err
+		}
+	}
+	for _, k := range stale {
+		if err := m.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func exeKeyToBpf(id model.ExeID) bpfExeKey {
+	return bpfExeKey{Ino: id.Ino, Dev: id.Dev}
+}
+
+// maxProtectedFiles is the size of protected_file_map (MAX_PROTECTED_FILES)
+const maxProtectedFiles = 64
+
+func filesToBpf(files []model.ExeID) (map[bpfExeKey]uint8, error) {
+	ret := make(map[bpfExeKey]uint8, len(files))
+	for _, f := range files {
+		ret[exeKeyToBpf(f)] = 1
+	}
+	if len(ret) > maxProtectedFiles {
+		return nil, errors.Errorf("too many protected files %d, at most %d are supported", len(ret), maxProtectedFiles)
+	}
+	return ret, nil
+}
+
+func exesToBpf(exes []model.ExeOwner) (map[bpfExeKey]bpfExeOwner, error) {
+	ret := make(map[bpfExeKey]bpfExeOwner, len(exes))
+	for _, exe := range exes {
+		key := exeKeyToBpf(exe.Exe)
+		val := bpfExeOwner{Parent: exeKeyToBpf(exe.Parent)}
+		if prev, ok := ret[key]; ok && prev != val {
+			if prev.Parent.Ino == 0 {
+				continue // executable is allowed regardless of its parent
+			}
+			if val.Parent.Ino != 0 {
+				return nil, errors.Errorf("executable %d:%d is allowed with different parents", key.Dev, key.Ino)
+			}
+		}
+		ret[key] = val
+	}
+	return ret, nil
+}
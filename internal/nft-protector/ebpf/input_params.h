@@ -2,64 +2,453 @@
 #define __INPUT_PARAMS_H__
 
 #define MAX_TBL_NAME 64
+#define MAX_PROTECTED_TBLS 256
+#define MAX_TBL_PATTERNS 16
+#define MAX_ALLOWED_PIDS 1024
+#define MAX_ALLOWED_CGROUPS 1024
+#define MAX_ALLOWED_EXES 256
+#define MAX_PROTECTED_FILES 64
+#define MAX_NFT_MSG 64
+#define MAX_TBL_HANDLES 1024
+#define MAX_FAMILY 16 /* > NFPROTO_NUMPROTO */
+#define POLICY_GENS 2
 
+#define NFPROTO_ANY 0 /* wildcard family, NFPROTO_UNSPEC */
+
+#define TBL_F_PROTECTED (1 << 0)
+#define TBL_F_AUDIT (1 << 1) /* changes of the table are reported but not denied */
+
+enum mode
+{
+    MODE_ENFORCE = 0,
+    MODE_AUDIT, /* nothing is denied, only reported */
+};
+
+enum verdict
+{
+    VERDICT_DENY = 0,
+    VERDICT_AUDIT, /* would be denied in enforce mode */
+};
+
+struct tbl_key
+{
+    u8 family;
+    u8 name[MAX_TBL_NAME];
+};
+
+const struct tbl_key *unused_tbl_key __attribute__((unused));
+
+/* glob with at most one '*' and any number of '?', unused entries are all zero */
+struct tbl_pattern
+{
+    u8 family;
+    u8 prefix_len; /* length of the text before '*' or of the whole text without '*' */
+    u8 suffix_len; /* length of the text after '*' */
+    u8 has_star;
+    u8 flags; /* TBL_F_xxx */
+    u8 text[MAX_TBL_NAME]; /* prefix followed by suffix without '*' */
+};
+
+const struct tbl_pattern *unused_tbl_pattern __attribute__((unused));
+
+struct exe_key
+{
+    u64 ino;
+    u32 dev;
+};
+
+struct exe_owner
+{
+    struct exe_key parent; /* zero if any parent is allowed */
+};
+
+const struct exe_owner *unused_exe_owner __attribute__((unused));
+
+#define NFT_MSG_F_FLUSH (1 << 0) /* message without table name affects all tables of the family */
+
+struct nft_msg_desc
+{
+    u16 tbl_attr;    /* attribute with the table name, 0 if the message does not change state */
+    u16 handle_attr; /* attribute with the table handle, 0 if the table can't be referred by handle */
+    u16 obj_attr;    /* attribute with the name of the chain, set, etc. the message changes */
+    u8 flags;        /* NFT_MSG_F_xxx */
+    u8 obj_kind;     /* enum obj_kind of obj_attr */
+};
+
+const struct nft_msg_desc *unused_nft_msg_desc __attribute__((unused));
+
+struct tbl_handle_key
+{
+    u64 handle;
+    u8 family;
+};
+
+const struct tbl_handle_key *unused_tbl_handle_key __attribute__((unused));
+
+/* lockdown is armed by the daemon with fail-closed shutdown policy and engaged when the daemon exits */
+struct lockdown
+{
+    u32 tgid;    /* the daemon, 0 if lockdown is not armed */
+    u32 engaged; /* every change of protected tables by non-owners is denied */
+};
+
+const struct lockdown *unused_lockdown __attribute__((unused));
+
+/* freeze denies every change of nf_tables state by everybody but break-glass owners, it is set by the daemon */
+struct freeze
+{
+    u64 until;   /* bpf_ktime_get_ns() the freeze expires at, 0 if it lasts until it is lifted */
+    u32 engaged;
+};
+
+const struct freeze *unused_freeze __attribute__((unused));
+
+/* POLICY_MAP declares the map of the policy in two generations, only the one policy_gen_map refers to is used,
+ * so the policy is written into the other one and then activated at once
+ */
+#define POLICY_MAP(_name, _type, _max_entries, _key, _value) \
+    struct                                                   \
+    {                                                        \
+        __uint(type, BPF_MAP_TYPE_ARRAY_OF_MAPS);            \
+        __uint(max_entries, POLICY_GENS);                    \
+        __type(key, u32);                                    \
+        __array(                                             \
+            values, struct {                                 \
+                __uint(type, _type);                         \
+                __uint(max_entries, _max_entries);           \
+                __type(key, _key);                           \
+                __type(value, _value);                       \
+            });                                              \
+    } _name SEC(".maps")
+
+POLICY_MAP(allowed_pid_map, BPF_MAP_TYPE_HASH, MAX_ALLOWED_PIDS, u32, u8);
+POLICY_MAP(allowed_cgroup_map, BPF_MAP_TYPE_HASH, MAX_ALLOWED_CGROUPS, u64, u8);
+POLICY_MAP(allowed_exe_map, BPF_MAP_TYPE_HASH, MAX_ALLOWED_EXES, struct exe_key, struct exe_owner);
+/* executables allowed to change nf_tables while the freeze is engaged */
+POLICY_MAP(break_glass_exe_map, BPF_MAP_TYPE_HASH, MAX_ALLOWED_EXES, struct exe_key, struct exe_owner);
+/* executables allowed to modify protected files */
+POLICY_MAP(updater_exe_map, BPF_MAP_TYPE_HASH, MAX_ALLOWED_EXES, struct exe_key, struct exe_owner);
+/* files which only the protector and updaters may modify, entries of protected directories are protected too */
+POLICY_MAP(protected_file_map, BPF_MAP_TYPE_HASH, MAX_PROTECTED_FILES, struct exe_key, u8);
+/* value is TBL_F_xxx */
+POLICY_MAP(protected_tbl_name_map, BPF_MAP_TYPE_HASH, MAX_PROTECTED_TBLS, struct tbl_key, u8);
+/* patterns are evaluated in order after exact names */
+POLICY_MAP(protected_pattern_map, BPF_MAP_TYPE_ARRAY, MAX_TBL_PATTERNS, u32, struct tbl_pattern);
+/* number of protected tables affected when all tables of the family are flushed */
+POLICY_MAP(protected_family_map, BPF_MAP_TYPE_ARRAY, MAX_FAMILY, u32, u32);
+/* global enum mode */
+POLICY_MAP(mode_map, BPF_MAP_TYPE_ARRAY, 1, u32, u8);
+
+/* the active generation of the policy maps */
 struct
 {
     __uint(type, BPF_MAP_TYPE_ARRAY);
     __uint(max_entries, 1);
     __type(key, u32);
     __type(value, u32);
-} allowed_pid_map SEC(".maps");
+} policy_gen_map SEC(".maps");
 
 struct
 {
     __uint(type, BPF_MAP_TYPE_ARRAY);
-    __uint(max_entries, 1);
+    __uint(max_entries, MAX_NFT_MSG);
     __type(key, u32);
+    __type(value, struct nft_msg_desc);
+} nft_msg_map SEC(".maps");
+
+struct
+{
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_TBL_HANDLES);
+    __type(key, struct tbl_handle_key);
     __type(value, u8[MAX_TBL_NAME]);
-} protected_tbl_name_map SEC(".maps");
+} tbl_handle_map SEC(".maps");
 
-static __always_inline u32 get_allowed_pid()
+struct
+{
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);
+    __type(value, struct lockdown);
+} lockdown_map SEC(".maps");
+
+static __always_inline bool is_locked_down()
 {
     u32 key = 0;
-    u32 *val = bpf_map_lookup_elem(&allowed_pid_map, &key);
-    if (!val)
+    struct lockdown *l = bpf_map_lookup_elem(&lockdown_map, &key);
+    return l && l->engaged;
+}
+
+struct
+{
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);
+    __type(value, struct freeze);
+} freeze_map SEC(".maps");
+
+static __always_inline bool is_frozen()
+{
+    u32 key = 0;
+    struct freeze *f = bpf_map_lookup_elem(&freeze_map, &key);
+    return f && f->engaged && (f->until == 0 || bpf_ktime_get_ns() < f->until);
+}
+
+/* get_policy_gen is read once per message, so the whole message is checked against the same policy */
+static __always_inline u32 get_policy_gen()
+{
+    u32 key = 0;
+    u32 *gen = bpf_map_lookup_elem(&policy_gen_map, &key);
+    return gen ? *gen % POLICY_GENS : 0;
+}
+
+static __always_inline void *lookup_policy(void *map, u32 gen, const void *key)
+{
+    void *inner = bpf_map_lookup_elem(map, &gen);
+    return inner ? bpf_map_lookup_elem(inner, key) : NULL;
+}
+
+/* get_verdict is audit when either the whole protector or the table is in audit mode, nothing is audited in lockdown */
+static __always_inline u8 get_verdict(u32 gen, u8 tbl_flags)
+{
+    u32 key = 0;
+    u8 *mode = lookup_policy(&mode_map, gen, &key);
+
+    if (is_locked_down())
+    {
+        return VERDICT_DENY;
+    }
+    if ((mode && *mode == MODE_AUDIT) || (tbl_flags & TBL_F_AUDIT))
     {
-        return 0;
+        return VERDICT_AUDIT;
     }
-    return *val;
+    return VERDICT_DENY;
 }
 
-#define GET_PROTECTED_TBL_NAME(tbl_name)                              \
-    ({                                                                \
-        u32 key = 0;                                                  \
-        u8 *res = NULL;                                               \
-        u8 *val = bpf_map_lookup_elem(&protected_tbl_name_map, &key); \
-        if (val)                                                      \
-        {                                                             \
-            res = __builtin_memcpy(tbl_name, val, MAX_TBL_NAME);      \
-        }                                                             \
-        res;                                                          \
-    })
+static __always_inline struct nft_msg_desc *get_nft_msg_desc(u8 msg_type)
+{
+    u32 key = msg_type;
+    return bpf_map_lookup_elem(&nft_msg_map, &key);
+}
 
-#define GET_NAME_LEN(tbl_name)                                  \
-    ({                                                          \
-        u32 len = 0;                                            \
-        while (tbl_name[len] != '\0' && len < MAX_TBL_NAME - 1) \
-        {                                                       \
-            len++;                                              \
-        }                                                       \
-        len;                                                    \
-    })
+static __always_inline bool has_protected_tbls(u32 gen, u8 family)
+{
+    u32 key = family;
+    u32 *cnt = lookup_policy(&protected_family_map, gen, &key);
+    return cnt && *cnt > 0;
+}
+
+static __always_inline bool get_tbl_name_by_handle(struct tbl_key *key, u64 handle)
+{
+    struct tbl_handle_key hkey = {.handle = handle, .family = key->family};
+    u8 *name = bpf_map_lookup_elem(&tbl_handle_map, &hkey);
+    if (!name)
+    {
+        return false;
+    }
+    __builtin_memcpy(key->name, name, MAX_TBL_NAME);
+    return true;
+}
+
+static __always_inline bool is_allowed_pid(u32 gen, u32 pid)
+{
+    return lookup_policy(&allowed_pid_map, gen, &pid) != NULL;
+}
+
+static __always_inline bool is_allowed_cgroup(u32 gen)
+{
+    u64 cgroup_id = bpf_get_current_cgroup_id();
+    return lookup_policy(&allowed_cgroup_map, gen, &cgroup_id) != NULL;
+}
+
+static __always_inline void get_inode_key(struct inode *inode, struct exe_key *key)
+{
+    key->ino = BPF_CORE_READ(inode, i_ino);
+    key->dev = BPF_CORE_READ(inode, i_sb, s_dev);
+}
+
+static __always_inline bool get_task_exe(struct task_struct *task, struct exe_key *key)
+{
+    struct file *exe_file = BPF_CORE_READ(task, mm, exe_file);
+    if (!exe_file)
+    {
+        return false;
+    }
+    get_inode_key(BPF_CORE_READ(exe_file, f_inode), key);
+    return true;
+}
+
+/* match_exe is true if the executable of the current process is in the map of exe_owner and its parent matches */
+static __always_inline bool match_exe(void *map, u32 gen)
+{
+    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+    struct exe_key key = {};
+    if (!get_task_exe(task, &key))
+    {
+        return false;
+    }
+
+    struct exe_owner *owner = lookup_policy(map, gen, &key);
+    if (!owner)
+    {
+        return false;
+    }
+    if (owner->parent.ino == 0)
+    {
+        return true;
+    }
+
+    struct exe_key parent = {};
+    if (!get_task_exe(BPF_CORE_READ(task, real_parent), &parent))
+    {
+        return false;
+    }
+    return parent.ino == owner->parent.ino && parent.dev == owner->parent.dev;
+}
+
+static __always_inline bool is_allowed_exe(u32 gen)
+{
+    return match_exe(&allowed_exe_map, gen);
+}
+
+static __always_inline bool is_break_glass(u32 gen)
+{
+    return match_exe(&break_glass_exe_map, gen);
+}
+
+static __always_inline bool is_updater(u32 gen)
+{
+    return match_exe(&updater_exe_map, gen);
+}
+
+/* owner PIDs are not trusted in lockdown, they may be reused after the daemon is gone */
+static __always_inline bool is_owner(u32 gen, u32 pid)
+{
+    return (!is_locked_down() && is_allowed_pid(gen, pid)) || is_allowed_cgroup(gen) || is_allowed_exe(gen);
+}
+
+static __always_inline u32 get_name_len(u8 *name)
+{
+    u32 len = 0;
+    while (len < MAX_TBL_NAME && name[len] != '\0')
+    {
+        len++;
+    }
+    return len;
+}
+
+static __always_inline bool glob_match(struct tbl_pattern *p, u8 *name, u32 name_len)
+{
+    u32 prefix_len = p->prefix_len;
+    u32 suffix_len = p->suffix_len;
+
+    if (p->has_star ? name_len < prefix_len + suffix_len : name_len != prefix_len + suffix_len)
+    {
+        return false;
+    }
+    for (u32 i = 0; i < MAX_TBL_NAME && i < prefix_len; i++)
+    {
+        if (p->text[i] != '?' && p->text[i] != name[i])
+        {
+            return false;
+        }
+    }
+    for (u32 i = 0; i < MAX_TBL_NAME && i < suffix_len; i++)
+    {
+        u32 pi = prefix_len + i;
+        u32 ni = name_len - suffix_len + i;
+        if (pi >= MAX_TBL_NAME || ni >= MAX_TBL_NAME)
+        {
+            return false;
+        }
+        if (p->text[pi] != '?' && p->text[pi] != name[ni])
+        {
+            return false;
+        }
+    }
+    return true;
+}
+
+/* get_tbl_pattern_flags matches patterns of the family of the key, or of every family if any_family is set */
+static __always_inline u8 get_tbl_pattern_flags(u32 gen, struct tbl_key *key, bool any_family)
+{
+    u32 name_len = get_name_len(key->name);
+
+    for (u32 i = 0; i < MAX_TBL_PATTERNS; i++)
+    {
+        struct tbl_pattern *p = lookup_policy(&protected_pattern_map, gen, &i);
+        if (!p || (!p->has_star && p->prefix_len == 0))
+        {
+            break;
+        }
+        if (!any_family && p->family != NFPROTO_ANY && p->family != key->family)
+        {
+            continue;
+        }
+        if (glob_match(p, key->name, name_len))
+        {
+            return p->flags | TBL_F_PROTECTED;
+        }
+    }
+    return 0;
+}
+
+/* get_tbl_flags matches exact names of the family, then exact names of any family and then patterns,
+ * it returns 0 if the table is not protected
+ */
+static __always_inline u8 get_tbl_flags(u32 gen, struct tbl_key *key)
+{
+    u8 *flags = lookup_policy(&protected_tbl_name_map, gen, key);
+    if (flags)
+    {
+        return *flags | TBL_F_PROTECTED;
+    }
+    if (key->family != NFPROTO_ANY)
+    {
+        struct tbl_key any = {.family = NFPROTO_ANY};
+        __builtin_memcpy(any.name, key->name, MAX_TBL_NAME);
+        flags = lookup_policy(&protected_tbl_name_map, gen, &any);
+        if (flags)
+        {
+            return *flags | TBL_F_PROTECTED;
+        }
+    }
+    return get_tbl_pattern_flags(gen, key, false);
+}
+
+/* get_flushed_tbl_flags is for DELTABLE with NFPROTO_UNSPEC, the kernel deletes the named table of every family,
+ * so the name is matched against protected tables and patterns of all families
+ */
+static __always_inline u8 get_flushed_tbl_flags(u32 gen, struct tbl_key *key)
+{
+    struct tbl_key k = {};
+    __builtin_memcpy(k.name, key->name, MAX_TBL_NAME);
+    for (u32 f = 0; f < MAX_FAMILY; f++)
+    {
+        k.family = f;
+        u8 *flags = lookup_policy(&protected_tbl_name_map, gen, &k);
+        if (flags)
+        {
+            return *flags | TBL_F_PROTECTED;
+        }
+    }
+    return get_tbl_pattern_flags(gen, key, true);
+}
 
-#define NAME_CMP(src1, src2, len)                                 \
-    ({                                                            \
-        u32 i = 0;                                                \
-        while (i < len && i < MAX_TBL_NAME && src1[i] == src2[i]) \
-        {                                                         \
-            i++;                                                  \
-        }                                                         \
-        i == len;                                                 \
+#define TRIM_NAME(tbl_name)                    \
+    ({                                         \
+        bool found = false;                    \
+        for (u32 i = 0; i < MAX_TBL_NAME; i++) \
+        {                                      \
+            if (found)                         \
+            {                                  \
+                tbl_name[i] = '\0';            \
+            }                                  \
+            else if (tbl_name[i] == '\0')      \
+            {                                  \
+                found = true;                  \
+            }                                  \
+        }                                      \
     })
 
 #endif
\ No newline at end of file
@@ -10,6 +10,7 @@
 #include <linux/netfilter/nf_tables.h>
 
 #include "netlink.h"
+#include "self.h"
 
 char LICENSE[] SEC("license") = "GPL";
 
@@ -22,6 +23,20 @@ int BPF_PROG(lsm_netlink_send, struct sock *sk, struct sk_buff *skb)
     return nl_handle_msg(skb);
 }
 
+/* the same as the LSM hook but works without BPF LSM enabled, fmod_ret is allowed on security_* functions */
+SEC("fmod_ret/security_netlink_send")
+int BPF_PROG(fmod_ret_netlink_send, struct sock *sk, struct sk_buff *skb, int ret)
+{
+    if (ret != 0)
+        return ret;
+
+    if (BPF_CORE_READ(sk, sk_protocol) != NETLINK_NETFILTER)
+        return 0;
+
+    return nl_handle_msg(skb);
+}
+
+/* detect only, the return value of kprobe does not affect nfnetlink_rcv */
 SEC("kprobe/nfnetlink_rcv")
 int kprobe_nfnetlink_rcv(struct pt_regs *ctx)
 {
@@ -29,3 +44,153 @@ int kprobe_nfnetlink_rcv(struct pt_regs *ctx)
     nl_handle_msg(skb);
     return 0;
 }
+
+/* when the last thread of the daemon exits, even if it is killed, the lockdown armed by the daemon is engaged
+ * and self-protection is turned off, so the next instance can take the pinned objects over
+ */
+SEC("tp_btf/sched_process_exit")
+int BPF_PROG(on_protector_exit, struct task_struct *task)
+{
+    u32 key = 0;
+    u32 tgid = BPF_CORE_READ(task, tgid);
+
+    if (BPF_CORE_READ(task, signal, live.counter) != 0)
+        return 0;
+
+    struct lockdown *l = bpf_map_lookup_elem(&lockdown_map, &key);
+    if (l && l->tgid != 0 && l->tgid == tgid)
+        l->engaged = 1;
+
+    struct self *s = bpf_map_lookup_elem(&self_map, &key);
+    if (s && s->tgid == tgid)
+        s->tgid = 0;
+
+    return 0;
+}
+
+/* self-protection, fds of our objects are the only way to tamper with them */
+SEC("lsm/bpf")
+int BPF_PROG(lsm_bpf, int cmd, union bpf_attr *attr, unsigned int size)
+{
+    return self_check_cmd(cmd, attr);
+}
+
+SEC("lsm/bpf_map")
+int BPF_PROG(lsm_bpf_map, struct bpf_map *map, fmode_t fmode)
+{
+    return self_check_map(map, fmode);
+}
+
+SEC("lsm/bpf_prog")
+int BPF_PROG(lsm_bpf_prog, struct bpf_prog *prog)
+{
+    return self_check_prog(prog);
+}
+
+/* the same as the LSM hooks for fmod_ret backend; security_bpf got a trailing argument in newer kernels, so
+ * the previous return value is taken with bpf_get_func_ret, kernels without it (< 5.17) have three arguments
+ */
+SEC("fmod_ret/security_bpf")
+int BPF_PROG(fmod_ret_bpf, int cmd, union bpf_attr *attr, unsigned int size)
+{
+    __u64 ret;
+
+    if (HAVE_BPF_GET_FUNC_RET)
+        bpf_get_func_ret(ctx, &ret);
+    else
+        ret = ctx[3];
+    if ((int)ret != 0)
+        return (int)ret;
+    return self_check_cmd(cmd, attr);
+}
+
+SEC("fmod_ret/security_bpf_map")
+int BPF_PROG(fmod_ret_bpf_map, struct bpf_map *map, fmode_t fmode, int ret)
+{
+    if (ret != 0)
+        return ret;
+    return self_check_map(map, fmode);
+}
+
+SEC("fmod_ret/security_bpf_prog")
+int BPF_PROG(fmod_ret_bpf_prog, struct bpf_prog *prog, int ret)
+{
+    if (ret != 0)
+        return ret;
+    return self_check_prog(prog);
+}
+
+/* optional guard of the protector and owner PIDs against SIGKILL, SIGSTOP and ptrace */
+SEC("lsm/task_kill")
+int BPF_PROG(lsm_task_kill, struct task_struct *p, struct kernel_siginfo *info, int sig, const struct cred *cred)
+{
+    return guard_check_kill(p, sig);
+}
+
+SEC("lsm/ptrace_access_check")
+int BPF_PROG(lsm_ptrace_access_check, struct task_struct *child, unsigned int mode)
+{
+    return guard_check_ptrace(child);
+}
+
+SEC("fmod_ret/security_task_kill")
+int BPF_PROG(fmod_ret_task_kill, struct task_struct *p, struct kernel_siginfo *info, int sig, const struct cred *cred,
+             int ret)
+{
+    if (ret != 0)
+        return ret;
+    return guard_check_kill(p, sig);
+}
+
+SEC("fmod_ret/security_ptrace_access_check")
+int BPF_PROG(fmod_ret_ptrace_access_check, struct task_struct *child, unsigned int mode, int ret)
+{
+    if (ret != 0)
+        return ret;
+    return guard_check_ptrace(child);
+}
+
+/* the config file, the binary and the pinned objects are read-only for everybody but the protector and updaters */
+SEC("lsm/file_open")
+int BPF_PROG(lsm_file_open, struct file *file)
+{
+    return file_check_open(file);
+}
+
+SEC("lsm/inode_rename")
+int BPF_PROG(lsm_inode_rename, struct inode *old_dir, struct dentry *old_dentry, struct inode *new_dir,
+             struct dentry *new_dentry)
+{
+    return file_check_rename(old_dir, old_dentry, new_dir, new_dentry);
+}
+
+SEC("lsm/inode_unlink")
+int BPF_PROG(lsm_inode_unlink, struct inode *dir, struct dentry *dentry)
+{
+    return file_check_unlink(dir, dentry);
+}
+
+SEC("fmod_ret/security_file_open")
+int BPF_PROG(fmod_ret_file_open, struct file *file, int ret)
+{
+    if (ret != 0)
+        return ret;
+    return file_check_open(file);
+}
+
+SEC("fmod_ret/security_inode_rename")
+int BPF_PROG(fmod_ret_inode_rename, struct inode *old_dir, struct dentry *old_dentry, struct inode *new_dir,
+             struct dentry *new_dentry, unsigned int flags, int ret)
+{
+    if (ret != 0)
+        return ret;
+    return file_check_rename(old_dir, old_dentry, new_dir, new_dentry);
+}
+
+SEC("fmod_ret/security_inode_unlink")
+int BPF_PROG(fmod_ret_inode_unlink, struct inode *dir, struct dentry *dentry, int ret)
+{
+    if (ret != 0)
+        return ret;
+    return file_check_unlink(dir, dentry);
+}
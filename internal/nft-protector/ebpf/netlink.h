@@ -3,6 +3,7 @@
 
 #include "input_params.h"
 #include "send_event.h"
+#include "policy.h"
 
 #define NETLINK_NETFILTER 12 /* netfilter subsystem */
 
@@ -18,14 +19,23 @@
 #define NLMSG_ALIGNTO 4U
 #define NLMSG_ALIGN(len) (((len) + NLMSG_ALIGNTO - 1) & ~(NLMSG_ALIGNTO - 1))
 
+/* bounds of the walk when bpf_loop is not available (kernel < 5.17) */
 #define MAX_ATTRS 32
 #define MAX_MSGS 16
 
-#define ATTR_IS_TABLE_NAME(t)   \
-    ((t) == NFTA_TABLE_NAME ||  \
-     (t) == NFTA_CHAIN_TABLE || \
-     (t) == NFTA_RULE_TABLE ||  \
-     (t) == NFTA_SET_TABLE)
+/* bounds of the walk with bpf_loop, a batch can't have more as skb is limited by socket buffer */
+#define MAX_LOOP_ATTRS (1 << 16)
+#define MAX_LOOP_MSGS (1 << 16)
+
+/* used only to check whether the running kernel has bpf_loop and bpf_get_func_ret */
+enum bpf_func_id___local
+{
+    BPF_FUNC_loop___local = 181,
+    BPF_FUNC_get_func_ret___local = 184,
+};
+
+#define HAVE_BPF_LOOP bpf_core_enum_value_exists(enum bpf_func_id___local, BPF_FUNC_loop___local)
+#define HAVE_BPF_GET_FUNC_RET bpf_core_enum_value_exists(enum bpf_func_id___local, BPF_FUNC_get_func_ret___local)
 
 struct nfgenmsg
 {
@@ -34,117 +44,341 @@ struct nfgenmsg
     __be16 res_id;     /* resource id */
 };
 
-static __always_inline bool nl_attr_has_protected_tbl(void *attr_buf, u32 len)
+enum tbl_ref
 {
-    for (int n = 0; n < MAX_ATTRS && len >= sizeof(struct nlattr); n++)
+    TBL_REF_NONE = 0,
+    TBL_REF_NAME,
+    TBL_REF_HANDLE,
+};
+
+struct attr_walk
+{
+    void *buf;
+    u32 len;
+    bool done;
+    enum tbl_ref ref;
+    struct nft_msg_desc desc;
+    u64 handle;
+    struct tbl_key key;
+    bool long_name; /* the table name doesn't fit into the key, so it can't be checked */
+    u8 obj_name[MAX_TBL_NAME];
+};
+
+/* nl_walk_attr handles one attribute, returns 1 to stop the walk.
+ * The kernel takes the last one of duplicated attributes so the walk never stops on a match,
+ * and it looks the table up by handle when both the handle and the name are given.
+ */
+static long nl_walk_attr(u32 idx, void *ctx)
+{
+    struct attr_walk *w = ctx;
+
+    if (w->len < sizeof(struct nlattr))
     {
-        struct nlattr *nla = attr_buf;
-        u32 nla_len = BPF_CORE_READ(nla, nla_len);
-        if (nla_len < sizeof(*nla) || nla_len > len)
+        w->done = true;
+        return 1;
+    }
+
+    struct nlattr *nla = w->buf;
+    u32 nla_len = BPF_CORE_READ(nla, nla_len);
+    if (nla_len < sizeof(*nla) || nla_len > w->len)
+    {
+        /* the kernel ignores the rest too */
+        w->done = true;
+        return 1;
+    }
+
+    u16 nla_type = BPF_CORE_READ(nla, nla_type) & NLA_TYPE_MASK;
+    if (nla_type == w->desc.tbl_attr)
+    {
+        u32 name_len = nla_len - sizeof(*nla);
+        if (name_len > MAX_TBL_NAME)
         {
-            return false;
+            name_len = MAX_TBL_NAME;
         }
 
-        if (ATTR_IS_TABLE_NAME(BPF_CORE_READ(nla, nla_type) & NLA_TYPE_MASK))
+        __builtin_memset(w->key.name, 0, MAX_TBL_NAME);
+        if (bpf_probe_read_kernel(w->key.name, name_len, (void *)nla + sizeof(*nla)) != 0)
+        {
+            return 1; /* not done, fail closed */
+        }
+        w->long_name = w->key.name[MAX_TBL_NAME - 1] != '\0';
+        TRIM_NAME(w->key.name);
+        if (w->ref != TBL_REF_HANDLE)
+        {
+            w->ref = TBL_REF_NAME;
+        }
+    }
+    else if (w->desc.obj_attr != 0 && nla_type == w->desc.obj_attr)
+    {
+        u32 name_len = nla_len - sizeof(*nla);
+        if (name_len > MAX_TBL_NAME)
         {
-            char tbl_name[MAX_TBL_NAME];
+            name_len = MAX_TBL_NAME;
+        }
 
-            if (bpf_probe_read_kernel(tbl_name, sizeof(tbl_name), (void *)nla + sizeof(*nla)) != 0)
-            {
-                return false;
-            }
+        __builtin_memset(w->obj_name, 0, MAX_TBL_NAME);
+        if (bpf_probe_read_kernel(w->obj_name, name_len, (void *)nla + sizeof(*nla)) != 0)
+        {
+            return 1; /* not done, fail closed */
+        }
+        TRIM_NAME(w->obj_name);
+    }
+    else if (w->desc.handle_attr != 0 && nla_type == w->desc.handle_attr)
+    {
+        __be64 be_handle = 0;
+        if (bpf_probe_read_kernel(&be_handle, sizeof(be_handle), (void *)nla + sizeof(*nla)) != 0)
+        {
+            return 1; /* not done, fail closed */
+        }
+        w->handle = bpf_be64_to_cpu(be_handle);
+        w->ref = TBL_REF_HANDLE;
+    }
 
-            char protected_tbl_name[MAX_TBL_NAME];
-            if (!GET_PROTECTED_TBL_NAME(protected_tbl_name))
-            {
-                return false;
-            }
-            u32 len = GET_NAME_LEN(protected_tbl_name);
-            if (len == 0 || nla_len - sizeof(*nla) < len)
-            {
-                return false;
-            }
-            if (NAME_CMP(tbl_name, protected_tbl_name, len))
+    u32 step = NLMSG_ALIGN(nla_len);
+    if (step >= w->len)
+    {
+        w->done = true;
+        return 1;
+    }
+    w->buf += step;
+    w->len -= step;
+    return 0;
+}
+
+/* nl_attr_find_tbl looks for the table the message refers to either by name or by handle,
+ * returns false if the attributes could not be walked through to the end
+ */
+static __always_inline bool nl_attr_find_tbl(struct attr_walk *w)
+{
+    if (HAVE_BPF_LOOP)
+    {
+        bpf_loop(MAX_LOOP_ATTRS, nl_walk_attr, w, 0);
+    }
+    else
+    {
+        for (int n = 0; n < MAX_ATTRS; n++)
+        {
+            if (nl_walk_attr(n, w))
             {
-                return true;
+                break;
             }
-            return false;
         }
-
-        u32 step = (nla_len + 3) & ~3;
-        attr_buf += step;
-        len -= step;
     }
-    return false;
+    return w->done;
 }
 
-static __always_inline int nl_handle_msg(struct sk_buff *skb)
+/* nl_attr_tbl_flags returns TBL_F_xxx of the protected table the message changes, 0 if there is no such */
+static __always_inline u8 nl_attr_tbl_flags(u32 gen, struct attr_walk *w)
 {
-    void *data = (void *)BPF_CORE_READ(skb, data);
-    void *data_end = data + BPF_CORE_READ(skb, len);
-
-    for (int i = 0; i < MAX_MSGS; i++)
+    switch (w->ref)
     {
-        struct nlmsghdr *nlh = data;
-        if ((void *)nlh + sizeof(*nlh) > data_end)
+    case TBL_REF_NAME:
+        if ((w->desc.flags & NFT_MSG_F_FLUSH) && w->key.family == NFPROTO_ANY)
         {
-            break;
+            return get_flushed_tbl_flags(gen, &w->key);
         }
-
-        u32 nlh_len = BPF_CORE_READ(nlh, nlmsg_len);
-        if (nlh_len == 0 || (void *)nlh + nlh_len > data_end)
+        return get_tbl_flags(gen, &w->key);
+    case TBL_REF_HANDLE:
+        if (get_tbl_name_by_handle(&w->key, w->handle))
         {
-            break;
+            return get_tbl_flags(gen, &w->key);
         }
+        /* unknown handle may refer to a protected table which is not tracked yet */
+        return has_protected_tbls(gen, w->key.family) ? TBL_F_PROTECTED : 0;
+    default:
+        /* e.g. 'nft flush ruleset' sends DELTABLE without any table reference */
+        return (w->desc.flags & NFT_MSG_F_FLUSH) && has_protected_tbls(gen, w->key.family) ? TBL_F_PROTECTED : 0;
+    }
+}
 
-        u16 ntype = BPF_CORE_READ(nlh, nlmsg_type);
-        u8 subsys = NFNL_SUBSYS_ID(ntype);
-        u8 mtype = NFNL_MSG_TYPE(ntype);
+struct msg_walk
+{
+    void *data;
+    void *data_end;
+    u32 gen; /* the policy generation the whole batch is checked against */
+    bool done;
+    bool owner;
+    bool has_rules;
+    bool frozen; /* every change is denied, the process is not a break-glass owner */
+    int ret;
+    struct subject subj;
+};
 
-        if (subsys != NFNL_SUBSYS_NFTABLES)
+static __always_inline void nl_report(u8 reason, u8 verdict, u8 mtype, struct tbl_key *key, u16 rule_id)
+{
+    u8 comm[TASK_COMM_LEN];
+    u32 curr_pid = bpf_get_current_pid_tgid() >> 32;
+
+    if (bpf_get_current_comm(&comm, TASK_COMM_LEN) == 0)
+    {
+        send_event(curr_pid, comm, reason, verdict, mtype, key, rule_id, 0);
+    }
+}
+
+/* nl_apply_rule applies the first policy rule matching the message, returns false if there is no such rule */
+static __always_inline bool nl_apply_rule(struct msg_walk *w, struct attr_walk *aw, u8 mtype)
+{
+    struct object obj = {
+        .msg_type = mtype,
+        .obj_kind = aw->desc.obj_kind,
+        .tbl = &aw->key,
+        .name = aw->obj_name,
+    };
+    if (aw->ref == TBL_REF_HANDLE && !get_tbl_name_by_handle(&aw->key, aw->handle))
+    {
+        __builtin_memset(aw->key.name, 0, MAX_TBL_NAME); /* unknown table may be any */
+    }
+
+    struct policy_rule *r = match_rule(w->gen, &w->subj, &obj);
+    if (!r)
+    {
+        return false;
+    }
+    u8 verdict;
+    switch (r->verdict)
+    {
+    case RULE_ALLOW:
+        return true;
+    case RULE_AUDIT:
+        verdict = VERDICT_AUDIT;
+        break;
+    default:
+        verdict = get_verdict(w->gen, 0);
+    }
+    nl_report(EVENT_REASON_RULE, verdict, mtype, &aw->key, r->id);
+    if (verdict == VERDICT_DENY)
+    {
+        w->ret = -EPERM;
+    }
+    return true;
+}
+
+/* nl_walk_msg handles one netlink message of the batch, returns 1 to stop the walk */
+static long nl_walk_msg(u32 idx, void *ctx)
+{
+    struct msg_walk *w = ctx;
+    struct nlmsghdr *nlh = w->data;
+
+    if ((void *)nlh + sizeof(*nlh) > w->data_end)
+    {
+        w->done = true;
+        return 1;
+    }
+
+    u32 nlh_len = BPF_CORE_READ(nlh, nlmsg_len);
+    if (nlh_len < sizeof(*nlh) || (void *)nlh + nlh_len > w->data_end)
+    {
+        /* the kernel stops processing the batch here too */
+        w->done = true;
+        return 1;
+    }
+
+    u16 ntype = BPF_CORE_READ(nlh, nlmsg_type);
+    u8 mtype = NFNL_MSG_TYPE(ntype);
+    struct nft_msg_desc *desc = get_nft_msg_desc(mtype);
+
+    if (NFNL_SUBSYS_ID(ntype) == NFNL_SUBSYS_NFTABLES && desc && desc->tbl_attr != 0 &&
+        nlh_len >= sizeof(struct nlmsghdr) + sizeof(struct nfgenmsg))
+    {
+        struct attr_walk aw = {};
+        struct nfgenmsg *nfmsg = (void *)nlh + sizeof(struct nlmsghdr);
+
+        aw.desc = *desc;
+        aw.key.family = BPF_CORE_READ(nfmsg, nfgen_family);
+        aw.buf = (void *)nfmsg + sizeof(struct nfgenmsg);
+        aw.len = nlh_len - sizeof(struct nlmsghdr) - sizeof(struct nfgenmsg);
+        if (w->frozen)
         {
-            data += NLMSG_ALIGN(nlh_len);
-            continue;
+            nl_attr_find_tbl(&aw); /* only to report the table */
+            nl_report(EVENT_REASON_FREEZE, VERDICT_DENY, mtype, &aw.key, 0);
+            w->ret = -EPERM;
+            return 1;
         }
-
-        switch (mtype)
+        u8 reason = EVENT_REASON_PROTECTED_TBL;
+        u8 flags = 0;
+        if (!nl_attr_find_tbl(&aw) || aw.long_name)
         {
-        case NFT_MSG_NEWTABLE:
-        case NFT_MSG_DELTABLE:
-        case NFT_MSG_NEWRULE:
-        case NFT_MSG_DELRULE:
-        case NFT_MSG_NEWCHAIN:
-        case NFT_MSG_DELCHAIN:
-        case NFT_MSG_NEWSET:
-        case NFT_MSG_DELSET:
+            /* the table is unknown or a truncated name might escape a pattern,
+             * so fail closed if there is anything to protect
+             */
+            reason = aw.long_name ? EVENT_REASON_LONG_NAME : EVENT_REASON_WALK_INCOMPLETE;
+            flags = !w->owner && (w->has_rules || has_protected_tbls(w->gen, NFPROTO_ANY)) ? TBL_F_PROTECTED : 0;
+        }
+        else if (w->has_rules && nl_apply_rule(w, &aw, mtype))
         {
-            void *attr_buf;
-            u32 attr_len;
-
-            attr_buf = (void *)nlh + sizeof(struct nlmsghdr) + sizeof(struct nfgenmsg);
-            attr_len = nlh_len - sizeof(struct nlmsghdr) - sizeof(struct nfgenmsg);
-            u32 curr_pid = bpf_get_current_pid_tgid() >> 32;
-            if (nl_attr_has_protected_tbl(attr_buf, attr_len) &&
-                curr_pid != get_allowed_pid())
+            if (w->ret != 0)
             {
-                u8 comm[TASK_COMM_LEN];
-                if (bpf_get_current_comm(&comm, TASK_COMM_LEN) == 0)
-                {
-                    send_event(curr_pid, comm);
-                }
-                return -EPERM;
+                return 1;
             }
-
-            break;
         }
-        default:
-            break;
+        else if (!w->owner)
+        {
+            flags = nl_attr_tbl_flags(w->gen, &aw);
+        }
+        if (flags)
+        {
+            u8 verdict = get_verdict(w->gen, flags);
+            nl_report(reason, verdict, mtype, &aw.key, 0);
+            if (verdict == VERDICT_DENY)
+            {
+                w->ret = -EPERM;
+                return 1;
+            }
         }
-
-        data += NLMSG_ALIGN(nlh_len);
     }
 
+    w->data += NLMSG_ALIGN(nlh_len);
     return 0;
 }
 
-#endif
\ No newline at end of file
+static __always_inline int nl_handle_msg(struct sk_buff *skb)
+{
+    struct msg_walk w = {};
+
+    /* policy rules apply to owners too, in lockdown only owners may change protected tables,
+     * in the freeze only break-glass owners may change anything regardless of the mode
+     */
+    w.gen = get_policy_gen();
+    w.frozen = is_frozen() && !is_break_glass(w.gen);
+    w.owner = !w.frozen && is_owner(w.gen, bpf_get_current_pid_tgid() >> 32);
+    w.has_rules = !w.frozen && !is_locked_down() && has_policy_rules(w.gen);
+    if (w.owner && !w.has_rules)
+    {
+        return 0;
+    }
+    if (w.has_rules)
+    {
+        get_subject(&w.subj);
+    }
+
+    w.data = (void *)BPF_CORE_READ(skb, data);
+    w.data_end = w.data + BPF_CORE_READ(skb, len);
+    if (HAVE_BPF_LOOP)
+    {
+        bpf_loop(MAX_LOOP_MSGS, nl_walk_msg, &w, 0);
+    }
+    else
+    {
+        for (int i = 0; i < MAX_MSGS; i++)
+        {
+            if (nl_walk_msg(i, &w))
+            {
+                break;
+            }
+        }
+    }
+
+    bool checked = w.frozen || (!w.owner && (w.has_rules || has_protected_tbls(w.gen, NFPROTO_ANY)));
+    if (w.ret == 0 && !w.done && checked)
+    {
+        /* the batch is longer than we are able to check */
+        struct tbl_key key = {};
+        u8 verdict = w.frozen ? VERDICT_DENY : get_verdict(w.gen, 0);
+        nl_report(EVENT_REASON_WALK_INCOMPLETE, verdict, 0, &key, 0);
+        return verdict == VERDICT_DENY ? -EPERM : 0;
+    }
+
+    return w.ret;
+}
+
+#endif
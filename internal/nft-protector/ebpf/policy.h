@@ -0,0 +1,214 @@
+#ifndef __POLICY_H__
+#define __POLICY_H__
+
+#include "input_params.h"
+
+#define MAX_POLICY_RULES 32
+#define MAX_RULE_CGROUPS 1024
+#define COMM_LEN 16 /* kernel TASK_COMM_LEN */
+
+#define RULE_SUBJ_PID (1 << 0)
+#define RULE_SUBJ_UID (1 << 1)
+#define RULE_SUBJ_COMM (1 << 2)
+#define RULE_SUBJ_CGROUP (1 << 3)
+#define RULE_SUBJ_EXE (1 << 4)
+
+#define RULE_OBJ_TABLE (1 << 0)
+#define RULE_OBJ_NAME (1 << 1) /* chain or set name */
+
+enum rule_verdict
+{
+    RULE_ALLOW = 0,
+    RULE_DENY,
+    RULE_AUDIT,
+};
+
+/* kind of the object the message changes inside the table */
+enum obj_kind
+{
+    OBJ_NONE = 0,
+    OBJ_CHAIN, /* chains and rules */
+    OBJ_SET,   /* sets and set elements */
+    OBJ_OBJ,
+    OBJ_FLOWTABLE,
+};
+
+struct policy_rule
+{
+    u64 ops; /* bit per NFT_MSG_xxx */
+    u64 exe_ino;
+    u32 exe_dev;
+    u32 pid;
+    u32 uid;
+    u16 id;      /* position in the policy starting from 1, 0 ends the policy */
+    u8 verdict;  /* enum rule_verdict */
+    u8 subj;     /* RULE_SUBJ_xxx to match */
+    u8 obj;      /* RULE_OBJ_xxx to match */
+    u8 family;   /* NFPROTO_ANY matches all */
+    u8 obj_kind; /* enum obj_kind the name refers to */
+    u8 comm[COMM_LEN];
+    u8 table[MAX_TBL_NAME];
+    u8 name[MAX_TBL_NAME];
+};
+
+const struct policy_rule *unused_policy_rule __attribute__((unused));
+
+/* cgroup the rule with RULE_SUBJ_CGROUP matches, ids are resolved by the daemon like cgroups of owners */
+struct rule_cgroup_key
+{
+    u64 cgroup_id;
+    u32 rule; /* id of the rule */
+    u32 pad;
+};
+
+const struct rule_cgroup_key *unused_rule_cgroup_key __attribute__((unused));
+
+/* the process which sends the message */
+struct subject
+{
+    u32 pid;
+    u32 uid;
+    struct exe_key exe;
+    u8 comm[COMM_LEN];
+    u64 cgroup_id;
+};
+
+/* what the message changes */
+struct object
+{
+    u8 msg_type;
+    u8 obj_kind;
+    struct tbl_key *tbl; /* empty name if the message affects all tables */
+    u8 *name;            /* empty if the message affects all objects of the table */
+};
+
+/* rules are evaluated in order, the first matching one decides */
+POLICY_MAP(policy_rule_map, BPF_MAP_TYPE_ARRAY, MAX_POLICY_RULES, u32, struct policy_rule);
+POLICY_MAP(rule_cgroup_map, BPF_MAP_TYPE_HASH, MAX_RULE_CGROUPS, struct rule_cgroup_key, u8);
+
+static __always_inline bool has_policy_rules(u32 gen)
+{
+    u32 key = 0;
+    struct policy_rule *r = lookup_policy(&policy_rule_map, gen, &key);
+    return r && r->id != 0;
+}
+
+static __always_inline void get_subject(struct subject *s)
+{
+    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+
+    s->pid = bpf_get_current_pid_tgid() >> 32;
+    s->uid = (u32)bpf_get_current_uid_gid();
+    get_task_exe(task, &s->exe);
+    bpf_get_current_comm(s->comm, COMM_LEN);
+    s->cgroup_id = bpf_get_current_cgroup_id();
+}
+
+/* str_eq compares zero padded strings */
+static __always_inline bool str_eq(const u8 *a, const u8 *b, u32 n)
+{
+    for (u32 i = 0; i < n && i < MAX_TBL_NAME; i++)
+    {
+        if (a[i] != b[i])
+        {
+            return false;
+        }
+        if (a[i] == '\0')
+        {
+            break;
+        }
+    }
+    return true;
+}
+
+/* rule_match_subject: the executable or the cgroup which is not resolved matches nothing */
+static __always_inline bool rule_match_subject(u32 gen, struct policy_rule *r, struct subject *s)
+{
+    if ((r->subj & RULE_SUBJ_PID) && r->pid != s->pid)
+    {
+        return false;
+    }
+    if ((r->subj & RULE_SUBJ_UID) && r->uid != s->uid)
+    {
+        return false;
+    }
+    if ((r->subj & RULE_SUBJ_EXE) && (r->exe_ino == 0 || r->exe_ino != s->exe.ino || r->exe_dev != s->exe.dev))
+    {
+        return false;
+    }
+    if ((r->subj & RULE_SUBJ_COMM) && !str_eq(r->comm, s->comm, COMM_LEN))
+    {
+        return false;
+    }
+    if (r->subj & RULE_SUBJ_CGROUP)
+    {
+        struct rule_cgroup_key key = {.cgroup_id = s->cgroup_id, .rule = r->id};
+        if (!lookup_policy(&rule_cgroup_map, gen, &key))
+        {
+            return false;
+        }
+    }
+    return true;
+}
+
+/* rule_match_object: a message which affects all tables or all objects of the table
+ * can't be allowed by a rule limited to a name but it is denied or audited by such a rule
+ */
+static __always_inline bool rule_match_object(struct policy_rule *r, struct object *o)
+{
+    if (!(r->ops & (1ULL << (o->msg_type & 63))))
+    {
+        return false;
+    }
+    if (r->family != NFPROTO_ANY && r->family != o->tbl->family)
+    {
+        return false;
+    }
+    if (r->obj & RULE_OBJ_TABLE)
+    {
+        if (o->tbl->name[0] == '\0')
+        {
+            return r->verdict != RULE_ALLOW;
+        }
+        if (!str_eq(r->table, o->tbl->name, MAX_TBL_NAME))
+        {
+            return false;
+        }
+    }
+    if (r->obj & RULE_OBJ_NAME)
+    {
+        if (r->obj_kind != o->obj_kind)
+        {
+            return false;
+        }
+        if (o->name[0] == '\0')
+        {
+            return r->verdict != RULE_ALLOW;
+        }
+        if (!str_eq(r->name, o->name, MAX_TBL_NAME))
+        {
+            return false;
+        }
+    }
+    return true;
+}
+
+/* match_rule returns the first rule matching the message, NULL if there is no such */
+static __always_inline struct policy_rule *match_rule(u32 gen, struct subject *s, struct object *o)
+{
+    for (u32 i = 0; i < MAX_POLICY_RULES; i++)
+    {
+        struct policy_rule *r = lookup_policy(&policy_rule_map, gen, &i);
+        if (!r || r->id == 0)
+        {
+            break;
+        }
+        if (rule_match_subject(gen, r, s) && rule_match_object(r, o))
+        {
+            return r;
+        }
+    }
+    return NULL;
+}
+
+#endif
@@ -0,0 +1,334 @@
+#ifndef __SELF_H__
+#define __SELF_H__
+
+#include "input_params.h"
+#include "send_event.h"
+#include "policy.h"
+
+#define FMODE_WRITE 0x2
+
+#define MAX_SELF_OBJS 256
+
+/* enum tamper_op is in msg_type of EVENT_REASON_TAMPER events */
+enum tamper_op
+{
+    TAMPER_MAP_WRITE = 0, /* a writable fd of our map */
+    TAMPER_PROG_OPEN,     /* an fd of our program, e.g. to replace it */
+    TAMPER_LINK_OPEN,     /* an fd of our link, e.g. to detach or update it */
+    TAMPER_LINK_CHANGE,   /* our link detached or updated by an fd, e.g. got from the pin */
+    TAMPER_KILL,          /* SIGKILL to the protector or an owner */
+    TAMPER_STOP,          /* SIGSTOP to the protector or an owner */
+    TAMPER_PTRACE,        /* ptrace of the protector or an owner */
+    TAMPER_FILE_WRITE,    /* a protected file opened for writing, table is the file name */
+    TAMPER_FILE_RENAME,   /* a protected file renamed or replaced by rename */
+    TAMPER_FILE_UNLINK,   /* a protected file removed */
+    TAMPER_THAW,          /* the thaw signal to the protector */
+};
+
+#define SIGKILL 9
+#define SIGUSR2 12 /* lifts the freeze */
+#define SIGSTOP 19
+
+enum self_obj_kind
+{
+    SELF_OBJ_MAP = 0,
+    SELF_OBJ_PROG,
+    SELF_OBJ_LINK,
+};
+
+/* self-protection is in force while the protector runs */
+struct self
+{
+    u32 tgid;  /* the protector, 0 if it is not running */
+    u32 guard; /* 1 if SIGKILL, SIGSTOP and ptrace of the protector and owners are denied */
+};
+
+struct self_obj_key
+{
+    u32 kind; /* enum self_obj_kind */
+    u32 id;
+};
+
+const struct self *unused_self __attribute__((unused));
+const struct self_obj_key *unused_self_obj_key __attribute__((unused));
+
+struct
+{
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, u32);
+    __type(value, struct self);
+} self_map SEC(".maps");
+
+/* IDs of maps, programs and links of the protector */
+struct
+{
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_SELF_OBJS);
+    __type(key, struct self_obj_key);
+    __type(value, u8);
+} self_obj_map SEC(".maps");
+
+/* is_tamperer is true for anybody but the running protector */
+static __always_inline bool is_tamperer()
+{
+    u32 key = 0;
+    struct self *s = bpf_map_lookup_elem(&self_map, &key);
+    return s && s->tgid != 0 && s->tgid != bpf_get_current_pid_tgid() >> 32;
+}
+
+static __always_inline bool is_self_obj(u32 kind, u32 id)
+{
+    struct self_obj_key key = {.kind = kind, .id = id};
+    return bpf_map_lookup_elem(&self_obj_map, &key) != NULL;
+}
+
+/* report_tamper reports the attempt, tampering is denied regardless of the mode */
+static __always_inline int report_tamper(u8 op, struct tbl_key *key, u32 target_pid)
+{
+    u8 comm[TASK_COMM_LEN];
+
+    if (bpf_get_current_comm(&comm, TASK_COMM_LEN) == 0)
+    {
+        send_event(bpf_get_current_pid_tgid() >> 32, comm, EVENT_REASON_TAMPER, VERDICT_DENY, op, key, 0,
+                   target_pid);
+    }
+    return -EPERM;
+}
+
+static __always_inline int tamper_deny(u8 op, u32 target_pid)
+{
+    struct tbl_key key = {};
+    return report_tamper(op, &key, target_pid);
+}
+
+/* file_deny reports the name of the file in the table of the event */
+static __always_inline int file_deny(u8 op, struct dentry *dentry)
+{
+    struct tbl_key key = {};
+    bpf_probe_read_kernel_str(key.name, MAX_TBL_NAME, BPF_CORE_READ(dentry, d_name.name));
+    return report_tamper(op, &key, 0);
+}
+
+/* is_guarded is true for the running protector and owner PIDs */
+static __always_inline bool is_guarded(u32 gen, u32 tgid)
+{
+    u32 key = 0;
+    struct self *s = bpf_map_lookup_elem(&self_map, &key);
+    return (s && s->tgid != 0 && s->tgid == tgid) || is_allowed_pid(gen, tgid);
+}
+
+/* may_guard is true for the protector, owners and the service manager, which may stop the protector with SIGKILL */
+static __always_inline bool may_guard(u32 gen)
+{
+    u32 key = 0;
+    u32 tgid = bpf_get_current_pid_tgid() >> 32;
+    struct self *s = bpf_map_lookup_elem(&self_map, &key);
+    return tgid == 1 || (s && s->tgid == tgid) || is_owner(gen, tgid);
+}
+
+/* thaw_check_kill denies the thaw signal aimed at the protector unless it is sent by those who may guard
+ * or by break-glass owners, so the freeze can't be lifted by the one it stops
+ */
+static __always_inline int thaw_check_kill(u32 target)
+{
+    u32 key = 0;
+    struct self *s = bpf_map_lookup_elem(&self_map, &key);
+    if (!s || s->tgid == 0 || s->tgid != target)
+    {
+        return 0;
+    }
+    u32 gen = get_policy_gen();
+    if (may_guard(gen) || is_break_glass(gen))
+    {
+        return 0;
+    }
+    return tamper_deny(TAMPER_THAW, target);
+}
+
+/* guard_check_kill denies SIGKILL and SIGSTOP aimed at guarded processes if the guard is on and the thaw signal,
+ * signals sent by the kernel don't get here
+ */
+static __always_inline int guard_check_kill(struct task_struct *p, int sig)
+{
+    u32 key = 0;
+    u32 target = BPF_CORE_READ(p, tgid);
+    if (sig == SIGUSR2)
+    {
+        return thaw_check_kill(target);
+    }
+    if (sig != SIGKILL && sig != SIGSTOP)
+    {
+        return 0;
+    }
+    struct self *s = bpf_map_lookup_elem(&self_map, &key);
+    if (!s || !s->guard)
+    {
+        return 0;
+    }
+    u32 gen = get_policy_gen();
+    if (!is_guarded(gen, target) || may_guard(gen))
+    {
+        return 0;
+    }
+    return tamper_deny(sig == SIGKILL ? TAMPER_KILL : TAMPER_STOP, target);
+}
+
+static __always_inline int guard_check_ptrace(struct task_struct *child)
+{
+    u32 gen = get_policy_gen();
+    u32 target = BPF_CORE_READ(child, tgid);
+    if (!is_guarded(gen, target) || may_guard(gen))
+    {
+        return 0;
+    }
+    return tamper_deny(TAMPER_PTRACE, target);
+}
+
+/* is_protected_file is true for files in protected_file_map, the inode may be NULL, e.g. of a new dentry */
+static __always_inline bool is_protected_file(u32 gen, struct inode *inode)
+{
+    struct exe_key key = {};
+    if (!inode)
+    {
+        return false;
+    }
+    get_inode_key(inode, &key);
+    return lookup_policy(&protected_file_map, gen, &key) != NULL;
+}
+
+/* is_protected_entry is true for protected files and for entries of protected directories */
+static __always_inline bool is_protected_entry(u32 gen, struct inode *dir, struct dentry *dentry)
+{
+    return is_protected_file(gen, dir) || is_protected_file(gen, BPF_CORE_READ(dentry, d_inode));
+}
+
+/* file_check_open denies to open protected files for writing, reading is allowed */
+static __always_inline int file_check_open(struct file *file)
+{
+    if (!(BPF_CORE_READ(file, f_mode) & FMODE_WRITE) || !is_tamperer())
+    {
+        return 0;
+    }
+    u32 gen = get_policy_gen();
+    struct dentry *dentry = BPF_CORE_READ(file, f_path.dentry);
+    if (!is_protected_entry(gen, BPF_CORE_READ(dentry, d_parent, d_inode), dentry) || is_updater(gen))
+    {
+        return 0;
+    }
+    return file_deny(TAMPER_FILE_WRITE, dentry);
+}
+
+/* file_check_rename denies to move protected files and to replace them by another file */
+static __always_inline int file_check_rename(struct inode *old_dir, struct dentry *old_dentry, struct inode *new_dir,
+                                             struct dentry *new_dentry)
+{
+    if (!is_tamperer())
+    {
+        return 0;
+    }
+    u32 gen = get_policy_gen();
+    struct dentry *hit = NULL;
+    if (is_protected_entry(gen, old_dir, old_dentry))
+    {
+        hit = old_dentry;
+    }
+    else if (is_protected_entry(gen, new_dir, new_dentry))
+    {
+        hit = new_dentry;
+    }
+    if (!hit || is_updater(gen))
+    {
+        return 0;
+    }
+    return file_deny(TAMPER_FILE_RENAME, hit);
+}
+
+static __always_inline int file_check_unlink(struct inode *dir, struct dentry *dentry)
+{
+    if (!is_tamperer())
+    {
+        return 0;
+    }
+    u32 gen = get_policy_gen();
+    if (!is_protected_entry(gen, dir, dentry) || is_updater(gen))
+    {
+        return 0;
+    }
+    return file_deny(TAMPER_FILE_UNLINK, dentry);
+}
+
+/* self_check_map denies writable fds of our maps, so they can't be updated, reading is allowed */
+static __always_inline int self_check_map(struct bpf_map *map, fmode_t fmode)
+{
+    if (!(fmode & FMODE_WRITE) || !is_tamperer() || !is_self_obj(SELF_OBJ_MAP, BPF_CORE_READ(map, id)))
+    {
+        return 0;
+    }
+    return tamper_deny(TAMPER_MAP_WRITE, 0);
+}
+
+static __always_inline int self_check_prog(struct bpf_prog *prog)
+{
+    if (!is_tamperer() || !is_self_obj(SELF_OBJ_PROG, BPF_CORE_READ(prog, aux, id)))
+    {
+        return 0;
+    }
+    return tamper_deny(TAMPER_PROG_OPEN, 0);
+}
+
+extern const struct file_operations bpf_link_fops __ksym;
+
+/* fd_link_id is the ID of the link behind the fd of the current process, 0 if there is no such fd or it is
+ * not a link. Links with poll have other file operations, none of them is ours.
+ */
+static __always_inline u32 fd_link_id(u32 fd)
+{
+    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+    struct fdtable *fdt = BPF_CORE_READ(task, files, fdt);
+    struct file **fds;
+    struct file *file = NULL;
+
+    if (!fdt || fd >= BPF_CORE_READ(fdt, max_fds))
+    {
+        return 0;
+    }
+    fds = BPF_CORE_READ(fdt, fd);
+    if (bpf_probe_read_kernel(&file, sizeof(file), &fds[fd]) != 0 || !file)
+    {
+        return 0;
+    }
+    if (BPF_CORE_READ(file, f_op) != &bpf_link_fops)
+    {
+        return 0; /* private_data is not a bpf_link */
+    }
+    struct bpf_link *lnk = BPF_CORE_READ(file, private_data);
+    return lnk ? BPF_CORE_READ(lnk, id) : 0;
+}
+
+/* self_check_cmd guards our links, which have no hook of their own, by their IDs. Getting an fd by ID is denied,
+ * the fd of a pinned link may be got, but the link can't be detached or updated by it.
+ * Pins themselves are guarded as entries of PinPath, which is a protected file.
+ */
+static __always_inline int self_check_cmd(int cmd, union bpf_attr *attr)
+{
+    u32 id;
+
+    if (cmd != BPF_LINK_GET_FD_BY_ID && cmd != BPF_LINK_DETACH && cmd != BPF_LINK_UPDATE)
+    {
+        return 0;
+    }
+    if (!is_tamperer())
+    {
+        return 0;
+    }
+    if (cmd == BPF_LINK_GET_FD_BY_ID)
+    {
+        return is_self_obj(SELF_OBJ_LINK, BPF_CORE_READ(attr, link_id)) ? tamper_deny(TAMPER_LINK_OPEN, 0) : 0;
+    }
+    id = fd_link_id(cmd == BPF_LINK_DETACH ? BPF_CORE_READ(attr, link_detach.link_fd)
+                                           : BPF_CORE_READ(attr, link_update.link_fd));
+    return id != 0 && is_self_obj(SELF_OBJ_LINK, id) ? tamper_deny(TAMPER_LINK_CHANGE, 0) : 0;
+}
+
+#endif
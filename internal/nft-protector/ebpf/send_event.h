@@ -1,12 +1,35 @@
 #ifndef __SEND_EVENT_H__
 #define __SEND_EVENT_H__
 
+#include "input_params.h"
+
 #define TASK_COMM_LEN 32
 
+enum event_reason
+{
+    EVENT_REASON_PROTECTED_TBL = 0, /* the message changes a protected table */
+    EVENT_REASON_WALK_INCOMPLETE,   /* the batch could not be checked to the end */
+    EVENT_REASON_RULE,              /* the message matches a deny or audit policy rule */
+    EVENT_REASON_TAMPER,            /* an attempt to tamper with the protector, msg_type is enum tamper_op */
+    EVENT_REASON_FREEZE,            /* the message changes nf_tables while the freeze is engaged */
+    EVENT_REASON_LONG_NAME,         /* the table name is longer than MAX_TBL_NAME - 1, so it can't be checked */
+};
+
 struct event
 {
     u32 pid;
     u8 comm[TASK_COMM_LEN];
+    u8 family;
+    u8 msg_type;
+    u8 reason;
+    u8 verdict;
+    u8 table[MAX_TBL_NAME];
+    u32 uid;
+    u32 exe_dev;
+    u64 cgroup_id;
+    u64 exe_ino;
+    u16 rule_id;    /* policy rule the message matches, 0 if none */
+    u32 target_pid; /* process the tamper attempt is aimed at, 0 if none */
 };
 
 const struct event *unused __attribute__((unused));
@@ -17,7 +40,8 @@ struct
     __uint(max_entries, 1 << 24);
 } events SEC(".maps");
 
-static __always_inline int send_event(u32 pid, u8 *comm)
+static __always_inline int send_event(u32 pid, u8 *comm, u8 reason, u8 verdict, u8 msg_type, struct tbl_key *tbl,
+                                      u16 rule_id, u32 target_pid)
 {
     struct event *event;
     event = bpf_ringbuf_reserve(&events, sizeof(struct event), 0);
@@ -25,6 +49,22 @@ static __always_inline int send_event(u32 pid, u8 *comm)
         return -1;
 
     event->pid = pid;
+    event->family = tbl->family;
+    event->msg_type = msg_type;
+    event->reason = reason;
+    event->verdict = verdict;
+    event->rule_id = rule_id;
+    event->target_pid = target_pid;
+    __builtin_memcpy(event->table, tbl->name, MAX_TBL_NAME);
+
+    /* identity of the process to learn owners from */
+    struct exe_key exe = {};
+    get_task_exe((struct task_struct *)bpf_get_current_task(), &exe);
+    event->uid = (u32)bpf_get_current_uid_gid();
+    event->exe_dev = exe.dev;
+    event->exe_ino = exe.ino;
+    event->cgroup_id = bpf_get_current_cgroup_id();
+
     if (bpf_probe_read_kernel(event->comm, TASK_COMM_LEN, comm) == 0)
     {
         bpf_ringbuf_submit(event, 0);
@@ -0,0 +1,29 @@
+package nft_protector
+
+import (
+	"math/bits"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EventsOptions tune the ring buffer events are read from
+type EventsOptions struct {
+	// RingbufSize is the size of the ring buffer in bytes, zero keeps the size the program is built with
+	RingbufSize uint32
+	// ReadTimeout is how long reading blocks before the protector checks whether it is stopped
+	ReadTimeout time.Duration
+}
+
+// Validate checks the ring buffer size is a power of 2 multiple of the page size
+func (o EventsOptions) Validate() error {
+	if o.RingbufSize != 0 && (bits.OnesCount32(o.RingbufSize) != 1 || o.RingbufSize%uint32(os.Getpagesize()) != 0) {
+		return errors.Errorf("ring buffer size %d is not a power of 2 multiple of the page size %d",
+			o.RingbufSize, os.Getpagesize())
+	}
+	if o.ReadTimeout <= 0 {
+		return errors.Errorf("read timeout must be positive but it is %s", o.ReadTimeout)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package nft_protector
+
+import (
+	"context"
+
+	kernelinfo "github.com/Morwran/nft-protect/internal/kernel-info"
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/pkg/errors"
+)
+
+var _ Protector = (*fmodRetProtector)(nil)
+
+type (
+	// fmodRetProtector denies changes of protected tables on kernels without BPF LSM.
+	// It modifies the return value of security_netlink_send: the kernel allows fmod_ret
+	// on security_* functions, but not on nfnetlink_rcv_batch which is not error injectable.
+	fmodRetProtector struct {
+		*bpfProtector
+	}
+)
+
+func NewFmodRetProtector(opts Options, owners model.Owners, protectedTbls ...TableKey) (*fmodRetProtector, error) {
+	err := ensureKernelSupport(kernelinfo.KernelVersion{Major: 5, Minor: 8, Patch: 0})
+	if err != nil {
+		return nil, err
+	}
+	if err = kernelinfo.CheckSecurityKernelSupport(); err != nil {
+		return nil, errors.WithMessage(err, "failed to check security kernel support")
+	}
+	p, err := newBpfProtector("fmod_ret_netlink_send",
+		newCapabilities("fmodret", true, "kernel>=5.8", "CONFIG_SECURITY", "fmod_ret"), opts, owners, protectedTbls)
+	if err != nil {
+		return nil, err
+	}
+	return &fmodRetProtector{bpfProtector: p}, nil
+}
+
+func (p *fmodRetProtector) Run(ctx context.Context) error {
+	return p.run(ctx, "fmodret-protector", func(prog *ebpf.Program) (link.Link, error) {
+		lnk, err := link.AttachTracing(link.TracingOptions{Program: prog})
+		return lnk, errors.WithMessage(err, "failed to attach fmod_ret program")
+	})
+}
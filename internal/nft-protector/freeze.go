@@ -0,0 +1,94 @@
+package nft_protector
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// FreezeSignal and ThawSignal toggle the freeze of the running daemon
+const (
+	FreezeSignal = syscall.SIGUSR1
+	ThawSignal   = syscall.SIGUSR2
+)
+
+// Freeze denies every change of nf_tables by everybody but break-glass owners regardless of the mode
+// until Thaw or, if d is positive, for d. The freeze outlives the daemon only if pinning is on.
+func (p *bpfProtector) Freeze(d time.Duration) error {
+	f := bpfFreeze{Engaged: 1}
+	if d > 0 {
+		now, err := monotonicNow()
+		if err != nil {
+			return err
+		}
+		f.Until = uint64(now + d)
+	}
+	return errors.WithMessage(p.maps.FreezeMap.Put(uint32(0), f), "failed to engage the freeze")
+}
+
+// Thaw lifts the freeze
+func (p *bpfProtector) Thaw() error {
+	return errors.WithMessage(p.maps.FreezeMap.Put(uint32(0), bpfFreeze{}), "failed to lift the freeze")
+}
+
+// frozen tells if the freeze is in force, e.g. the one left by the previous instance,
+// and for how long, zero is until Thaw
+func (p *bpfProtector) frozen() (left time.Duration, ok bool) {
+	var f bpfFreeze
+	if err := p.maps.FreezeMap.Lookup(uint32(0), &f); err != nil || f.Engaged == 0 {
+		return 0, false
+	}
+	now, err := monotonicNow()
+	if f.Until == 0 || err != nil {
+		return 0, true
+	}
+	if uint64(now) >= f.Until {
+		return 0, false
+	}
+	return time.Duration(f.Until - uint64(now)), true
+}
+
+// monotonicNow is the time in the form bpf_ktime_get_ns() returns
+func monotonicNow() (time.Duration, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, errors.WithMessage(err, "failed to get monotonic time")
+	}
+	return time.Duration(ts.Nano()), nil
+}
+
+// SignalDaemon sends the signal to the running daemon, which is found by the self-protection map
+// pinned under PinPath, so it works only with pinning and backends with self-protection. ThawSignal
+// is denied to all but the service manager, owners and break-glass owners.
+func SignalDaemon(sig syscall.Signal) (pid uint32, err error) {
+	m, err := ebpf.LoadPinnedMap(filepath.Join(PinPath, "self_map"), &ebpf.LoadPinOptions{ReadOnly: true})
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, errors.Errorf("the daemon can't be found without '%s/self_map', it is pinned by the daemon "+
+			"with -pin and -type lsm or fmodret; send %s to the daemon instead", PinPath, unix.SignalName(sig))
+	}
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to load the pinned self map")
+	}
+	defer m.Close()
+	var s bpfSelf
+	if err = m.Lookup(uint32(0), &s); err != nil {
+		return 0, errors.WithMessage(err, "failed to get the daemon")
+	}
+	if s.Tgid == 0 {
+		return 0, errors.New("the daemon is not running")
+	}
+	err = unix.Kill(int(s.Tgid), sig)
+	if errors.Is(err, unix.EPERM) && sig == ThawSignal {
+		return s.Tgid, errors.Errorf("the daemon %d accepts %s only from the service manager, owners and break-glass "+
+			"owners, e.g. 'systemctl kill -s %[2]s <unit>'", s.Tgid, unix.SignalName(sig))
+	}
+	if err != nil {
+		return s.Tgid, errors.WithMessagef(err, "failed to send %s to the daemon %d", unix.SignalName(sig), s.Tgid)
+	}
+	return s.Tgid, nil
+}
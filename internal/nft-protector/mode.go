@@ -0,0 +1,65 @@
+package nft_protector
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Mode tells whether changes of protected tables are denied or only reported (enum mode)
+type Mode uint8
+
+const (
+	ModeEnforce Mode = iota
+	// ModeAudit reports changes which would be denied but lets them through
+	ModeAudit
+)
+
+// Verdict is what the protector did or would do with the change of protected table (enum verdict)
+type Verdict uint8
+
+const (
+	VerdictDeny Verdict = iota
+	// VerdictAudit the change is let through but would be denied in enforce mode
+	VerdictAudit
+)
+
+// table flags (TBL_F_xxx)
+const (
+	tblFlagProtected uint8 = 1 << 0
+	tblFlagAudit     uint8 = 1 << 1
+)
+
+var modeNames = map[Mode]string{
+	ModeEnforce: "enforce",
+	ModeAudit:   "audit",
+}
+
+// ParseMode parses 'enforce' or 'audit'
+func ParseMode(s string) (Mode, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for m, name := range modeNames {
+		if name == s {
+			return m, nil
+		}
+	}
+	return ModeEnforce, errors.Errorf("unknown mode '%s'", s)
+}
+
+func (m Mode) String() string {
+	if name, ok := modeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("mode(%d)", uint8(m))
+}
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictDeny:
+		return "deny"
+	case VerdictAudit:
+		return "audit"
+	}
+	return fmt.Sprintf("verdict(%d)", uint8(v))
+}
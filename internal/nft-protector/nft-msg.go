@@ -0,0 +1,251 @@
+package nft_protector
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/pkg/errors"
+)
+
+// NftMsgType is nf_tables netlink message type (enum nf_tables_msg_types)
+type NftMsgType uint8
+
+const (
+	NftMsgNewTable NftMsgType = iota
+	NftMsgGetTable
+	NftMsgDelTable
+	NftMsgNewChain
+	NftMsgGetChain
+	NftMsgDelChain
+	NftMsgNewRule
+	NftMsgGetRule
+	NftMsgDelRule
+	NftMsgNewSet
+	NftMsgGetSet
+	NftMsgDelSet
+	NftMsgNewSetElem
+	NftMsgGetSetElem
+	NftMsgDelSetElem
+	NftMsgNewGen
+	NftMsgGetGen
+	NftMsgTrace
+	NftMsgNewObj
+	NftMsgGetObj
+	NftMsgDelObj
+	NftMsgGetObjReset
+	NftMsgNewFlowtable
+	NftMsgGetFlowtable
+	NftMsgDelFlowtable
+	NftMsgGetRuleReset
+	NftMsgDestroyTable
+	NftMsgDestroyChain
+	NftMsgDestroyRule
+	NftMsgDestroySet
+	NftMsgDestroySetElem
+	NftMsgDestroyObj
+	NftMsgDestroyFlowtable
+	NftMsgGetSetElemReset
+	NftMsgMax
+)
+
+// maxNftMsg is the size of the nft_msg_map (MAX_NFT_MSG)
+const maxNftMsg = 64
+
+// attributes which carry the table name (enum nft_xxx_attributes)
+const (
+	nftaTableName        uint16 = 1 // NFTA_TABLE_NAME
+	nftaChainTable       uint16 = 1 // NFTA_CHAIN_TABLE
+	nftaRuleTable        uint16 = 1 // NFTA_RULE_TABLE
+	nftaSetTable         uint16 = 1 // NFTA_SET_TABLE
+	nftaSetElemListTable uint16 = 1 // NFTA_SET_ELEM_LIST_TABLE
+	nftaObjTable         uint16 = 1 // NFTA_OBJ_TABLE
+	nftaFlowtableTable   uint16 = 1 // NFTA_FLOWTABLE_TABLE
+
+	nftaTableHandle uint16 = 4 // NFTA_TABLE_HANDLE
+
+	nftaChainName      uint16 = 3 // NFTA_CHAIN_NAME
+	nftaRuleChain      uint16 = 2 // NFTA_RULE_CHAIN
+	nftaSetName        uint16 = 2 // NFTA_SET_NAME
+	nftaSetElemListSet uint16 = 2 // NFTA_SET_ELEM_LIST_SET
+	nftaObjName        uint16 = 2 // NFTA_OBJ_NAME
+	nftaFlowtableName  uint16 = 2 // NFTA_FLOWTABLE_NAME
+)
+
+// objKind is the kind of the object inside the table the message changes (enum obj_kind)
+type objKind uint8
+
+const (
+	objNone objKind = iota
+	objChain
+	objSet
+	objObj
+	objFlowtable
+)
+
+// nftObjRef is the attribute with the name of the object the message changes
+type nftObjRef struct {
+	attr uint16
+	kind objKind
+}
+
+// nftMsgFlush is NFT_MSG_F_FLUSH
+const nftMsgFlush uint8 = 1 << 0
+
+var nftMsgNames = [...]string{
+	NftMsgNewTable:         "NEWTABLE",
+	NftMsgGetTable:         "GETTABLE",
+	NftMsgDelTable:         "DELTABLE",
+	NftMsgNewChain:         "NEWCHAIN",
+	NftMsgGetChain:         "GETCHAIN",
+	NftMsgDelChain:         "DELCHAIN",
+	NftMsgNewRule:          "NEWRULE",
+	NftMsgGetRule:          "GETRULE",
+	NftMsgDelRule:          "DELRULE",
+	NftMsgNewSet:           "NEWSET",
+	NftMsgGetSet:           "GETSET",
+	NftMsgDelSet:           "DELSET",
+	NftMsgNewSetElem:       "NEWSETELEM",
+	NftMsgGetSetElem:       "GETSETELEM",
+	NftMsgDelSetElem:       "DELSETELEM",
+	NftMsgNewGen:           "NEWGEN",
+	NftMsgGetGen:           "GETGEN",
+	NftMsgTrace:            "TRACE",
+	NftMsgNewObj:           "NEWOBJ",
+	NftMsgGetObj:           "GETOBJ",
+	NftMsgDelObj:           "DELOBJ",
+	NftMsgGetObjReset:      "GETOBJ_RESET",
+	NftMsgNewFlowtable:     "NEWFLOWTABLE",
+	NftMsgGetFlowtable:     "GETFLOWTABLE",
+	NftMsgDelFlowtable:     "DELFLOWTABLE",
+	NftMsgGetRuleReset:     "GETRULE_RESET",
+	NftMsgDestroyTable:     "DESTROYTABLE",
+	NftMsgDestroyChain:     "DESTROYCHAIN",
+	NftMsgDestroyRule:      "DESTROYRULE",
+	NftMsgDestroySet:       "DESTROYSET",
+	NftMsgDestroySetElem:   "DESTROYSETELEM",
+	NftMsgDestroyObj:       "DESTROYOBJ",
+	NftMsgDestroyFlowtable: "DESTROYFLOWTABLE",
+	NftMsgGetSetElemReset:  "GETSETELEM_RESET",
+}
+
+// nftMsgTableAttr maps every state changing nf_tables message to the attribute
+// which carries the table name. Messages not listed here are let through.
+// The *_RESET messages are listed as they reset counters and quotas.
+var nftMsgTableAttr = map[NftMsgType]uint16{
+	NftMsgNewTable:         nftaTableName,
+	NftMsgDelTable:         nftaTableName,
+	NftMsgDestroyTable:     nftaTableName,
+	NftMsgNewChain:         nftaChainTable,
+	NftMsgDelChain:         nftaChainTable,
+	NftMsgDestroyChain:     nftaChainTable,
+	NftMsgNewRule:          nftaRuleTable,
+	NftMsgDelRule:          nftaRuleTable,
+	NftMsgDestroyRule:      nftaRuleTable,
+	NftMsgGetRuleReset:     nftaRuleTable,
+	NftMsgNewSet:           nftaSetTable,
+	NftMsgDelSet:           nftaSetTable,
+	NftMsgDestroySet:       nftaSetTable,
+	NftMsgNewSetElem:       nftaSetElemListTable,
+	NftMsgDelSetElem:       nftaSetElemListTable,
+	NftMsgDestroySetElem:   nftaSetElemListTable,
+	NftMsgGetSetElemReset:  nftaSetElemListTable,
+	NftMsgNewObj:           nftaObjTable,
+	NftMsgDelObj:           nftaObjTable,
+	NftMsgDestroyObj:       nftaObjTable,
+	NftMsgGetObjReset:      nftaObjTable,
+	NftMsgNewFlowtable:     nftaFlowtableTable,
+	NftMsgDelFlowtable:     nftaFlowtableTable,
+	NftMsgDestroyFlowtable: nftaFlowtableTable,
+}
+
+// nftMsgTableHandleAttr maps messages which may refer to the table by handle instead of name
+var nftMsgTableHandleAttr = map[NftMsgType]uint16{
+	NftMsgDelTable:     nftaTableHandle,
+	NftMsgDestroyTable: nftaTableHandle,
+}
+
+// nftMsgObjAttr maps messages which change an object inside the table to the attribute with its name,
+// rules are objects of the chain
+var nftMsgObjAttr = map[NftMsgType]nftObjRef{
+	NftMsgNewChain:         {nftaChainName, objChain},
+	NftMsgDelChain:         {nftaChainName, objChain},
+	NftMsgDestroyChain:     {nftaChainName, objChain},
+	NftMsgNewRule:          {nftaRuleChain, objChain},
+	NftMsgDelRule:          {nftaRuleChain, objChain},
+	NftMsgDestroyRule:      {nftaRuleChain, objChain},
+	NftMsgGetRuleReset:     {nftaRuleChain, objChain},
+	NftMsgNewSet:           {nftaSetName, objSet},
+	NftMsgDelSet:           {nftaSetName, objSet},
+	NftMsgDestroySet:       {nftaSetName, objSet},
+	NftMsgNewSetElem:       {nftaSetElemListSet, objSet},
+	NftMsgDelSetElem:       {nftaSetElemListSet, objSet},
+	NftMsgDestroySetElem:   {nftaSetElemListSet, objSet},
+	NftMsgGetSetElemReset:  {nftaSetElemListSet, objSet},
+	NftMsgNewObj:           {nftaObjName, objObj},
+	NftMsgDelObj:           {nftaObjName, objObj},
+	NftMsgDestroyObj:       {nftaObjName, objObj},
+	NftMsgGetObjReset:      {nftaObjName, objObj},
+	NftMsgNewFlowtable:     {nftaFlowtableName, objFlowtable},
+	NftMsgDelFlowtable:     {nftaFlowtableName, objFlowtable},
+	NftMsgDestroyFlowtable: {nftaFlowtableName, objFlowtable},
+}
+
+// nftMsgFlushes are messages which affect all tables of the family when they have no table reference,
+// e.g. 'nft flush ruleset', and the named table of every family when the family is NFPROTO_UNSPEC
+var nftMsgFlushes = map[NftMsgType]bool{
+	NftMsgDelTable:     true,
+	NftMsgDestroyTable: true,
+}
+
+// ParseNftMsgType parses message name e.g. 'NEWSETELEM' or 'newsetelem'
+func ParseNftMsgType(s string) (NftMsgType, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	for t, name := range nftMsgNames {
+		if name == s {
+			return NftMsgType(t), nil
+		}
+	}
+	return 0, errors.Errorf("unknown nftables message '%s'", s)
+}
+
+func (t NftMsgType) String() string {
+	if int(t) < len(nftMsgNames) {
+		return nftMsgNames[t]
+	}
+	return fmt.Sprintf("NFT_MSG(%d)", uint8(t))
+}
+
+// IsStateChanging checks if the message changes nf_tables state
+func (t NftMsgType) IsStateChanging() bool {
+	_, ok := nftMsgTableAttr[t]
+	return ok
+}
+
+// StateChangingNftMsgs returns all state changing messages sorted by type
+func StateChangingNftMsgs() (ret []NftMsgType) {
+	for t := NftMsgType(0); t < NftMsgMax; t++ {
+		if t.IsStateChanging() {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+func putNftMsgDescs(m *ebpf.Map) error {
+	for t := NftMsgType(0); t < maxNftMsg; t++ {
+		desc := bpfNftMsgDesc{
+			TblAttr:    nftMsgTableAttr[t],
+			HandleAttr: nftMsgTableHandleAttr[t],
+			ObjAttr:    nftMsgObjAttr[t].attr,
+			ObjKind:    uint8(nftMsgObjAttr[t].kind),
+		}
+		if nftMsgFlushes[t] {
+			desc.Flags |= nftMsgFlush
+		}
+		if err := m.Put(uint32(t), desc); err != nil {
+			return errors.WithMessagef(err, "failed to setup nftables message %s", t)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package nft_protector
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NftMsgTypeValues(t *testing.T) {
+	// values from include/uapi/linux/netfilter/nf_tables.h
+	testCases := []struct {
+		msg  NftMsgType
+		want uint8
+	}{
+		{NftMsgNewTable, 0},
+		{NftMsgDelTable, 2},
+		{NftMsgNewSetElem, 12},
+		{NftMsgNewGen, 15},
+		{NftMsgNewObj, 18},
+		{NftMsgGetObjReset, 21},
+		{NftMsgNewFlowtable, 22},
+		{NftMsgDelFlowtable, 24},
+		{NftMsgGetRuleReset, 25},
+		{NftMsgDestroyTable, 26},
+		{NftMsgDestroyFlowtable, 32},
+		{NftMsgGetSetElemReset, 33},
+		{NftMsgMax, 34},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.want, uint8(tc.msg), tc.msg.String())
+	}
+	require.Len(t, nftMsgNames, int(NftMsgMax))
+	require.Less(t, int(NftMsgMax), maxNftMsg)
+}
+
+func Test_NftMsgTableAttr(t *testing.T) {
+	testCases := []struct {
+		msg      NftMsgType
+		tblAttr  uint16
+		changing bool
+	}{
+		{msg: NftMsgNewTable, tblAttr: nftaTableName, changing: true},
+		{msg: NftMsgGetTable},
+		{msg: NftMsgDelTable, tblAttr: nftaTableName, changing: true},
+		{msg: NftMsgNewChain, tblAttr: nftaChainTable, changing: true},
+		{msg: NftMsgGetChain},
+		{msg: NftMsgDelChain, tblAttr: nftaChainTable, changing: true},
+		{msg: NftMsgNewRule, tblAttr: nftaRuleTable, changing: true},
+		{msg: NftMsgGetRule},
+		{msg: NftMsgDelRule, tblAttr: nftaRuleTable, changing: true},
+		{msg: NftMsgNewSet, tblAttr: nftaSetTable, changing: true},
+		{msg: NftMsgGetSet},
+		{msg: NftMsgDelSet, tblAttr: nftaSetTable, changing: true},
+		{msg: NftMsgNewSetElem, tblAttr: nftaSetElemListTable, changing: true},
+		{msg: NftMsgGetSetElem},
+		{msg: NftMsgDelSetElem, tblAttr: nftaSetElemListTable, changing: true},
+		{msg: NftMsgNewGen},
+		{msg: NftMsgGetGen},
+		{msg: NftMsgTrace},
+		{msg: NftMsgNewObj, tblAttr: nftaObjTable, changing: true},
+		{msg: NftMsgGetObj},
+		{msg: NftMsgDelObj, tblAttr: nftaObjTable, changing: true},
+		{msg: NftMsgGetObjReset, tblAttr: nftaObjTable, changing: true},
+		{msg: NftMsgNewFlowtable, tblAttr: nftaFlowtableTable, changing: true},
+		{msg: NftMsgGetFlowtable},
+		{msg: NftMsgDelFlowtable, tblAttr: nftaFlowtableTable, changing: true},
+		{msg: NftMsgGetRuleReset, tblAttr: nftaRuleTable, changing: true},
+		{msg: NftMsgDestroyTable, tblAttr: nftaTableName, changing: true},
+		{msg: NftMsgDestroyChain, tblAttr: nftaChainTable, changing: true},
+		{msg: NftMsgDestroyRule, tblAttr: nftaRuleTable, changing: true},
+		{msg: NftMsgDestroySet, tblAttr: nftaSetTable, changing: true},
+		{msg: NftMsgDestroySetElem, tblAttr: nftaSetElemListTable, changing: true},
+		{msg: NftMsgDestroyObj, tblAttr: nftaObjTable, changing: true},
+		{msg: NftMsgDestroyFlowtable, tblAttr: nftaFlowtableTable, changing: true},
+		{msg: NftMsgGetSetElemReset, tblAttr: nftaSetElemListTable, changing: true},
+	}
+	require.Len(t, testCases, int(NftMsgMax), "every message type has to be classified")
+	for i, tc := range testCases {
+		require.Equal(t, NftMsgType(i), tc.msg)
+		require.Equal(t, tc.changing, tc.msg.IsStateChanging(), tc.msg.String())
+		require.Equal(t, tc.tblAttr, nftMsgTableAttr[tc.msg], tc.msg.String())
+		if tc.changing {
+			require.NotZero(t, nftMsgTableAttr[tc.msg], tc.msg.String())
+		}
+	}
+	for _, msg := range StateChangingNftMsgs() {
+		name := msg.String()
+		require.True(t,
+			strings.HasPrefix(name, "NEW") ||
+				strings.HasPrefix(name, "DEL") ||
+				strings.HasPrefix(name, "DESTROY") ||
+				strings.HasSuffix(name, "_RESET"), name)
+	}
+	require.False(t, NftMsgType(maxNftMsg-1).IsStateChanging())
+}
+
+func Test_NftMsgTableRefs(t *testing.T) {
+	for _, msg := range []NftMsgType{NftMsgDelTable, NftMsgDestroyTable} {
+		require.Equal(t, nftaTableHandle, nftMsgTableHandleAttr[msg], msg.String())
+		require.True(t, nftMsgFlushes[msg], msg.String())
+	}
+	require.Len(t, nftMsgTableHandleAttr, 2)
+	require.Len(t, nftMsgFlushes, 2)
+	for msg := range nftMsgTableHandleAttr {
+		require.True(t, msg.IsStateChanging(), msg.String())
+	}
+	for _, msg := range StateChangingNftMsgs() {
+		_, hasObj := nftMsgObjAttr[msg]
+		isTable := msg == NftMsgNewTable || msg == NftMsgDelTable || msg == NftMsgDestroyTable
+		require.Equal(t, !isTable, hasObj, msg.String())
+		if hasObj {
+			require.NotEqual(t, nftMsgTableAttr[msg], nftMsgObjAttr[msg].attr, msg.String())
+		}
+	}
+	for msg := range nftMsgObjAttr {
+		require.True(t, msg.IsStateChanging(), msg.String())
+		got, err := ParseNftMsgType(strings.ToLower(msg.String()))
+		require.NoError(t, err)
+		require.Equal(t, msg, got)
+	}
+}
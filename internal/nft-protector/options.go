@@ -0,0 +1,41 @@
+package nft_protector
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Options of the protector backends, they are fixed for the lifetime of the protector
+type Options struct {
+	Events EventsOptions
+	// Pin maps and the link under PinPath, so the last policy stays in force after the daemon exits.
+	// Only one protector may use the pinned objects at once. With self-protection the entries of PinPath
+	// are read-only for everybody but the protector and State.Updaters.
+	Pin bool
+	// Shutdown tells what protects tables after the daemon exits, ShutdownClosed needs Pin
+	Shutdown ShutdownPolicy
+	// Guard denies SIGKILL, SIGSTOP and ptrace aimed at the protector and owner PIDs.
+	// The protector, owners and PID 1, which is the service manager, may still kill them. SIGTERM is not denied.
+	// It works with self-protection only and is not pinned, so it is in force while the daemon runs.
+	Guard bool
+	// ProtectFiles makes State.Files read-only for everybody but the protector and State.Updaters.
+	// Like Guard it works with self-protection only and is in force while the daemon runs.
+	ProtectFiles bool
+}
+
+// DefaultOptions are options of the protector without pinning, guards and protection of files
+func DefaultOptions() Options {
+	return Options{Events: EventsOptions{ReadTimeout: 2 * time.Second}}
+}
+
+// Validate checks the options are consistent
+func (o Options) Validate() error {
+	if err := o.Events.Validate(); err != nil {
+		return err
+	}
+	if o.Shutdown == ShutdownClosed && !o.Pin {
+		return errors.New("fail-closed shutdown needs pinning")
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package nft_protector
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/cilium/ebpf/link"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// PinPath is the bpffs directory maps and the link of the protector are pinned under
+const PinPath = "/sys/fs/bpf/nft-protector"
+
+// acquirePinPath creates pinPath and takes its lock, which is held while the protector uses the pinned objects.
+// Pinned maps and the link keep protecting tables with the last loaded policy after the daemon exits,
+// the next instance reuses the maps and takes over the link.
+func acquirePinPath(pinPath string) (*os.File, error) {
+	if err := ensureBpfFs(filepath.Dir(pinPath)); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(pinPath, 0o700); err != nil {
+		return nil, errors.WithMessagef(err, "failed to create '%s'", pinPath)
+	}
+	f, locked, err := lockPinPath(pinPath)
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, errors.Errorf("another instance uses objects pinned under '%s'", pinPath)
+	}
+	return f, nil
+}
+
+func ensureBpfFs(path string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return errors.WithMessagef(err, "failed to stat '%s'", path)
+	}
+	if st.Type != unix.BPF_FS_MAGIC {
+		return errors.Errorf("'%s' is not a bpffs mount", path)
+	}
+	return nil
+}
+
+// lockPinPath takes the exclusive lock of pinPath, the file is nil if the directory doesn't exist
+func lockPinPath(pinPath string) (f *os.File, locked bool, err error) {
+	if f, err = os.Open(pinPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		_ = f.Close()
+		return nil, false, nil
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, false, errors.WithMessagef(err, "failed to lock '%s'", pinPath)
+	}
+	return f, true, nil
+}
+
+func pinnedLinkPath(pinPath string) string {
+	return filepath.Join(pinPath, "link")
+}
+
+// takeOver replaces the link of the previous instance pinned under pinPath by lnk. Both programs are attached
+// until the old link is released, so there is no moment when tables are not protected.
+// If pinning is off the objects pinned by the previous instance are removed.
+func takeOver(log logger.TypeOfLogger, lnk link.Link, pinPath string, pin bool) {
+	old, err := link.LoadPinnedLink(pinnedLinkPath(pinPath), nil)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		log.Warnf("failed to load the link pinned by the previous instance: %v", err)
+	default:
+		if err = old.Unpin(); err != nil {
+			log.Warnf("failed to unpin the link of the previous instance: %v", err)
+		}
+		_ = old.Close()
+		log.Info("the link of the previous instance is taken over")
+	}
+	if !pin {
+		if old != nil {
+			removePins(log, pinPath)
+		}
+		return
+	}
+	if err = lnk.Pin(pinnedLinkPath(pinPath)); err != nil {
+		log.Warnf("failed to pin the link, protection stops with the daemon: %v", err)
+	}
+}
+
+// removePins removes objects pinned by the previous instance unless another instance still uses them
+func removePins(log logger.TypeOfLogger, pinPath string) {
+	f, locked, err := lockPinPath(pinPath)
+	if err != nil || !locked {
+		log.Warnf("objects pinned under '%s' are in use, they are kept", pinPath)
+		return
+	}
+	defer f.Close()
+	if err = os.RemoveAll(pinPath); err != nil {
+		log.Warnf("failed to remove objects pinned under '%s': %v", pinPath, err)
+	}
+}
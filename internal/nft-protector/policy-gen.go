@@ -0,0 +1,198 @@
+package nft_protector
+
+import (
+	"slices"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/cilium/ebpf"
+	"github.com/pkg/errors"
+)
+
+// policyGens is the number of generations of the policy maps (POLICY_GENS)
+const policyGens = 2
+
+type (
+	// policyMaps is one generation of the maps the program decides by
+	policyMaps struct {
+		pids        *ebpf.Map
+		cgroups     *ebpf.Map
+		exes        *ebpf.Map
+		tblNames    *ebpf.Map
+		patterns    *ebpf.Map
+		families    *ebpf.Map
+		mode        *ebpf.Map
+		rules       *ebpf.Map
+		ruleCgroups *ebpf.Map
+		files       *ebpf.Map
+		updaters    *ebpf.Map
+		breakGlass  *ebpf.Map
+	}
+
+	// policyGenerations keeps two generations of the policy maps. The program reads only the active one,
+	// so the whole policy is written into the other one and then activated by a single update of policy_gen_map.
+	policyGenerations struct {
+		genMap  *ebpf.Map
+		waitMap *ebpf.Map // the outer map updated to wait for running programs
+		gens    [policyGens]policyMaps
+		active  uint32
+		pinDir  model.ExeID // entries of the directory of the pinned objects are protected regardless of the state
+	}
+
+	// policyMapSlot binds the outer map of the policy to the inner map of the generation
+	policyMapSlot struct {
+		name  string
+		outer *ebpf.Map
+		inner **ebpf.Map
+	}
+)
+
+// newPolicyGenerations creates inner maps of both generations and puts them into the outer maps,
+// inner maps which are in the outer ones yet, e.g. pinned by the previous instance, are reused
+func newPolicyGenerations(specs map[string]*ebpf.MapSpec, maps *bpfMaps) (_ *policyGenerations, err error) {
+	g := &policyGenerations{genMap: maps.PolicyGenMap, waitMap: maps.ModeMap}
+	defer func() {
+		if err != nil {
+			g.Close()
+		}
+	}()
+	for i := range g.gens {
+		for _, slot := range g.gens[i].slots(maps) {
+			spec := specs[slot.name]
+			if spec == nil || spec.InnerMap == nil {
+				return nil, errors.Errorf("map '%s' is not a map of maps", slot.name)
+			}
+			err = slot.outer.Lookup(uint32(i), slot.inner)
+			if err == nil {
+				if err = spec.InnerMap.Compatible(*slot.inner); err != nil {
+					return nil, errors.WithMessagef(err, "generation %d of map '%s'", i, slot.name)
+				}
+				continue
+			}
+			if !errors.Is(err, ebpf.ErrKeyNotExist) {
+				return nil, errors.WithMessagef(err, "failed to get generation %d of map '%s'", i, slot.name)
+			}
+			if *slot.inner, err = ebpf.NewMap(spec.InnerMap); err != nil {
+				return nil, errors.WithMessagef(err, "failed to create generation %d of map '%s'", i, slot.name)
+			}
+			if err = slot.outer.Put(uint32(i), *slot.inner); err != nil {
+				return nil, errors.WithMessagef(err, "failed to put generation %d of map '%s'", i, slot.name)
+			}
+		}
+	}
+	if err = g.genMap.Lookup(uint32(0), &g.active); err != nil {
+		return nil, errors.WithMessage(err, "failed to get policy generation")
+	}
+	if g.active >= policyGens {
+		return nil, errors.Errorf("invalid active policy generation %d", g.active)
+	}
+	return g, nil
+}
+
+func (m *policyMaps) slots(maps *bpfMaps) []policyMapSlot {
+	return []policyMapSlot{
+		{name: "allowed_pid_map", outer: maps.AllowedPidMap, inner: &m.pids},
+		{name: "allowed_cgroup_map", outer: maps.AllowedCgroupMap, inner: &m.cgroups},
+		{name: "allowed_exe_map", outer: maps.AllowedExeMap, inner: &m.exes},
+		{name: "protected_tbl_name_map", outer: maps.ProtectedTblNameMap, inner: &m.tblNames},
+		{name: "protected_pattern_map", outer: maps.ProtectedPatternMap, inner: &m.patterns},
+		{name: "protected_family_map", outer: maps.ProtectedFamilyMap, inner: &m.families},
+		{name: "mode_map", outer: maps.ModeMap, inner: &m.mode},
+		{name: "policy_rule_map", outer: maps.PolicyRuleMap, inner: &m.rules},
+		{name: "rule_cgroup_map", outer: maps.RuleCgroupMap, inner: &m.ruleCgroups},
+		{name: "protected_file_map", outer: maps.ProtectedFileMap, inner: &m.files},
+		{name: "updater_exe_map", outer: maps.UpdaterExeMap, inner: &m.updaters},
+		{name: "break_glass_exe_map", outer: maps.BreakGlassExeMap, inner: &m.breakGlass},
+	}
+}
+
+// load writes the policy into the inactive generation and activates it.
+// The active generation stays in force if the policy is invalid or can't be written.
+func (g *policyGenerations) load(s policyState) error {
+	if !g.pinDir.IsZero() {
+		s.files = append(slices.Clone(s.files), g.pinDir)
+	}
+	c, err := s.toBpf()
+	if err != nil {
+		return err
+	}
+	next := (g.active + 1) % policyGens
+	if err = g.waitPrograms(next); err != nil {
+		return err
+	}
+	if err = g.gens[next].write(&c); err != nil {
+		return err
+	}
+	if err = g.genMap.Put(uint32(0), next); err != nil {
+		return errors.WithMessage(err, "failed to activate policy")
+	}
+	g.active = next
+	return nil
+}
+
+// waitPrograms returns when no program uses the inactive generation. The program reads policy_gen_map once
+// and then uses the generation, so a program started before the last flip may still read the inactive one.
+// The kernel waits for running programs on every update of a map of maps, so an inner map of the generation
+// is put into its slot again. Sleepable programs are not waited for, the protector has none.
+func (g *policyGenerations) waitPrograms(gen uint32) error {
+	err := g.waitMap.Put(gen, g.gens[gen].mode)
+	return errors.WithMessage(err, "failed to wait for programs using the inactive policy")
+}
+
+func (m *policyMaps) write(c *policyContent) error {
+	if err := syncMap(m.pids, c.pids); err != nil {
+		return errors.WithMessage(err, "failed to setup allowed pids")
+	}
+	if err := syncMap(m.cgroups, c.cgroups); err != nil {
+		return errors.WithMessage(err, "failed to setup allowed cgroups")
+	}
+	if err := syncMap(m.exes, c.exes); err != nil {
+		return errors.WithMessage(err, "failed to setup allowed executables")
+	}
+	if err := syncMap(m.tblNames, c.tblNames); err != nil {
+		return errors.WithMessage(err, "failed to setup protected tables")
+	}
+	if err := putArray(m.patterns, c.patterns[:]); err != nil {
+		return errors.WithMessage(err, "failed to setup protected table patterns")
+	}
+	if err := putArray(m.families, c.families[:]); err != nil {
+		return errors.WithMessage(err, "failed to setup protected table families")
+	}
+	if err := m.mode.Put(uint32(0), c.mode); err != nil {
+		return errors.WithMessage(err, "failed to setup mode")
+	}
+	if err := putArray(m.rules, c.rules[:]); err != nil {
+		return errors.WithMessage(err, "failed to setup policy rules")
+	}
+	if err := syncMap(m.ruleCgroups, c.ruleCgroups); err != nil {
+		return errors.WithMessage(err, "failed to setup cgroups of policy rules")
+	}
+	if err := syncMap(m.files, c.files); err != nil {
+		return errors.WithMessage(err, "failed to setup protected files")
+	}
+	if err := syncMap(m.updaters, c.updaters); err != nil {
+		return errors.WithMessage(err, "failed to setup updaters")
+	}
+	return errors.WithMessage(syncMap(m.breakGlass, c.breakGlass), "failed to setup break-glass owners")
+}
+
+// putArray writes all entries of the array map
+func putArray[V any](m *ebpf.Map, vals []V) error {
+	for i := range vals {
+		if err := m.Put(uint32(i), vals[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes inner maps, the outer maps keep them alive while they are loaded
+func (g *policyGenerations) Close() {
+	for i := range g.gens {
+		for _, slot := range g.gens[i].slots(&bpfMaps{}) {
+			if *slot.inner != nil {
+				_ = (*slot.inner).Close()
+			}
+		}
+	}
+}
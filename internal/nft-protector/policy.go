@@ -0,0 +1,253 @@
+package nft_protector
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/pkg/errors"
+)
+
+// RuleVerdict is what the matching rule does with the message (enum rule_verdict)
+type RuleVerdict uint8
+
+const (
+	RuleAllow RuleVerdict = iota
+	RuleDeny
+	// RuleAudit lets the message through and reports it
+	RuleAudit
+)
+
+const (
+	// maxPolicyRules is the size of policy_rule_map (MAX_POLICY_RULES)
+	maxPolicyRules = 32
+	// maxRuleCgroups is the size of rule_cgroup_map (MAX_RULE_CGROUPS)
+	maxRuleCgroups = 1024
+	// commLen is the kernel TASK_COMM_LEN
+	commLen = 16
+)
+
+// subject and object fields to match (RULE_SUBJ_xxx, RULE_OBJ_xxx)
+const (
+	ruleSubjPid uint8 = 1 << iota
+	ruleSubjUid
+	ruleSubjComm
+	ruleSubjCgroup
+	ruleSubjExe
+)
+
+const (
+	ruleObjTable uint8 = 1 << iota
+	ruleObjName
+)
+
+var ruleVerdictNames = map[RuleVerdict]string{
+	RuleAllow: "allow",
+	RuleDeny:  "deny",
+	RuleAudit: "audit",
+}
+
+type (
+	// Rule matches the subject changing the object by one of the operations.
+	// Zero fields match anything.
+	Rule struct {
+		ID      string
+		Subject RuleSubject
+		Object  RuleObject
+		// Ops are state changing messages, empty matches all of them
+		Ops     []NftMsgType
+		Verdict RuleVerdict
+	}
+
+	// RuleSubject is the process sending the message
+	RuleSubject struct {
+		Pid  uint32
+		Uid  *uint32
+		Comm string
+		// Cgroup is the cgroup as it is configured, e.g. systemd unit 'fail2ban.service'.
+		// The rule matches processes of CgroupIDs it is resolved to, none if it is not resolved.
+		Cgroup    string
+		CgroupIDs []uint64
+		// ExePath is the executable as it is configured, the rule matches processes
+		// running Exe it is resolved to, none if it is not resolved
+		ExePath string
+		Exe     model.ExeID
+	}
+
+	// RuleObject is what the message changes. A message which changes all tables
+	// or all chains/sets of the table is never allowed by a rule limited to a name.
+	RuleObject struct {
+		Family Family
+		Table  string
+		// Chain limits chain and rule messages to the chain
+		Chain string
+		// Set limits set and set element messages to the set
+		Set string
+	}
+
+	// Policy is the ordered list of rules, the first matching rule decides.
+	// If no rule matches the owners and protected tables decide.
+	Policy []Rule
+)
+
+// ParseRuleVerdict parses 'allow', 'deny' or 'audit'
+func ParseRuleVerdict(s string) (RuleVerdict, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for v, name := range ruleVerdictNames {
+		if name == s {
+			return v, nil
+		}
+	}
+	return RuleDeny, errors.Errorf("unknown rule verdict '%s'", s)
+}
+
+func (v RuleVerdict) String() string {
+	if name, ok := ruleVerdictNames[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("verdict(%d)", uint8(v))
+}
+
+// Validate checks the policy can be loaded into the kernel
+func (p Policy) Validate() error {
+	_, _, err := p.toBpf()
+	return err
+}
+
+// RuleID returns the id of the rule at 1-based position as it is reported by events
+func (p Policy) RuleID(pos uint16) string {
+	if pos == 0 || int(pos) > len(p) {
+		return ""
+	}
+	if id := p[pos-1].ID; id != "" {
+		return id
+	}
+	return fmt.Sprintf("#%d", pos)
+}
+
+// toBpf converts the policy to the content of policy_rule_map and rule_cgroup_map
+func (p Policy) toBpf() ([]bpfPolicyRule, map[bpfRuleCgroupKey]uint8, error) {
+	if len(p) > maxPolicyRules {
+		return nil, nil, errors.Errorf("too many policy rules, at most %d are supported", maxPolicyRules)
+	}
+	ids := make(map[string]struct{}, len(p))
+	rules := make([]bpfPolicyRule, 0, len(p))
+	cgroups := make(map[bpfRuleCgroupKey]uint8)
+	for i, r := range p {
+		id := p.RuleID(uint16(i + 1))
+		if _, ok := ids[id]; ok {
+			return nil, nil, errors.Errorf("policy rule id '%s' is not unique", id)
+		}
+		ids[id] = struct{}{}
+		b, err := r.toBpf(uint16(i + 1))
+		if err != nil {
+			return nil, nil, errors.WithMessagef(err, "policy rule '%s'", id)
+		}
+		rules = append(rules, b)
+		for _, cg := range r.Subject.CgroupIDs {
+			cgroups[bpfRuleCgroupKey{CgroupId: cg, Rule: uint32(b.Id)}] = 1
+		}
+	}
+	if len(cgroups) > maxRuleCgroups {
+		return nil, nil, errors.Errorf("too many cgroups of policy rules %d, at most %d are supported",
+			len(cgroups), maxRuleCgroups)
+	}
+	return rules, cgroups, nil
+}
+
+func (r Rule) toBpf(pos uint16) (b bpfPolicyRule, err error) {
+	if _, ok := ruleVerdictNames[r.Verdict]; !ok {
+		return b, errors.Errorf("unknown verdict %s", r.Verdict)
+	}
+	b.Id = pos
+	b.Verdict = uint8(r.Verdict)
+
+	s := r.Subject
+	if s.Pid != 0 {
+		b.Subj |= ruleSubjPid
+		b.Pid = s.Pid
+	}
+	if s.Uid != nil {
+		b.Subj |= ruleSubjUid
+		b.Uid = *s.Uid
+	}
+	if s.Comm != "" {
+		if len(s.Comm) >= commLen {
+			return b, errors.Errorf("comm '%s' is longer than %d", s.Comm, commLen-1)
+		}
+		b.Subj |= ruleSubjComm
+		copy(b.Comm[:], s.Comm)
+	}
+	if s.Cgroup != "" || len(s.CgroupIDs) > 0 {
+		b.Subj |= ruleSubjCgroup
+	}
+	if s.ExePath != "" || !s.Exe.IsZero() {
+		b.Subj |= ruleSubjExe
+		b.ExeIno, b.ExeDev = s.Exe.Ino, s.Exe.Dev
+	}
+
+	o := r.Object
+	if _, ok := familyNames[o.Family]; !ok {
+		return b, errors.Errorf("unsupported family %s", o.Family)
+	}
+	b.Family = uint8(o.Family)
+	if o.Table != "" {
+		tbl, err := TableKey{Family: o.Family, Name: o.Table}.toBpf()
+		if err != nil {
+			return b, err
+		}
+		b.Obj |= ruleObjTable
+		b.Table = tbl.Name
+	}
+	kind, name := objNone, ""
+	switch {
+	case o.Chain != "" && o.Set != "":
+		return b, errors.New("object can't be both chain and set")
+	case o.Chain != "":
+		kind, name = objChain, o.Chain
+	case o.Set != "":
+		kind, name = objSet, o.Set
+	}
+	if kind != objNone {
+		if len(name) >= MaxTblNameLen {
+			return b, errors.Errorf("name '%s' is longer than %d", name, MaxTblNameLen-1)
+		}
+		b.Obj |= ruleObjName
+		b.ObjKind = uint8(kind)
+		copy(b.Name[:], name)
+	}
+
+	ops := r.Ops
+	if len(ops) == 0 {
+		for _, t := range StateChangingNftMsgs() {
+			if kind == objNone || nftMsgObjAttr[t].kind == kind {
+				ops = append(ops, t)
+			}
+		}
+	}
+	for _, t := range ops {
+		if !t.IsStateChanging() {
+			return b, errors.Errorf("operation %s does not change nftables", t)
+		}
+		if kind != objNone && nftMsgObjAttr[t].kind != kind {
+			return b, errors.Errorf("operation %s does not change %s '%s'", t, kind, name)
+		}
+		b.Ops |= 1 << t
+	}
+	return b, nil
+}
+
+func (k objKind) String() string {
+	switch k {
+	case objChain:
+		return "chain"
+	case objSet:
+		return "set"
+	case objObj:
+		return "object"
+	case objFlowtable:
+		return "flowtable"
+	}
+	return "none"
+}
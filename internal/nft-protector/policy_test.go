@@ -0,0 +1,72 @@
+package nft_protector
+
+import (
+	"testing"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PolicyToBpf(t *testing.T) {
+	root := uint32(0)
+	rule := Rule{
+		ID: "fail2ban",
+		Subject: RuleSubject{Comm: "fail2ban-server", Uid: &root, Cgroup: "fail2ban.service",
+			CgroupIDs: []uint64{10, 20}},
+		Object:  RuleObject{Family: FamilyInet, Table: "filter", Set: "blocklist"},
+		Ops:     []NftMsgType{NftMsgNewSetElem, NftMsgDelSetElem},
+		Verdict: RuleAllow,
+	}
+	rules, cgroups, err := Policy{rule, {Verdict: RuleDeny, Object: RuleObject{Chain: "input"}}}.toBpf()
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	require.Equal(t, map[bpfRuleCgroupKey]uint8{{CgroupId: 10, Rule: 1}: 1, {CgroupId: 20, Rule: 1}: 1}, cgroups)
+
+	b := rules[0]
+	require.Equal(t, uint16(1), b.Id)
+	require.Equal(t, ruleSubjUid|ruleSubjComm|ruleSubjCgroup, b.Subj)
+	require.Equal(t, ruleObjTable|ruleObjName, b.Obj)
+	require.Equal(t, uint8(objSet), b.ObjKind)
+	require.Equal(t, uint64(1<<NftMsgNewSetElem|1<<NftMsgDelSetElem), b.Ops)
+	require.Equal(t, "blocklist", FastBytes2String(b.Name[:len("blocklist")]))
+
+	b = rules[1]
+	require.Equal(t, ruleObjName, b.Obj, "no table matches any table")
+	for _, msg := range StateChangingNftMsgs() {
+		require.Equal(t, nftMsgObjAttr[msg].kind == objChain, b.Ops&(1<<msg) != 0, msg.String())
+	}
+
+	testCases := []struct {
+		name string
+		rule Rule
+	}{
+		{"long comm", Rule{Subject: RuleSubject{Comm: "a-very-long-process"}}},
+		{"pattern table", Rule{Object: RuleObject{Table: "k8s-*"}}},
+		{"chain and set", Rule{Object: RuleObject{Chain: "input", Set: "blocklist"}}},
+		{"op of other kind", Rule{Object: RuleObject{Set: "blocklist"}, Ops: []NftMsgType{NftMsgDelRule}}},
+		{"not changing op", Rule{Ops: []NftMsgType{NftMsgGetRule}}},
+		{"unknown verdict", Rule{Verdict: RuleVerdict(9)}},
+	}
+	for _, tc := range testCases {
+		require.Error(t, Policy{tc.rule}.Validate(), tc.name)
+	}
+	require.Error(t, Policy{rule, rule}.Validate(), "ids must be unique")
+	require.Error(t, Policy(make([]Rule, maxPolicyRules+1)).Validate())
+	require.NoError(t, Policy{{Subject: RuleSubject{Exe: model.ExeID{Ino: 1, Dev: 2}}}}.Validate())
+
+	unresolved, _, err := Policy{{Subject: RuleSubject{Cgroup: "gone.service", ExePath: "/usr/bin/gone"}}}.toBpf()
+	require.NoError(t, err)
+	require.Equal(t, ruleSubjCgroup|ruleSubjExe, unresolved[0].Subj, "the unresolved subject matches nothing")
+	many := make([]uint64, maxRuleCgroups+1)
+	for i := range many {
+		many[i] = uint64(i + 1)
+	}
+	require.Error(t, Policy{{Subject: RuleSubject{CgroupIDs: many}}}.Validate())
+
+	p := Policy{rule, {Verdict: RuleDeny}}
+	require.Equal(t, "fail2ban", p.RuleID(1))
+	require.Equal(t, "#2", p.RuleID(2))
+	require.Empty(t, p.RuleID(0))
+	require.Empty(t, p.RuleID(3))
+}
@@ -0,0 +1,151 @@
+package nft_protector
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxFamily is the size of protected_family_map (MAX_FAMILY)
+	maxFamily = 16
+	// maxTblPatterns is the size of protected_pattern_map (MAX_TBL_PATTERNS)
+	maxTblPatterns = 16
+)
+
+// protectedTables is the set of protected tables the BPF maps are derived from
+type protectedTables struct {
+	set     map[TableKey]struct{}
+	audited map[TableKey]struct{} // tables in audit mode
+	ordered []TableKey            // patterns in order they were added
+}
+
+func newProtectedTables() protectedTables {
+	return protectedTables{
+		set:     make(map[TableKey]struct{}),
+		audited: make(map[TableKey]struct{}),
+	}
+}
+
+func (t protectedTables) clone() protectedTables {
+	return protectedTables{
+		set:     maps.Clone(t.set),
+		audited: maps.Clone(t.audited),
+		ordered: slices.Clone(t.ordered),
+	}
+}
+
+func (t *protectedTables) add(tables ...TableKey) error {
+	for _, tbl := range tables {
+		if tbl.IsPattern() {
+			if _, err := tbl.toBpfPattern(); err != nil {
+				return err
+			}
+			if _, ok := t.set[tbl]; !ok {
+				if len(t.ordered) >= maxTblPatterns {
+					return errors.Errorf("too many table patterns, at most %d are supported", maxTblPatterns)
+				}
+				t.ordered = append(t.ordered, tbl)
+			}
+		} else if _, err := tbl.toBpf(); err != nil {
+			return err
+		}
+		t.set[tbl] = struct{}{}
+	}
+	return nil
+}
+
+// list returns exact tables first and then patterns in order they were added
+func (t protectedTables) list() []TableKey {
+	ret := make([]TableKey, 0, len(t.set))
+	for tbl := range t.set {
+		if !tbl.IsPattern() {
+			ret = append(ret, tbl)
+		}
+	}
+	return append(ret, t.ordered...)
+}
+
+func (t *protectedTables) remove(tables ...TableKey) {
+	for _, tbl := range tables {
+		if i := slices.Index(t.ordered, tbl); i >= 0 {
+			t.ordered = slices.Delete(t.ordered, i, i+1)
+		}
+		delete(t.set, tbl)
+		delete(t.audited, tbl)
+	}
+}
+
+// setMode switches protected tables between enforce and audit mode
+func (t *protectedTables) setMode(mode Mode, tables ...TableKey) error {
+	for _, tbl := range tables {
+		if _, ok := t.set[tbl]; !ok {
+			return errors.Errorf("table '%s' is not protected", tbl)
+		}
+		switch mode {
+		case ModeEnforce:
+			delete(t.audited, tbl)
+		case ModeAudit:
+			t.audited[tbl] = struct{}{}
+		default:
+			return errors.Errorf("unknown mode %s", mode)
+		}
+	}
+	return nil
+}
+
+// auditedList returns tables in audit mode
+func (t protectedTables) auditedList() []TableKey {
+	ret := make([]TableKey, 0, len(t.audited))
+	for tbl := range t.audited {
+		ret = append(ret, tbl)
+	}
+	return ret
+}
+
+// flags are TBL_F_xxx of the table
+func (t protectedTables) flags(tbl TableKey) (flags uint8) {
+	flags = tblFlagProtected
+	if _, ok := t.audited[tbl]; ok {
+		flags |= tblFlagAudit
+	}
+	return flags
+}
+
+// toBpf fills protected_tbl_name_map, protected_pattern_map and protected_family_map of the policy
+func (t protectedTables) toBpf(c *policyContent) error {
+	c.tblNames = make(map[bpfTblKey]uint8, len(t.set))
+	for tbl := range t.set {
+		if tbl.IsPattern() {
+			continue
+		}
+		key, err := tbl.toBpf()
+		if err != nil {
+			return err
+		}
+		c.tblNames[key] = t.flags(tbl)
+	}
+	for i, tbl := range t.ordered {
+		p, err := tbl.toBpfPattern()
+		if err != nil {
+			return err
+		}
+		p.Flags = t.flags(tbl)
+		c.patterns[i] = p
+	}
+	for f := range c.families {
+		c.families[f] = countFlushedTables(t.set, Family(f))
+	}
+	return nil
+}
+
+// countFlushedTables counts protected tables and patterns hit by flushing all tables of the family
+func countFlushedTables(set map[TableKey]struct{}, family Family) (n uint32) {
+	for tbl := range set {
+		if family == FamilyAny || tbl.Family == FamilyAny || tbl.Family == family {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,307 @@
+package nft_protector
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/pkg/errors"
+)
+
+// TamperOp is what the process tried to do with the objects of the protector (enum tamper_op)
+type TamperOp uint8
+
+const (
+	// TamperMapWrite a writable fd of the map, e.g. to add itself to owners
+	TamperMapWrite TamperOp = iota
+	// TamperProgOpen an fd of the program, e.g. to replace it
+	TamperProgOpen
+	// TamperLinkOpen an fd of the link by its ID, e.g. to detach it
+	TamperLinkOpen
+	// TamperLinkChange the link detached or updated by an fd, e.g. got from the pin
+	TamperLinkChange
+	// TamperKill SIGKILL to the protector or an owner
+	TamperKill
+	// TamperStop SIGSTOP to the protector or an owner
+	TamperStop
+	// TamperPtrace ptrace of the protector or an owner
+	TamperPtrace
+	// TamperFileWrite a protected file opened for writing
+	TamperFileWrite
+	// TamperFileRename a protected file moved or replaced
+	TamperFileRename
+	// TamperFileUnlink a protected file removed
+	TamperFileUnlink
+	// TamperThaw ThawSignal to the protector by anybody but the service manager, owners and break-glass owners
+	TamperThaw
+)
+
+// kinds of objects of the protector (enum self_obj_kind)
+const (
+	selfObjMap uint32 = iota
+	selfObjProg
+	selfObjLink
+)
+
+// selfProgNames are programs denying to tamper with the objects of the backend, detect-only backend has none
+var selfProgNames = map[string][]string{
+	"lsm_netlink_send":      {"lsm_bpf", "lsm_bpf_map", "lsm_bpf_prog"},
+	"fmod_ret_netlink_send": {"fmod_ret_bpf", "fmod_ret_bpf_map", "fmod_ret_bpf_prog"},
+}
+
+// killProgNames deny ThawSignal aimed at the protector, so they are attached with self-protection,
+// they deny SIGKILL and SIGSTOP aimed at the protector and owner PIDs if the guard is on
+var killProgNames = map[string][]string{
+	"lsm_netlink_send":      {"lsm_task_kill"},
+	"fmod_ret_netlink_send": {"fmod_ret_task_kill"},
+}
+
+// guardProgNames deny ptrace of the protector and owner PIDs
+var guardProgNames = map[string][]string{
+	"lsm_netlink_send":      {"lsm_ptrace_access_check"},
+	"fmod_ret_netlink_send": {"fmod_ret_ptrace_access_check"},
+}
+
+// fileProgNames deny to modify protected files
+var fileProgNames = map[string][]string{
+	"lsm_netlink_send":      {"lsm_file_open", "lsm_inode_rename", "lsm_inode_unlink"},
+	"fmod_ret_netlink_send": {"fmod_ret_file_open", "fmod_ret_inode_rename", "fmod_ret_inode_unlink"},
+}
+
+// IsFile is true for operations with protected files, the event has the name of the file
+func (op TamperOp) IsFile() bool {
+	return op >= TamperFileWrite && op <= TamperFileUnlink
+}
+
+func (op TamperOp) String() string {
+	switch op {
+	case TamperMapWrite:
+		return "map-write"
+	case TamperProgOpen:
+		return "prog-open"
+	case TamperLinkOpen:
+		return "link-open"
+	case TamperLinkChange:
+		return "link-change"
+	case TamperKill:
+		return "kill"
+	case TamperStop:
+		return "stop"
+	case TamperPtrace:
+		return "ptrace"
+	case TamperFileWrite:
+		return "file-write"
+	case TamperFileRename:
+		return "file-rename"
+	case TamperFileUnlink:
+		return "file-unlink"
+	case TamperThaw:
+		return "thaw"
+	}
+	return fmt.Sprintf("tamper(%d)", uint8(op))
+}
+
+// guardSubjects are the processes self-protection tells apart, the decisions are the same as BPF programs make
+type guardSubjects struct {
+	self       uint32   // the running protector, 0 if it is not running
+	guard      bool     // -guard is on
+	owners     []uint32 // owner PIDs, may_guard lets owners of any kind, they are given by PIDs here
+	breakGlass []uint32 // PIDs of break-glass owners
+}
+
+// isTamperer is the same as is_tamperer: anybody but the running protector, nobody if it is not running
+func (g guardSubjects) isTamperer(tgid uint32) bool {
+	return g.self != 0 && tgid != g.self
+}
+
+// isGuarded is the same as is_guarded: the running protector and owner PIDs
+func (g guardSubjects) isGuarded(tgid uint32) bool {
+	return (g.self != 0 && tgid == g.self) || slices.Contains(g.owners, tgid)
+}
+
+// mayGuard is the same as may_guard: the service manager, the protector and owners
+func (g guardSubjects) mayGuard(tgid uint32) bool {
+	return tgid == 1 || (g.self != 0 && tgid == g.self) || slices.Contains(g.owners, tgid)
+}
+
+// checkKill is the same as guard_check_kill, it returns the operation to deny
+func (g guardSubjects) checkKill(sender, target uint32, sig syscall.Signal) (op TamperOp, deny bool) {
+	if sig == ThawSignal {
+		if g.self == 0 || target != g.self || g.mayGuard(sender) || slices.Contains(g.breakGlass, sender) {
+			return 0, false
+		}
+		return TamperThaw, true
+	}
+	if (sig != syscall.SIGKILL && sig != syscall.SIGSTOP) || !g.guard {
+		return 0, false
+	}
+	if !g.isGuarded(target) || g.mayGuard(sender) {
+		return 0, false
+	}
+	if sig == syscall.SIGKILL {
+		return TamperKill, true
+	}
+	return TamperStop, true
+}
+
+// checkPtrace is the same as guard_check_ptrace
+func (g guardSubjects) checkPtrace(tracer, target uint32) bool {
+	return g.isGuarded(target) && !g.mayGuard(tracer)
+}
+
+// protectSelf attaches the programs which deny other processes to update our maps, replace our programs
+// or detach our links while this process runs. The exit program must be attached, so the next instance
+// is not denied to take the pinned objects over.
+func (p *bpfProtector) protectSelf(log logger.TypeOfLogger, links ...link.Link) (selfLinks []link.Link) {
+	if len(p.selfProgs) == 0 {
+		if p.opts.Guard || p.opts.ProtectFiles {
+			log.Warn("the backend can't guard processes and files")
+		}
+		return nil
+	}
+	err := p.attachSelf(&selfLinks)
+	if err == nil {
+		err = p.attachLive(&selfLinks)
+	}
+	if err == nil {
+		err = p.registerSelf(append(links, selfLinks...))
+	}
+	if err == nil {
+		self := bpfSelf{Tgid: uint32(os.Getpid())}
+		if p.opts.Guard {
+			self.Guard = 1
+		}
+		err = p.maps.SelfMap.Put(uint32(0), self)
+	}
+	if err != nil {
+		for _, lnk := range selfLinks {
+			_ = lnk.Unpin()
+			_ = lnk.Close()
+		}
+		log.Warnf("self-protection is off: %v", err)
+		return nil
+	}
+	var guarded []string
+	if p.opts.Guard {
+		guarded = append(guarded, "the protector and owner processes")
+	}
+	if p.opts.ProtectFiles {
+		guarded = append(guarded, "protected files")
+	}
+	if p.opts.Pin {
+		guarded = append(guarded, "pinned objects")
+	}
+	if len(guarded) > 0 {
+		log.Infof("self-protection is on, %s are guarded", strings.Join(guarded, " and "))
+	} else {
+		log.Info("self-protection is on")
+	}
+	return selfLinks
+}
+
+func attachHook(prog *ebpf.Program) (link.Link, error) {
+	if prog.Type() == ebpf.LSM {
+		return link.AttachLSM(link.LSMOptions{Program: prog})
+	}
+	return link.AttachTracing(link.TracingOptions{Program: prog})
+}
+
+// attachLive attaches the guard and protection of files, they are not pinned
+func (p *bpfProtector) attachLive(selfLinks *[]link.Link) error {
+	for name, prog := range p.liveProgs {
+		lnk, err := attachHook(prog)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to attach '%s'", name)
+		}
+		*selfLinks = append(*selfLinks, lnk)
+	}
+	return nil
+}
+
+func (p *bpfProtector) attachSelf(selfLinks *[]link.Link) error {
+	for name, prog := range p.selfProgs {
+		lnk, err := attachHook(prog)
+		if err != nil {
+			return errors.WithMessagef(err, "failed to attach '%s'", name)
+		}
+		*selfLinks = append(*selfLinks, lnk)
+		if !p.opts.Pin {
+			continue
+		}
+		path := filepath.Join(p.pinPath, "self-"+name)
+		if old, err := link.LoadPinnedLink(path, nil); err == nil {
+			_ = old.Unpin()
+			_ = old.Close()
+		}
+		if err = lnk.Pin(path); err != nil {
+			return errors.WithMessagef(err, "failed to pin '%s'", name)
+		}
+	}
+	return nil
+}
+
+// registerSelf writes IDs of all our maps, programs and links into self_obj_map
+func (p *bpfProtector) registerSelf(links []link.Link) error {
+	objs := make(map[bpfSelfObjKey]uint8)
+	add := func(kind uint32, id uint32) {
+		objs[bpfSelfObjKey{Kind: kind, Id: id}] = 1
+	}
+	for _, m := range p.selfMaps() {
+		info, err := m.Info()
+		if err != nil {
+			return err
+		}
+		if id, ok := info.ID(); ok {
+			add(selfObjMap, uint32(id))
+		}
+	}
+	progs := []*ebpf.Program{p.prog, p.exitProg}
+	for _, prog := range p.selfProgs {
+		progs = append(progs, prog)
+	}
+	for _, prog := range p.liveProgs {
+		progs = append(progs, prog)
+	}
+	for _, prog := range progs {
+		if prog == nil {
+			continue
+		}
+		info, err := prog.Info()
+		if err != nil {
+			return err
+		}
+		if id, ok := info.ID(); ok {
+			add(selfObjProg, uint32(id))
+		}
+	}
+	for _, lnk := range links {
+		if info, err := lnk.Info(); err == nil {
+			add(selfObjLink, uint32(info.ID))
+		}
+	}
+	return errors.WithMessage(syncMap(p.maps.SelfObjMap, objs), "failed to register own objects")
+}
+
+// selfMaps are all maps of the protector including inner maps of the policy generations
+func (p *bpfProtector) selfMaps() []*ebpf.Map {
+	m := &p.maps
+	ret := []*ebpf.Map{
+		m.AllowedCgroupMap, m.AllowedExeMap, m.AllowedPidMap, m.BreakGlassExeMap, m.Events, m.FreezeMap,
+		m.LockdownMap, m.ModeMap,
+		m.NftMsgMap, m.PolicyGenMap, m.PolicyRuleMap, m.ProtectedFamilyMap, m.ProtectedFileMap,
+		m.ProtectedPatternMap, m.ProtectedTblNameMap, m.RuleCgroupMap, m.SelfMap, m.SelfObjMap, m.TblHandleMap,
+		m.UpdaterExeMap,
+	}
+	for i := range p.gens.gens {
+		for _, slot := range p.gens.gens[i].slots(m) {
+			ret = append(ret, *slot.inner)
+		}
+	}
+	return ret
+}
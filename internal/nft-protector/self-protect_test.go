@@ -0,0 +1,98 @@
+package nft_protector
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TamperOp(t *testing.T) {
+	testCases := []struct {
+		op     TamperOp
+		name   string
+		isFile bool
+	}{
+		{op: TamperMapWrite, name: "map-write"},
+		{op: TamperProgOpen, name: "prog-open"},
+		{op: TamperLinkOpen, name: "link-open"},
+		{op: TamperLinkChange, name: "link-change"},
+		{op: TamperKill, name: "kill"},
+		{op: TamperStop, name: "stop"},
+		{op: TamperPtrace, name: "ptrace"},
+		{op: TamperFileWrite, name: "file-write", isFile: true},
+		{op: TamperFileRename, name: "file-rename", isFile: true},
+		{op: TamperFileUnlink, name: "file-unlink", isFile: true},
+		{op: TamperThaw, name: "thaw"},
+		{op: TamperThaw + 1, name: "tamper(11)"},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.name, tc.op.String())
+		require.Equal(t, tc.isFile, tc.op.IsFile(), tc.name)
+	}
+}
+
+func Test_IsTamperer(t *testing.T) {
+	stopped := guardSubjects{}
+	require.False(t, stopped.isTamperer(100), "nobody tampers while the protector is not running")
+
+	running := guardSubjects{self: 100}
+	require.False(t, running.isTamperer(100), "the protector takes care of its own objects")
+	require.True(t, running.isTamperer(200))
+	require.True(t, running.isTamperer(1), "even the service manager")
+}
+
+func Test_GuardCheck(t *testing.T) {
+	const (
+		protector = 100
+		owner     = 200
+		other     = 300
+		admin     = 400
+	)
+	g := guardSubjects{self: protector, guard: true, owners: []uint32{owner}, breakGlass: []uint32{admin}}
+	testCases := []struct {
+		name           string
+		sender, target uint32
+		sig            syscall.Signal
+		wantOp         TamperOp
+		wantDeny       bool
+	}{
+		{name: "kill of the protector", sender: other, target: protector, sig: syscall.SIGKILL,
+			wantOp: TamperKill, wantDeny: true},
+		{name: "stop of an owner", sender: other, target: owner, sig: syscall.SIGSTOP,
+			wantOp: TamperStop, wantDeny: true},
+		{name: "term of the protector", sender: other, target: protector, sig: syscall.SIGTERM},
+		{name: "kill of another process", sender: other, target: other, sig: syscall.SIGKILL},
+		{name: "kill by the service manager", sender: 1, target: protector, sig: syscall.SIGKILL},
+		{name: "kill by an owner", sender: owner, target: protector, sig: syscall.SIGKILL},
+		{name: "kill by the protector", sender: protector, target: owner, sig: syscall.SIGKILL},
+		{name: "kill by a break-glass owner", sender: admin, target: protector, sig: syscall.SIGKILL,
+			wantOp: TamperKill, wantDeny: true},
+		{name: "thaw by another process", sender: other, target: protector, sig: ThawSignal,
+			wantOp: TamperThaw, wantDeny: true},
+		{name: "thaw by the service manager", sender: 1, target: protector, sig: ThawSignal},
+		{name: "thaw by an owner", sender: owner, target: protector, sig: ThawSignal},
+		{name: "thaw by a break-glass owner", sender: admin, target: protector, sig: ThawSignal},
+		{name: "SIGUSR2 to an owner", sender: other, target: owner, sig: ThawSignal},
+		{name: "freeze by another process", sender: other, target: protector, sig: FreezeSignal},
+	}
+	for _, tc := range testCases {
+		op, deny := g.checkKill(tc.sender, tc.target, tc.sig)
+		require.Equal(t, tc.wantDeny, deny, tc.name)
+		require.Equal(t, tc.wantOp, op, tc.name)
+	}
+
+	require.True(t, g.checkPtrace(other, owner))
+	require.False(t, g.checkPtrace(owner, protector), "owners may debug the protector")
+	unguarded := guardSubjects{self: protector, owners: []uint32{owner}}
+	_, deny := unguarded.checkKill(other, protector, syscall.SIGKILL)
+	require.False(t, deny, "kill is allowed if the guard is off")
+	op, deny := unguarded.checkKill(other, protector, ThawSignal)
+	require.True(t, deny, "thaw is denied even if the guard is off")
+	require.Equal(t, TamperThaw, op)
+	stopped := guardSubjects{guard: true, owners: []uint32{owner}}
+	_, deny = stopped.checkKill(other, protector, syscall.SIGKILL)
+	require.False(t, deny, "the stopped protector is not guarded by its PID")
+	_, deny = stopped.checkKill(other, owner, syscall.SIGKILL)
+	require.True(t, deny, "owners are guarded while the guard is attached")
+}
@@ -0,0 +1,119 @@
+package nft_protector
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/pkg/errors"
+)
+
+// ShutdownPolicy tells what protects tables after the daemon exits
+type ShutdownPolicy uint8
+
+const (
+	// ShutdownOpen leaves tables unprotected unless objects are pinned, then the last policy stays in force
+	ShutdownOpen ShutdownPolicy = iota
+	// ShutdownClosed engages the lockdown when the daemon exits, even if it is killed: every change
+	// of protected tables by non-owners is denied until Unlock. Owner PIDs are not trusted in lockdown.
+	ShutdownClosed
+)
+
+const exitProgName = "on_protector_exit"
+
+var shutdownNames = map[ShutdownPolicy]string{
+	ShutdownOpen:   "open",
+	ShutdownClosed: "closed",
+}
+
+// ParseShutdownPolicy parses 'open' or 'closed'
+func ParseShutdownPolicy(s string) (ShutdownPolicy, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for p, name := range shutdownNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return ShutdownOpen, errors.Errorf("unknown shutdown policy '%s'", s)
+}
+
+func (p ShutdownPolicy) String() string {
+	if name, ok := shutdownNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("shutdown(%d)", uint8(p))
+}
+
+func pinnedLockdownLinkPath(pinPath string) string {
+	return filepath.Join(pinPath, "lockdown-link")
+}
+
+// armLockdown attaches the exit program and makes the lockdown engage when this process exits with
+// fail-closed policy, otherwise it is disarmed. The lockdown left by the previous instance is lifted.
+func (p *bpfProtector) armLockdown(log logger.TypeOfLogger) (lnk link.Link, err error) {
+	if p.exitProg != nil {
+		if lnk, err = link.AttachTracing(link.TracingOptions{Program: p.exitProg}); err != nil {
+			return nil, errors.WithMessage(err, "failed to attach exit program")
+		}
+	}
+	if !p.opts.Pin {
+		return lnk, nil // a fresh lockdown_map, objects of the previous instance are removed by takeOver
+	}
+	if old, err := link.LoadPinnedLink(pinnedLockdownLinkPath(p.pinPath), nil); err == nil {
+		_ = old.Unpin()
+		_ = old.Close()
+	}
+	if lnk != nil {
+		if err = lnk.Pin(pinnedLockdownLinkPath(p.pinPath)); err != nil {
+			_ = lnk.Close()
+			return nil, errors.WithMessage(err, "failed to pin exit program")
+		}
+	}
+	var prev, next bpfLockdown
+	if err = p.maps.LockdownMap.Lookup(uint32(0), &prev); err != nil {
+		return lnk, errors.WithMessage(err, "failed to get lockdown")
+	}
+	if lnk != nil && p.opts.Shutdown == ShutdownClosed {
+		next.Tgid = uint32(os.Getpid())
+	}
+	if err = p.maps.LockdownMap.Put(uint32(0), next); err != nil {
+		return lnk, errors.WithMessage(err, "failed to arm lockdown")
+	}
+	if prev.Engaged != 0 {
+		log.Warn("the lockdown left by the previous instance is lifted")
+	}
+	return lnk, nil
+}
+
+// Unlock lifts the lockdown left by fail-closed shutdown and removes all pinned objects, so tables are not
+// protected any more. It fails if a running instance uses the pinned objects.
+func Unlock() (wasLocked bool, err error) {
+	return unlock(PinPath)
+}
+
+func unlock(pinPath string) (wasLocked bool, err error) {
+	f, locked, err := lockPinPath(pinPath)
+	if err != nil {
+		return false, err
+	}
+	if f == nil {
+		return false, errors.Errorf("nothing is pinned under '%s'", pinPath)
+	}
+	defer f.Close()
+	if !locked {
+		return false, errors.Errorf("a running instance uses objects pinned under '%s', stop it first", pinPath)
+	}
+	if m, err := ebpf.LoadPinnedMap(filepath.Join(pinPath, "lockdown_map"), nil); err == nil {
+		var l bpfLockdown
+		wasLocked = m.Lookup(uint32(0), &l) == nil && l.Engaged != 0
+		_ = m.Close()
+	}
+	if err = os.RemoveAll(pinPath); err != nil {
+		return wasLocked, errors.WithMessagef(err, "failed to remove objects pinned under '%s'", pinPath)
+	}
+	return wasLocked, nil
+}
@@ -0,0 +1,114 @@
+package nft_protector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseShutdownPolicy(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    ShutdownPolicy
+		wantErr bool
+	}{
+		{input: "open", want: ShutdownOpen},
+		{input: " Closed ", want: ShutdownClosed},
+		{input: "", wantErr: true},
+		{input: "fail-closed", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseShutdownPolicy(tc.input)
+		if tc.wantErr {
+			require.Error(t, err, tc.input)
+			continue
+		}
+		require.NoError(t, err, tc.input)
+		require.Equal(t, tc.want, got)
+		require.Equal(t, tc.want, mustParseShutdown(t, got.String()), "the name is parsed back")
+	}
+	require.Equal(t, "shutdown(7)", ShutdownPolicy(7).String())
+
+	opts := DefaultOptions()
+	opts.Shutdown = ShutdownClosed
+	require.Error(t, opts.Validate(), "fail-closed shutdown needs pinning")
+	opts.Pin = true
+	require.NoError(t, opts.Validate())
+}
+
+func mustParseShutdown(t *testing.T, s string) ShutdownPolicy {
+	p, err := ParseShutdownPolicy(s)
+	require.NoError(t, err)
+	return p
+}
+
+var lockdownMapSpec = ebpf.MapSpec{Type: ebpf.Array, KeySize: 4, ValueSize: 8, MaxEntries: 1}
+
+func Test_Unlock(t *testing.T) {
+	pinPath := filepath.Join(bpfFsDir(t), "nft-protector")
+	f, err := acquirePinPath(pinPath)
+	require.NoError(t, err)
+	require.NoError(t, pinnedMap(t, pinPath, "lockdown_map", lockdownMapSpec).Put(uint32(0), bpfLockdown{Engaged: 1}))
+
+	_, err = unlock(pinPath)
+	require.Error(t, err, "the running instance keeps its objects")
+	require.DirExists(t, pinPath)
+
+	require.NoError(t, f.Close())
+	wasLocked, err := unlock(pinPath)
+	require.NoError(t, err)
+	require.True(t, wasLocked)
+	require.NoDirExists(t, pinPath, "all pinned objects are removed")
+
+	_, err = unlock(pinPath)
+	require.Error(t, err, "nothing is pinned")
+}
+
+func Test_ArmLockdown(t *testing.T) {
+	dir := bpfFsDir(t)
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.Tracing,
+		AttachType:   ebpf.AttachTraceRawTp,
+		AttachTo:     "sched_process_exit",
+		Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, 0), asm.Return()},
+		License:      "GPL",
+	})
+	if err != nil {
+		t.Skipf("tracing programs can't be loaded: %v", err)
+	}
+	t.Cleanup(func() { _ = prog.Close() })
+	lockdown := pinnedMap(t, dir, "lockdown_map", lockdownMapSpec)
+	require.NoError(t, lockdown.Put(uint32(0), bpfLockdown{Tgid: 1, Engaged: 1}))
+	log := logger.FromContext(context.Background())
+
+	p := &bpfProtector{
+		opts:     Options{Pin: true, Shutdown: ShutdownClosed},
+		pinPath:  dir,
+		exitProg: prog,
+		maps:     bpfMaps{LockdownMap: lockdown},
+	}
+	lnk, err := p.armLockdown(log)
+	require.NoError(t, err)
+	var l bpfLockdown
+	require.NoError(t, lockdown.Lookup(uint32(0), &l))
+	require.Equal(t, bpfLockdown{Tgid: uint32(os.Getpid())}, l, "the previous lockdown is lifted and this process arms it")
+
+	require.NoError(t, lnk.Close())
+	pinned, err := link.LoadPinnedLink(pinnedLockdownLinkPath(dir), nil)
+	require.NoError(t, err, "the exit program stays attached after the daemon is gone")
+	require.NoError(t, pinned.Close())
+
+	p.opts.Shutdown = ShutdownOpen
+	lnk, err = p.armLockdown(log)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = lnk.Unpin(); _ = lnk.Close() })
+	require.NoError(t, lockdown.Lookup(uint32(0), &l))
+	require.Zero(t, l.Tgid, "the lockdown is disarmed with fail-open shutdown")
+}
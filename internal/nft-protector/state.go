@@ -0,0 +1,114 @@
+package nft_protector
+
+import (
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// State is the whole policy of the protector, Reload replaces it at once
+	State struct {
+		Owners model.Owners
+		Tables []TableKey
+		// Audited are protected tables in audit mode
+		Audited []TableKey
+		Mode    Mode
+		Policy  Policy
+		// Files are read-only for everybody but the protector and Updaters, entries of directories too.
+		// Only backends with self-protection guard them and only while the daemon runs.
+		Files    []model.ExeID
+		Updaters []model.ExeOwner
+		// BreakGlass may change nf_tables while the freeze is engaged
+		BreakGlass []model.ExeOwner
+	}
+
+	// policyState is the State in the form it is changed in
+	policyState struct {
+		owners     model.Owners
+		tables     protectedTables
+		mode       Mode
+		policy     Policy
+		files      []model.ExeID
+		updaters   []model.ExeOwner
+		breakGlass []model.ExeOwner
+	}
+
+	// policyContent is the content of one generation of the policy maps
+	policyContent struct {
+		pids        map[uint32]uint8
+		cgroups     map[uint64]uint8
+		exes        map[bpfExeKey]bpfExeOwner
+		tblNames    map[bpfTblKey]uint8
+		patterns    [maxTblPatterns]bpfTblPattern
+		families    [maxFamily]uint32
+		mode        uint8
+		rules       [maxPolicyRules]bpfPolicyRule
+		ruleCgroups map[bpfRuleCgroupKey]uint8
+		files       map[bpfExeKey]uint8
+		updaters    map[bpfExeKey]bpfExeOwner
+		breakGlass  map[bpfExeKey]bpfExeOwner
+	}
+)
+
+func newPolicyState(st State) (s policyState, err error) {
+	s = policyState{
+		owners:     st.Owners,
+		tables:     newProtectedTables(),
+		mode:       st.Mode,
+		policy:     st.Policy,
+		files:      st.Files,
+		updaters:   st.Updaters,
+		breakGlass: st.BreakGlass,
+	}
+	if err = s.tables.add(st.Tables...); err != nil {
+		return s, errors.WithMessage(err, "failed to setup protected tables")
+	}
+	return s, s.tables.setMode(ModeAudit, st.Audited...)
+}
+
+func (s policyState) clone() policyState {
+	s.tables = s.tables.clone()
+	return s
+}
+
+func (s policyState) State() State {
+	return State{
+		Owners:     s.owners,
+		Tables:     s.tables.list(),
+		Audited:    s.tables.auditedList(),
+		Mode:       s.mode,
+		Policy:     s.policy,
+		Files:      s.files,
+		Updaters:   s.updaters,
+		BreakGlass: s.breakGlass,
+	}
+}
+
+// toBpf validates the state and converts it to the content of the policy maps
+func (s policyState) toBpf() (c policyContent, err error) {
+	if err = ownersToBpf(&c, s.owners); err != nil {
+		return c, err
+	}
+	if err = s.tables.toBpf(&c); err != nil {
+		return c, errors.WithMessage(err, "failed to setup protected tables")
+	}
+	if _, ok := modeNames[s.mode]; !ok {
+		return c, errors.Errorf("unknown mode %s", s.mode)
+	}
+	c.mode = uint8(s.mode)
+	rules, ruleCgroups, err := s.policy.toBpf()
+	if err != nil {
+		return c, err
+	}
+	copy(c.rules[:], rules)
+	c.ruleCgroups = ruleCgroups
+	if c.files, err = filesToBpf(s.files); err != nil {
+		return c, err
+	}
+	if c.updaters, err = exesToBpf(s.updaters); err != nil {
+		return c, errors.WithMessage(err, "failed to setup updaters")
+	}
+	c.breakGlass, err = exesToBpf(s.breakGlass)
+	return c, errors.WithMessage(err, "failed to setup break-glass owners")
+}
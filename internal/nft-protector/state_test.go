@@ -0,0 +1,48 @@
+package nft_protector
+
+import (
+	"testing"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PolicyStateToBpf(t *testing.T) {
+	fw := TableKey{Family: FamilyInet, Name: "fw"}
+	k8s := TableKey{Family: FamilyAny, Name: "k8s-*"}
+	s, err := newPolicyState(State{
+		Owners:  model.Owners{Pids: []uint32{1, 2}, Exes: []model.ExeOwner{{Exe: model.ExeID{Ino: 3, Dev: 4}}}},
+		Tables:  []TableKey{fw, k8s},
+		Audited: []TableKey{k8s},
+		Mode:    ModeAudit,
+		Policy:  Policy{{Verdict: RuleDeny}},
+	})
+	require.NoError(t, err)
+
+	c, err := s.toBpf()
+	require.NoError(t, err)
+	require.Equal(t, map[uint32]uint8{1: 1, 2: 1}, c.pids)
+	require.Len(t, c.exes, 1)
+	require.Len(t, c.tblNames, 1)
+	require.Equal(t, tblFlagProtected|tblFlagAudit, c.patterns[0].Flags)
+	require.Equal(t, uint32(2), c.families[FamilyInet])
+	require.Equal(t, uint32(1), c.families[FamilyIP])
+	require.Equal(t, uint8(ModeAudit), c.mode)
+	require.Equal(t, uint16(1), c.rules[0].Id)
+	require.Zero(t, c.rules[1].Id, "the rest of rules ends the policy")
+
+	// a change of the copy does not leak into the state in force
+	next := s.clone()
+	next.tables.remove(fw)
+	require.NoError(t, next.tables.setMode(ModeEnforce, k8s))
+	require.ElementsMatch(t, []TableKey{fw, k8s}, s.tables.list())
+	require.Equal(t, []TableKey{k8s}, s.tables.auditedList())
+
+	next.mode = Mode(10)
+	_, err = next.toBpf()
+	require.Error(t, err)
+
+	_, err = newPolicyState(State{Tables: []TableKey{fw}, Audited: []TableKey{{Name: "nat"}}})
+	require.ErrorContains(t, err, "is not protected")
+}
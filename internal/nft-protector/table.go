@@ -0,0 +1,213 @@
+package nft_protector
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Family is a nftables table family (NFPROTO_xxx)
+type Family uint8
+
+const (
+	FamilyAny    Family = 0 // NFPROTO_UNSPEC, matches tables of any family
+	FamilyInet   Family = 1
+	FamilyIP     Family = 2
+	FamilyARP    Family = 3
+	FamilyNetdev Family = 5
+	FamilyBridge Family = 7
+	FamilyIP6    Family = 10
+)
+
+var familyNames = map[Family]string{
+	FamilyAny:    "any",
+	FamilyInet:   "inet",
+	FamilyIP:     "ip",
+	FamilyARP:    "arp",
+	FamilyNetdev: "netdev",
+	FamilyBridge: "bridge",
+	FamilyIP6:    "ip6",
+}
+
+// ParseFamily parses family name as it is used by nft utility
+func ParseFamily(s string) (Family, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for f, name := range familyNames {
+		if name == s {
+			return f, nil
+		}
+	}
+	return FamilyAny, errors.Errorf("unknown table family '%s'", s)
+}
+
+func (f Family) String() string {
+	if name, ok := familyNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("family(%d)", uint8(f))
+}
+
+// TableKey identifies protected table. FamilyAny protects the table in all families.
+// The Name may be a glob pattern with at most one '*' and any number of '?', e.g. 'k8s-*'.
+// Table names may contain these characters too, they are matched literally if escaped by '\',
+// e.g. 'fw\*', and '\' itself is escaped as '\\'. A pattern can't have escaped characters.
+//
+// Precedence: an exact name of the family wins, then an exact name with FamilyAny,
+// then patterns in the order they were added.
+type TableKey struct {
+	Family Family
+	Name   string
+}
+
+// ParseTableKey parses table in form '[family] name' e.g. 'inet filter', 'filter' or 'ip k8s-*'
+func ParseTableKey(s string) (k TableKey, err error) {
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		k.Name = fields[0]
+	case 2:
+		if k.Family, err = ParseFamily(fields[0]); err != nil {
+			return k, err
+		}
+		k.Name = fields[1]
+	default:
+		return k, errors.Errorf("table '%s' must be in form '[family] name'", s)
+	}
+	if k.IsPattern() {
+		_, err = k.toBpfPattern()
+	} else {
+		_, err = k.toBpf()
+	}
+	return k, err
+}
+
+// IsPattern checks if the Name is a glob pattern
+func (k TableKey) IsPattern() bool {
+	_, wildcard, _, _ := parseTblName(k.Name)
+	return wildcard
+}
+
+// parseTblName unescapes the name, wildcard tells if it has '*' or '?' which are not escaped
+func parseTblName(name string) (literal string, wildcard, escaped bool, err error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch c {
+		case '\\':
+			if i+1 == len(name) || !strings.ContainsRune(`*?\`, rune(name[i+1])) {
+				return "", false, false, errors.Errorf("table name '%s' has '\\' which escapes nothing", name)
+			}
+			i++
+			c, escaped = name[i], true
+		case '*', '?':
+			wildcard = true
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), wildcard, escaped, nil
+}
+
+// Match checks if the table matches the key, it is the same as BPF program does.
+// A name of MaxTblNameLen or longer doesn't fit into the BPF key, so it matches any key.
+func (k TableKey) Match(tbl TableKey) bool {
+	if len(tbl.Name) >= MaxTblNameLen {
+		return true
+	}
+	if k.Family != FamilyAny && k.Family != tbl.Family {
+		return false
+	}
+	if literal, wildcard, _, _ := parseTblName(k.Name); !wildcard {
+		return literal == tbl.Name
+	}
+	prefix, suffix, hasStar := strings.Cut(k.Name, "*")
+	if hasStar && len(tbl.Name) < len(prefix)+len(suffix) {
+		return false
+	}
+	if !hasStar && len(tbl.Name) != len(prefix) {
+		return false
+	}
+	globEq := func(pattern, s string) bool {
+		for i := 0; i < len(pattern); i++ {
+			if pattern[i] != '?' && pattern[i] != s[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return globEq(prefix, tbl.Name[:len(prefix)]) &&
+		globEq(suffix, tbl.Name[len(tbl.Name)-len(suffix):])
+}
+
+// MatchFlush checks if the table is hit by the flush message, e.g. DELTABLE with FamilyAny
+// deletes the named table of every family, it is the same as BPF program does
+func (k TableKey) MatchFlush(tbl TableKey) bool {
+	if tbl.Family == FamilyAny {
+		tbl.Family = k.Family
+		k.Family = FamilyAny
+	}
+	return k.Match(tbl)
+}
+
+func (k TableKey) String() string {
+	return k.Family.String() + " " + k.Name
+}
+
+func (k TableKey) validate() error {
+	if k.Name == "" {
+		return errors.New("empty table name")
+	}
+	literal, wildcard, escaped, err := parseTblName(k.Name)
+	if err != nil {
+		return err
+	}
+	if wildcard && escaped {
+		return errors.Errorf("table pattern '%s' can't have escaped characters", k.Name)
+	}
+	if len(literal) >= MaxTblNameLen {
+		return errors.Errorf("table name '%s' is longer than %d", k.Name, MaxTblNameLen-1)
+	}
+	if _, ok := familyNames[k.Family]; !ok {
+		return errors.Errorf("table '%s' has unsupported family", k.Name)
+	}
+	return nil
+}
+
+func (k TableKey) toBpf() (key bpfTblKey, err error) {
+	if err = k.validate(); err != nil {
+		return key, err
+	}
+	if k.IsPattern() {
+		return key, errors.Errorf("table name '%s' is a pattern", k.Name)
+	}
+	literal, _, _, _ := parseTblName(k.Name)
+	key.Family = uint8(k.Family)
+	copy(key.Name[:], literal)
+	return key, nil
+}
+
+func (k TableKey) toBpfPattern() (p bpfTblPattern, err error) {
+	if err = k.validate(); err != nil {
+		return p, err
+	}
+	if strings.Count(k.Name, "*") > 1 {
+		return p, errors.Errorf("table pattern '%s' has more than one '*'", k.Name)
+	}
+	prefix, suffix, hasStar := strings.Cut(k.Name, "*")
+	p.Family = uint8(k.Family)
+	p.PrefixLen = uint8(len(prefix))
+	p.SuffixLen = uint8(len(suffix))
+	if hasStar {
+		p.HasStar = 1
+	}
+	copy(p.Text[:], prefix+suffix)
+	return p, nil
+}
+
+func tableKeyFromBpf(family uint8, name []uint8) TableKey {
+	return TableKey{
+		Family: Family(family),
+		Name:   string(bytes.TrimRight(name, "\x00")),
+	}
+}
@@ -0,0 +1,156 @@
+package nft_protector
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseTableKey(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    TableKey
+		wantErr bool
+	}{
+		{input: "filter", want: TableKey{Family: FamilyAny, Name: "filter"}},
+		{input: " inet  filter ", want: TableKey{Family: FamilyInet, Name: "filter"}},
+		{input: "ip nat", want: TableKey{Family: FamilyIP, Name: "nat"}},
+		{input: "IP6 mangle", want: TableKey{Family: FamilyIP6, Name: "mangle"}},
+		{input: "arp t", want: TableKey{Family: FamilyARP, Name: "t"}},
+		{input: "bridge t", want: TableKey{Family: FamilyBridge, Name: "t"}},
+		{input: "netdev t", want: TableKey{Family: FamilyNetdev, Name: "t"}},
+		{input: "any t", want: TableKey{Family: FamilyAny, Name: "t"}},
+		{input: "", wantErr: true},
+		{input: "ipx filter", wantErr: true},
+		{input: "ip filter extra", wantErr: true},
+		{input: "ip " + strings.Repeat("x", MaxTblNameLen), wantErr: true},
+		{input: "ip k8s-*", want: TableKey{Family: FamilyIP, Name: "k8s-*"}},
+		{input: "*-test", want: TableKey{Family: FamilyAny, Name: "*-test"}},
+		{input: "fw?", want: TableKey{Family: FamilyAny, Name: "fw?"}},
+		{input: "k8s-*-*", wantErr: true},
+		{input: `ip fw\*`, want: TableKey{Family: FamilyIP, Name: `fw\*`}},
+		{input: `fw\?-*`, wantErr: true},
+		{input: `fw\`, wantErr: true},
+		{input: `f\w`, wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseTableKey(tc.input)
+		if tc.wantErr {
+			require.Error(t, err, tc.input)
+			continue
+		}
+		require.NoError(t, err, tc.input)
+		require.Equal(t, tc.want, got)
+	}
+}
+
+func Test_CountFlushedTables(t *testing.T) {
+	set := map[TableKey]struct{}{
+		{Family: FamilyAny, Name: "fw"}:    {},
+		{Family: FamilyInet, Name: "fw"}:   {},
+		{Family: FamilyIP, Name: "nat"}:    {},
+		{Family: FamilyIP6, Name: "nat"}:   {},
+		{Family: FamilyIP6, Name: "raw"}:   {},
+		{Family: FamilyBridge, Name: "br"}: {},
+	}
+	testCases := []struct {
+		family Family
+		want   uint32
+	}{
+		{family: FamilyAny, want: 6},
+		{family: FamilyInet, want: 2},
+		{family: FamilyIP, want: 2},
+		{family: FamilyIP6, want: 3},
+		{family: FamilyBridge, want: 2},
+		{family: FamilyARP, want: 1},
+		{family: FamilyNetdev, want: 1},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.want, countFlushedTables(set, tc.family), tc.family.String())
+	}
+	require.Zero(t, countFlushedTables(nil, FamilyAny))
+}
+
+func Test_TableKeyMatch(t *testing.T) {
+	// the name which doesn't fit into the BPF key is denied by any protected table
+	long := strings.Repeat("x", MaxTblNameLen)
+	testCases := []struct {
+		key   TableKey
+		table TableKey
+		want  bool
+	}{
+		{key: TableKey{FamilyAny, "fw"}, table: TableKey{FamilyIP, "fw"}, want: true},
+		{key: TableKey{FamilyAny, "fw"}, table: TableKey{FamilyIP, "fw_test"}},
+		{key: TableKey{FamilyAny, "fw"}, table: TableKey{FamilyIP, "fwd"}},
+		{key: TableKey{FamilyAny, "fw"}, table: TableKey{FamilyIP, "f"}},
+		{key: TableKey{FamilyIP, "fw"}, table: TableKey{FamilyIP6, "fw"}},
+		{key: TableKey{FamilyAny, "k8s-*"}, table: TableKey{FamilyInet, "k8s-"}, want: true},
+		{key: TableKey{FamilyAny, "k8s-*"}, table: TableKey{FamilyInet, "k8s-proxy"}, want: true},
+		{key: TableKey{FamilyAny, "k8s-*"}, table: TableKey{FamilyInet, "k8s"}},
+		{key: TableKey{FamilyAny, "k8s-*"}, table: TableKey{FamilyInet, "xk8s-proxy"}},
+		{key: TableKey{FamilyInet, "k8s-*"}, table: TableKey{FamilyIP, "k8s-proxy"}},
+		{key: TableKey{FamilyAny, "*-test"}, table: TableKey{FamilyIP, "fw-test"}, want: true},
+		{key: TableKey{FamilyAny, "*-test"}, table: TableKey{FamilyIP, "fw-test2"}},
+		{key: TableKey{FamilyAny, "fw-*-v?"}, table: TableKey{FamilyIP, "fw-main-v2"}, want: true},
+		{key: TableKey{FamilyAny, "fw-*-v?"}, table: TableKey{FamilyIP, "fw--v2"}, want: true},
+		{key: TableKey{FamilyAny, "fw-*-v?"}, table: TableKey{FamilyIP, "fw-v2"}},
+		{key: TableKey{FamilyAny, "fw-*-v?"}, table: TableKey{FamilyIP, "fw-main-v10"}},
+		{key: TableKey{FamilyAny, "fw?"}, table: TableKey{FamilyIP, "fw1"}, want: true},
+		{key: TableKey{FamilyAny, "fw?"}, table: TableKey{FamilyIP, "fw"}},
+		{key: TableKey{FamilyAny, "fw?"}, table: TableKey{FamilyIP, "fw12"}},
+		{key: TableKey{FamilyAny, "*"}, table: TableKey{FamilyIP, "anything"}, want: true},
+		{key: TableKey{FamilyAny, "*-prod"}, table: TableKey{FamilyIP, long + "-prod"}, want: true},
+		{key: TableKey{FamilyIP6, "fw"}, table: TableKey{FamilyIP, long}, want: true},
+		{key: TableKey{FamilyAny, "*-prod"}, table: TableKey{FamilyIP, long[:MaxTblNameLen-3] + "-p"}},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.want, tc.key.Match(tc.table), "%s ~ %s", tc.key, tc.table)
+	}
+}
+
+func Test_TableKeyMatchFlush(t *testing.T) {
+	testCases := []struct {
+		key   TableKey
+		table TableKey
+		want  bool
+	}{
+		{key: TableKey{FamilyInet, "filter"}, table: TableKey{FamilyAny, "filter"}, want: true},
+		{key: TableKey{FamilyIP, "k8s-*"}, table: TableKey{FamilyAny, "k8s-proxy"}, want: true},
+		{key: TableKey{FamilyAny, "filter"}, table: TableKey{FamilyAny, "filter"}, want: true},
+		{key: TableKey{FamilyInet, "filter"}, table: TableKey{FamilyAny, "nat"}},
+		{key: TableKey{FamilyInet, "filter"}, table: TableKey{FamilyIP, "filter"}},
+		{key: TableKey{FamilyInet, "filter"}, table: TableKey{FamilyInet, "filter"}, want: true},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.want, tc.key.MatchFlush(tc.table), "%s ~ %s", tc.key, tc.table)
+	}
+}
+
+func Test_TableKeyToBpfPattern(t *testing.T) {
+	p, err := TableKey{FamilyIP, "fw-*-v?"}.toBpfPattern()
+	require.NoError(t, err)
+	require.Equal(t, uint8(FamilyIP), p.Family)
+	require.Equal(t, uint8(3), p.PrefixLen)
+	require.Equal(t, uint8(3), p.SuffixLen)
+	require.Equal(t, uint8(1), p.HasStar)
+	require.Equal(t, "fw--v?", string(bytes.TrimRight(p.Text[:], "\x00")))
+
+	p, err = TableKey{FamilyAny, "fw?"}.toBpfPattern()
+	require.NoError(t, err)
+	require.Equal(t, bpfTblPattern{PrefixLen: 3, Text: p.Text}, p)
+
+	_, err = TableKey{FamilyAny, "fw?"}.toBpf()
+	require.Error(t, err)
+}
+
+func Test_TableKeyEscape(t *testing.T) {
+	k := TableKey{Family: FamilyIP, Name: `fw\*\?\\`}
+	require.False(t, k.IsPattern())
+	require.True(t, k.Match(TableKey{Family: FamilyIP, Name: `fw*?\`}))
+	require.False(t, k.Match(TableKey{Family: FamilyIP, Name: `fw-a\`}))
+	key, err := k.toBpf()
+	require.NoError(t, err)
+	require.Equal(t, TableKey{Family: FamilyIP, Name: `fw*?\`}, tableKeyFromBpf(key.Family, key.Name[:]))
+}
@@ -0,0 +1,175 @@
+package nft_protector
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/cilium/ebpf"
+	"github.com/mdlayher/netlink"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	nfnlSubsysNftables = 10 // NFNL_SUBSYS_NFTABLES
+	nfnlGrpNftables    = 7  // NFNLGRP_NFTABLES
+	nfgenMsgLen        = 4  // sizeof(struct nfgenmsg)
+)
+
+type tableHandleEvent struct {
+	msgType NftMsgType
+	key     bpfTblHandleKey
+	name    [MaxTblNameLen]uint8
+}
+
+// tableHandleTracker keeps tbl_handle_map in sync with the tables existing in the kernel,
+// so deleting a protected table by its handle can be recognized by the BPF program
+type tableHandleTracker struct {
+	m        *ebpf.Map
+	notify   *netlink.Conn
+	stopped  chan struct{}
+	onceStop sync.Once
+}
+
+// runTableHandleTracker fills tbl_handle_map from the dump of the tables and then
+// follows table changes until ctx is canceled or the returned stop is called
+func runTableHandleTracker(ctx context.Context, m *ebpf.Map) (stop func(), err error) {
+	t := &tableHandleTracker{m: m, stopped: make(chan struct{})}
+	// subscribe before the dump so no change is missed in between
+	if t.notify, err = netlink.Dial(unix.NETLINK_NETFILTER, nil); err != nil {
+		return nil, errors.WithMessage(err, "failed to open nfnetlink socket")
+	}
+	if err = t.notify.JoinGroup(nfnlGrpNftables); err != nil {
+		_ = t.notify.Close()
+		return nil, errors.WithMessage(err, "failed to subscribe to nftables changes")
+	}
+	if err = t.resync(); err != nil {
+		_ = t.notify.Close()
+		return nil, err
+	}
+	go t.watch(logger.FromContext(ctx).Named("table-handles"))
+	ctxStop := context.AfterFunc(ctx, t.stop)
+	return func() {
+		ctxStop()
+		t.stop()
+	}, nil
+}
+
+func (t *tableHandleTracker) stop() {
+	t.onceStop.Do(func() {
+		_ = t.notify.Close()
+		<-t.stopped
+	})
+}
+
+func (t *tableHandleTracker) watch(log logger.TypeOfLogger) {
+	defer close(t.stopped)
+	for {
+		msgs, err := t.notify.Receive()
+		if err != nil {
+			if errors.Is(err, unix.ENOBUFS) {
+				log.Warn("nftables notifications are lost, resync table handles")
+				if err = t.resync(); err != nil {
+					log.Errorf("failed to resync table handles: %v", err)
+				}
+				continue
+			}
+			return // closed
+		}
+		for _, msg := range msgs {
+			ev, ok, err := parseTableMsg(msg)
+			if err != nil {
+				log.Warnf("failed to parse nftables notification: %v", err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			switch ev.msgType {
+			case NftMsgNewTable:
+				err = t.m.Put(ev.key, ev.name)
+			case NftMsgDelTable, NftMsgDestroyTable:
+				if err = t.m.Delete(ev.key); errors.Is(err, ebpf.ErrKeyNotExist) {
+					err = nil
+				}
+			}
+			if err != nil {
+				log.Errorf("failed to update handle of table '%s': %v",
+					tableKeyFromBpf(ev.key.Family, ev.name[:]), err)
+			}
+		}
+	}
+}
+
+func (t *tableHandleTracker) resync() error {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return errors.WithMessage(err, "failed to open nfnetlink socket")
+	}
+	defer conn.Close() //nolint:errcheck
+	msgs, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(nfnlSubsysNftables<<8 | uint16(NftMsgGetTable)),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0},
+	})
+	if err != nil {
+		return errors.WithMessage(err, "failed to dump nftables tables")
+	}
+	handles := make(map[bpfTblHandleKey][MaxTblNameLen]uint8, len(msgs))
+	for _, msg := range msgs {
+		ev, ok, err := parseTableMsg(msg)
+		if err != nil {
+			return err
+		}
+		if ok {
+			handles[ev.key] = ev.name
+		}
+	}
+	return errors.WithMessage(syncMap(t.m, handles), "failed to setup table handles")
+}
+
+// parseTableMsg parses NEWTABLE/DELTABLE/DESTROYTABLE messages, ok is false for other messages
+func parseTableMsg(msg netlink.Message) (ev tableHandleEvent, ok bool, err error) {
+	typ := uint16(msg.Header.Type)
+	if typ>>8 != nfnlSubsysNftables {
+		return ev, false, nil
+	}
+	ev.msgType = NftMsgType(typ & 0xff)
+	switch ev.msgType {
+	case NftMsgNewTable, NftMsgDelTable, NftMsgDestroyTable:
+	default:
+		return ev, false, nil
+	}
+	if len(msg.Data) < nfgenMsgLen {
+		return ev, false, errors.Errorf("%s message is too short", ev.msgType)
+	}
+	ev.key.Family = msg.Data[0]
+	ad, err := netlink.NewAttributeDecoder(msg.Data[nfgenMsgLen:])
+	if err != nil {
+		return ev, false, errors.WithMessagef(err, "failed to decode %s message", ev.msgType)
+	}
+	ad.ByteOrder = binary.BigEndian
+	var hasName, hasHandle bool
+	for ad.Next() {
+		switch ad.Type() {
+		case nftaTableName:
+			name := ad.String()
+			if len(name) >= MaxTblNameLen {
+				return ev, false, nil // the name doesn't fit into the key, messages by the unknown handle fail closed
+			}
+			copy(ev.name[:], name)
+			hasName = true
+		case nftaTableHandle:
+			ev.key.Handle = ad.Uint64()
+			hasHandle = true
+		}
+	}
+	if err = ad.Err(); err != nil {
+		return ev, false, errors.WithMessagef(err, "failed to decode %s message", ev.msgType)
+	}
+	return ev, hasName && hasHandle, nil
+}
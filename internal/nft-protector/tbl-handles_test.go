@@ -0,0 +1,62 @@
+package nft_protector
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/require"
+)
+
+func tableMsg(t *testing.T, msgType NftMsgType, family uint8, name string, handle uint64) netlink.Message {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	if name != "" {
+		ae.String(nftaTableName, name)
+	}
+	ae.Uint32(2, 0) // NFTA_TABLE_FLAGS
+	if handle != 0 {
+		ae.Uint64(nftaTableHandle, handle)
+	}
+	attrs, err := ae.Encode()
+	require.NoError(t, err)
+	return netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(nfnlSubsysNftables<<8 | uint16(msgType))},
+		Data:   append([]byte{family, 0, 0, 0}, attrs...),
+	}
+}
+
+func Test_ParseTableMsg(t *testing.T) {
+	var filter [MaxTblNameLen]uint8
+	copy(filter[:], "filter")
+
+	ev, ok, err := parseTableMsg(tableMsg(t, NftMsgNewTable, uint8(FamilyInet), "filter", 42))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, tableHandleEvent{
+		msgType: NftMsgNewTable,
+		key:     bpfTblHandleKey{Handle: 42, Family: uint8(FamilyInet)},
+		name:    filter,
+	}, ev)
+
+	ev, ok, err = parseTableMsg(tableMsg(t, NftMsgDelTable, uint8(FamilyIP), "filter", 7))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, NftMsgDelTable, ev.msgType)
+	require.Equal(t, bpfTblHandleKey{Handle: 7, Family: uint8(FamilyIP)}, ev.key)
+
+	_, ok, err = parseTableMsg(tableMsg(t, NftMsgNewChain, uint8(FamilyIP), "filter", 7))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, ok, err = parseTableMsg(tableMsg(t, NftMsgNewTable, uint8(FamilyIP), "", 7))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, ok, err = parseTableMsg(netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(nfnlSubsysNftables<<8 | uint16(NftMsgNewTable))},
+		Data:   []byte{2},
+	})
+	require.Error(t, err)
+	require.False(t, ok)
+}
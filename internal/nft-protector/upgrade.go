@@ -0,0 +1,135 @@
+package nft_protector
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/pkg/errors"
+)
+
+// notMigrated are maps the new program gets its own content of
+var notMigrated = map[string]bool{
+	"events":         true,
+	"lockdown_map":   true,
+	"nft_msg_map":    true,
+	"policy_gen_map": true,
+	"self_map":       true,
+	"self_obj_map":   true,
+}
+
+// upgradePinPath is where the maps of the new program are pinned while the old program still uses
+// the pinned ones, they replace the pinned maps after the new program is behind the link
+func upgradePinPath(pinPath string) string {
+	return filepath.Join(pinPath, "upgrade")
+}
+
+// mapsPinPath returns pinPath if the maps pinned there can be reused by the program, otherwise the maps
+// are incompatible with the new version of the program and have to be migrated
+func mapsPinPath(pinPath string, specs map[string]*ebpf.MapSpec) (string, error) {
+	if err := os.RemoveAll(upgradePinPath(pinPath)); err != nil { // left by a failed upgrade
+		return "", errors.WithMessage(err, "failed to remove maps of the failed upgrade")
+	}
+	for name, spec := range specs {
+		m, err := ebpf.LoadPinnedMap(filepath.Join(pinPath, name), nil)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", errors.WithMessagef(err, "failed to load pinned map '%s'", name)
+		}
+		err = spec.Compatible(m)
+		_ = m.Close()
+		if errors.Is(err, ebpf.ErrMapIncompatible) {
+			return upgradePinPath(pinPath), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return pinPath, nil
+}
+
+// migrateMaps copies entries of the maps pinned under pinPath into the maps of the new program. The policy maps
+// are not copied, the new program gets the whole policy anyway. Maps with another layout are skipped.
+func migrateMaps(pinPath string, maps map[string]*ebpf.Map) (migrated []string, err error) {
+	for name, m := range maps {
+		if notMigrated[name] || m.Type() == ebpf.ArrayOfMaps || m.Type() == ebpf.HashOfMaps {
+			continue
+		}
+		old, err := ebpf.LoadPinnedMap(filepath.Join(pinPath, name), nil)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to load pinned map '%s'", name)
+		}
+		if old.Type() == m.Type() && old.KeySize() == m.KeySize() && old.ValueSize() == m.ValueSize() {
+			err = copyMap(old, m)
+			migrated = append(migrated, name)
+		}
+		_ = old.Close()
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to migrate map '%s'", name)
+		}
+	}
+	return migrated, nil
+}
+
+func copyMap(from, to *ebpf.Map) error {
+	var (
+		key = make([]byte, from.KeySize())
+		val = make([]byte, from.ValueSize())
+	)
+	it := from.Iterate()
+	for it.Next(&key, &val) {
+		if err := to.Put(key, val); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// commitUpgrade replaces the pinned maps by the migrated ones
+func (p *bpfProtector) commitUpgrade(log logger.TypeOfLogger) {
+	entries, err := os.ReadDir(upgradePinPath(p.pinPath))
+	if err != nil {
+		log.Warnf("failed to read migrated maps: %v", err)
+		return
+	}
+	for _, e := range entries {
+		err = os.Rename(filepath.Join(upgradePinPath(p.pinPath), e.Name()), filepath.Join(p.pinPath, e.Name()))
+		if err != nil {
+			log.Warnf("failed to pin migrated map '%s': %v", e.Name(), err)
+		}
+	}
+	_ = os.RemoveAll(upgradePinPath(p.pinPath))
+}
+
+// abortUpgrade removes the migrated maps if the program is upgraded, the pinned ones are kept for the old program
+func (p *bpfProtector) abortUpgrade() {
+	if p.upgrading {
+		_ = os.RemoveAll(upgradePinPath(p.pinPath))
+	}
+}
+
+// verifyLink checks the program is behind the link, links without info, e.g. of kprobes, are not checked
+func verifyLink(lnk link.Link, prog *ebpf.Program) error {
+	info, err := lnk.Info()
+	if errors.Is(err, ebpf.ErrNotSupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	progInfo, err := prog.Info()
+	if err != nil {
+		return err
+	}
+	if id, ok := progInfo.ID(); ok && id != info.Program {
+		return errors.Errorf("program %d is behind the link instead of %d", info.Program, id)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package nft_protector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// bpfFsDir mounts bpffs for the test, the test is skipped if it can't
+func bpfFsDir(t *testing.T) string {
+	dir := t.TempDir()
+	if err := unix.Mount("bpf", dir, "bpf", 0, ""); err != nil {
+		t.Skipf("bpffs can't be mounted: %v", err)
+	}
+	t.Cleanup(func() { _ = unix.Unmount(dir, 0) })
+	return dir
+}
+
+func pinnedMap(t *testing.T, dir, name string, spec ebpf.MapSpec) *ebpf.Map {
+	spec.Name, spec.Pinning = name, ebpf.PinByName
+	m, err := ebpf.NewMapWithOptions(&spec, ebpf.MapOptions{PinPath: dir})
+	if err != nil {
+		t.Skipf("bpf maps can't be created: %v", err)
+	}
+	t.Cleanup(func() { _ = m.Close() })
+	return m
+}
+
+func Test_MapsPinPath(t *testing.T) {
+	dir := bpfFsDir(t)
+	spec := ebpf.MapSpec{Type: ebpf.Hash, KeySize: 4, ValueSize: 4, MaxEntries: 8}
+	pinnedMap(t, dir, "owners", spec)
+
+	path, err := mapsPinPath(dir, map[string]*ebpf.MapSpec{"owners": &spec, "new_map": &spec})
+	require.NoError(t, err)
+	require.Equal(t, dir, path, "compatible and new maps are reused")
+
+	changed := spec
+	changed.ValueSize = 8
+	path, err = mapsPinPath(dir, map[string]*ebpf.MapSpec{"owners": &changed})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "upgrade"), path, "incompatible maps are migrated")
+}
+
+func Test_MigrateMaps(t *testing.T) {
+	dir := bpfFsDir(t)
+	spec := ebpf.MapSpec{Type: ebpf.Hash, KeySize: 4, ValueSize: 4, MaxEntries: 8}
+	require.NoError(t, pinnedMap(t, dir, "owners", spec).Put(uint32(1), uint32(10)))
+	require.NoError(t, pinnedMap(t, dir, "resized", spec).Put(uint32(2), uint32(20)))
+	require.NoError(t, pinnedMap(t, dir, "nft_msg_map", spec).Put(uint32(3), uint32(30)))
+
+	newMap := func(s ebpf.MapSpec) *ebpf.Map {
+		m, err := ebpf.NewMap(&s)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = m.Close() })
+		return m
+	}
+	resized := spec
+	resized.ValueSize = 8
+	maps := map[string]*ebpf.Map{
+		"owners":      newMap(spec),
+		"resized":     newMap(resized),
+		"nft_msg_map": newMap(spec),
+		"new_map":     newMap(spec),
+	}
+	migrated, err := migrateMaps(dir, maps)
+	require.NoError(t, err)
+	require.Equal(t, []string{"owners"}, migrated)
+
+	var val uint32
+	require.NoError(t, maps["owners"].Lookup(uint32(1), &val))
+	require.Equal(t, uint32(10), val)
+	require.ErrorIs(t, maps["nft_msg_map"].Lookup(uint32(3), &val), ebpf.ErrKeyNotExist, "nft_msg_map is not migrated")
+	var wide uint64
+	require.ErrorIs(t, maps["resized"].Lookup(uint32(2), &wide), ebpf.ErrKeyNotExist, "map of another layout is skipped")
+}
+
+func Test_AbortUpgrade(t *testing.T) {
+	dir := bpfFsDir(t)
+	spec := ebpf.MapSpec{Type: ebpf.Hash, KeySize: 4, ValueSize: 4, MaxEntries: 8}
+	require.NoError(t, pinnedMap(t, dir, "owners", spec).Put(uint32(1), uint32(10)))
+	require.NoError(t, os.Mkdir(upgradePinPath(dir), 0o700))
+	require.NoError(t, pinnedMap(t, upgradePinPath(dir), "owners", spec).Put(uint32(1), uint32(20)))
+
+	p := &bpfProtector{opts: Options{Pin: true}, pinPath: dir, upgrading: true}
+	errAttach := errors.New("attach failed")
+	_, err := p.attach(logger.FromContext(context.Background()), func(*ebpf.Program) (link.Link, error) {
+		return nil, errAttach
+	})
+	require.ErrorIs(t, err, errAttach)
+	require.NoDirExists(t, upgradePinPath(dir), "migrated maps are removed")
+
+	m, err := ebpf.LoadPinnedMap(filepath.Join(dir, "owners"), nil)
+	require.NoError(t, err)
+	defer m.Close()
+	var val uint32
+	require.NoError(t, m.Lookup(uint32(1), &val))
+	require.Equal(t, uint32(10), val, "the pinned maps are kept for the old program")
+}
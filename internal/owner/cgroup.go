@@ -0,0 +1,128 @@
+package owner
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// systemSlice holds units of the system manager, units of user managers are elsewhere and may be
+	// started by anybody, so they can't be owners by their names
+	systemSlice = "system.slice"
+
+	systemdUnitSuffixes = []string{".service", ".scope", ".slice"}
+)
+
+// CgroupResolver resolves owner by cgroup v2 path or systemd unit name.
+// The cgroup and all its descendants are owners, so helper children of a service
+// placed in sub-cgroups are allowed as well.
+//
+//	'/system.slice/firewalld.service' - path relative to the cgroup v2 root
+//	'/sys/fs/cgroup/system.slice/firewalld.service' - absolute path
+//	'firewalld.service' or 'firewalld' - systemd unit name, it is looked up in system.slice only,
+//	units in other slices are given by path
+//
+// Paths with '..' are rejected.
+type CgroupResolver string
+
+// Resolve impl Resolver
+func (r CgroupResolver) Resolve(owners *model.Owners) error {
+	dirs, err := r.lookupDirs()
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return nil // cgroup has gone
+				}
+				return err
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			id, err := cgroupID(path)
+			if err == nil {
+				owners.CgroupIDs = append(owners.CgroupIDs, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.WithMessagef(err, "failed to walk cgroup '%s'", dir)
+		}
+	}
+	return nil
+}
+
+func (r CgroupResolver) String() string {
+	return "cgroup:" + string(r)
+}
+
+func (r CgroupResolver) lookupDirs() ([]string, error) {
+	s := strings.TrimSpace(string(r))
+	if strings.Contains(s, "/") {
+		if slices.Contains(strings.Split(s, "/"), "..") {
+			return nil, errors.Errorf("cgroup path '%s' must not contain '..'", s)
+		}
+		path := s
+		if !strings.HasPrefix(path, cgroupRoot+"/") {
+			path = filepath.Join(cgroupRoot, path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return []string{path}, nil
+	}
+	unit := s
+	if !hasUnitSuffix(unit) {
+		unit += ".service"
+	}
+	var dirs []string
+	err := filepath.WalkDir(filepath.Join(cgroupRoot, systemSlice), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() && d.Name() == unit {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return dirs, errors.WithMessagef(err, "failed to lookup systemd unit '%s'", unit)
+}
+
+func hasUnitSuffix(unit string) bool {
+	for _, suffix := range systemdUnitSuffixes {
+		if strings.HasSuffix(unit, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cgroupID returns cgroup v2 id which is the inode number of the cgroup directory
+// and the same value as bpf_get_current_cgroup_id() returns
+func cgroupID(path string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Ino, nil
+}
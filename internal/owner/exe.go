@@ -0,0 +1,212 @@
+package owner
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type (
+	// ExeResolver resolves owner by the executable file identity.
+	// When SHA256 is set the binary content has to match it, otherwise the binary is not trusted.
+	// When Parent is set the process has to be launched by the Parent executable.
+	// The binary is re-identified on every Resolve so a replaced binary is followed.
+	// Binaries on overlayfs can't be identified: the kernel sees the inode of the underlying file system.
+	ExeResolver struct {
+		Path   string
+		SHA256 string
+		Parent string
+
+		cache map[string]exeState
+	}
+
+	// untrustedError is returned when the binary doesn't match its SHA256, so the owner loses its rights
+	untrustedError struct {
+		error
+	}
+
+	exeState struct {
+		id    model.ExeID
+		mtime unix.StatxTimestamp
+		size  uint64
+		hash  string
+	}
+)
+
+// ParseExeResolver parses executable owner in form 'path[;sha256=<hex>][;parent=<path>]'
+func ParseExeResolver(s string) (*ExeResolver, error) {
+	parts := strings.Split(s, ";")
+	r := &ExeResolver{Path: strings.TrimSpace(parts[0])}
+	if !strings.HasPrefix(r.Path, "/") {
+		return nil, errors.Errorf("executable path '%s' must be absolute", r.Path)
+	}
+	for _, opt := range parts[1:] {
+		k, v, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		if !ok {
+			return nil, errors.Errorf("executable '%s' has invalid option '%s'", r.Path, opt)
+		}
+		switch strings.TrimSpace(k) {
+		case "sha256":
+			r.SHA256 = strings.ToLower(strings.TrimSpace(v))
+			if b, err := hex.DecodeString(r.SHA256); err != nil || len(b) != sha256.Size {
+				return nil, errors.Errorf("executable '%s' has invalid sha256 '%s'", r.Path, v)
+			}
+		case "parent":
+			r.Parent = strings.TrimSpace(v)
+			if !strings.HasPrefix(r.Parent, "/") {
+				return nil, errors.Errorf("parent executable path '%s' must be absolute", r.Parent)
+			}
+		default:
+			return nil, errors.Errorf("executable '%s' has unknown option '%s'", r.Path, k)
+		}
+	}
+	return r, nil
+}
+
+func (e untrustedError) Unwrap() error {
+	return e.error
+}
+
+// Resolve impl Resolver
+func (r *ExeResolver) Resolve(owners *model.Owners) error {
+	exe, err := r.identify(r.Path, r.SHA256)
+	if err != nil || exe.IsZero() {
+		return err
+	}
+	var parent model.ExeID
+	if r.Parent != "" {
+		if parent, err = r.identify(r.Parent, ""); err != nil || parent.IsZero() {
+			return err
+		}
+	}
+	owners.Exes = append(owners.Exes, model.ExeOwner{Exe: exe, Parent: parent})
+	return nil
+}
+
+func (r *ExeResolver) String() string {
+	s := "exe:" + r.Path
+	if r.Parent != "" {
+		s += " launched by " + r.Parent
+	}
+	return s
+}
+
+// identify returns zero id if the file does not exist. The id and the hash are taken from the same open file,
+// so the binary can't be replaced in between.
+func (r *ExeResolver) identify(path, wantHash string) (model.ExeID, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return model.ExeID{}, nil
+		}
+		return model.ExeID{}, errors.WithMessagef(err, "failed to open '%s'", path)
+	}
+	defer f.Close() //nolint:errcheck
+	st, id, err := statID(int(f.Fd()), "", unix.AT_EMPTY_PATH)
+	if err != nil {
+		return model.ExeID{}, errors.WithMessagef(err, "failed to stat '%s'", path)
+	}
+	state := exeState{
+		id:    id,
+		mtime: st.Mtime,
+		size:  st.Size,
+	}
+	if wantHash == "" {
+		return state.id, nil
+	}
+	if r.cache == nil {
+		r.cache = make(map[string]exeState)
+	}
+	if cached, ok := r.cache[path]; ok && cached.id == state.id &&
+		cached.mtime == state.mtime && cached.size == state.size {
+		state.hash = cached.hash
+	} else {
+		hash, err := fileSHA256(f)
+		if err != nil {
+			return model.ExeID{}, err
+		}
+		state.hash = hash
+		r.cache[path] = state
+	}
+	if state.hash != wantHash {
+		return model.ExeID{}, untrustedError{errors.Errorf("executable '%s' has sha256 %s but %s is expected",
+			path, state.hash, wantHash)}
+	}
+	return state.id, nil
+}
+
+// FileID identifies the file as the kernel sees it, zero id is returned if the file does not exist
+func FileID(path string) (model.ExeID, error) {
+	_, id, err := statID(unix.AT_FDCWD, path, 0)
+	if errors.Is(err, unix.ENOENT) {
+		return model.ExeID{}, nil
+	}
+	return id, errors.WithMessagef(err, "failed to stat '%s'", path)
+}
+
+// statID identifies the file like BPF does by the device of the inode super block (i_sb->s_dev).
+// It is the device of the mount in mountinfo, st_dev differs from it e.g. on btrfs subvolumes.
+func statID(dirfd int, path string, flags int) (st unix.Statx_t, id model.ExeID, err error) {
+	if err = unix.Statx(dirfd, path, flags, unix.STATX_BASIC_STATS|unix.STATX_MNT_ID, &st); err != nil {
+		return st, id, err
+	}
+	dev := unix.Mkdev(st.Dev_major, st.Dev_minor)
+	if st.Mask&unix.STATX_MNT_ID != 0 {
+		if sdev, ok := mountDev(st.Mnt_id); ok {
+			dev = sdev
+		}
+	}
+	return st, model.ExeID{Ino: st.Ino, Dev: kernelDev(dev)}, nil
+}
+
+// mountDev returns the device of the super block of the mount
+func mountDev(mntID uint64) (uint64, bool) {
+	f, err := os.Open(filepath.Join(procRoot, "self", "mountinfo"))
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close() //nolint:errcheck
+	return parseMountDev(f, mntID)
+}
+
+// parseMountDev finds 'major:minor' of the mount in mountinfo
+func parseMountDev(r io.Reader, mntID uint64) (uint64, bool) {
+	id := strconv.FormatUint(mntID, 10)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != id {
+			continue
+		}
+		var major, minor uint32
+		if _, err := fmt.Sscanf(fields[2], "%d:%d", &major, &minor); err != nil {
+			return 0, false
+		}
+		return unix.Mkdev(major, minor), true
+	}
+	return 0, false
+}
+
+func fileSHA256(f *os.File) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.WithMessagef(err, "failed to read '%s'", f.Name())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// kernelDev converts user space dev_t into the kernel internal one (super_block.s_dev)
+func kernelDev(dev uint64) uint32 {
+	return unix.Major(dev)<<20 | unix.Minor(dev)
+}
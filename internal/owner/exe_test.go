@@ -0,0 +1,112 @@
+package owner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/stretchr/testify/require"
+)
+
+func exeID(t *testing.T, path string) model.ExeID {
+	id, err := FileID(path)
+	require.NoError(t, err)
+	require.False(t, id.IsZero())
+	return id
+}
+
+func Test_ParseExeResolver(t *testing.T) {
+	hash := hex.EncodeToString(make([]byte, sha256.Size))
+	testCases := []struct {
+		input   string
+		want    ExeResolver
+		wantErr bool
+	}{
+		{input: "/usr/sbin/nft", want: ExeResolver{Path: "/usr/sbin/nft"}},
+		{input: "/usr/sbin/nft; parent=/usr/bin/agent", want: ExeResolver{Path: "/usr/sbin/nft", Parent: "/usr/bin/agent"}},
+		{input: "/usr/sbin/nft;sha256=" + hash, want: ExeResolver{Path: "/usr/sbin/nft", SHA256: hash}},
+		{input: "nft", wantErr: true},
+		{input: "/usr/sbin/nft;sha256=abc", wantErr: true},
+		{input: "/usr/sbin/nft;parent=agent", wantErr: true},
+		{input: "/usr/sbin/nft;uid=0", wantErr: true},
+		{input: "/usr/sbin/nft;parent", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseExeResolver(tc.input)
+		if tc.wantErr {
+			require.Error(t, err, tc.input)
+			continue
+		}
+		require.NoError(t, err, tc.input)
+		require.Equal(t, tc.want, *got)
+	}
+}
+
+func Test_ExeResolver(t *testing.T) {
+	dir := t.TempDir()
+	agent := filepath.Join(dir, "agent")
+	nft := filepath.Join(dir, "nft")
+	require.NoError(t, os.WriteFile(agent, []byte("agent v1"), 0o755))
+	require.NoError(t, os.WriteFile(nft, []byte("nft"), 0o755))
+	sum := sha256.Sum256([]byte("agent v1"))
+
+	r := &ExeResolver{Path: agent, SHA256: hex.EncodeToString(sum[:])}
+	got, err := ResolveAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []model.ExeOwner{{Exe: exeID(t, agent)}}, got.Exes)
+
+	r = &ExeResolver{Path: nft, Parent: agent}
+	got, err = ResolveAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []model.ExeOwner{{Exe: exeID(t, nft), Parent: exeID(t, agent)}}, got.Exes)
+
+	got, err = ResolveAll(&ExeResolver{Path: filepath.Join(dir, "none")})
+	require.NoError(t, err)
+	require.Empty(t, got.Exes)
+
+	// the binary is replaced by the one with the same content: new inode is followed
+	r = &ExeResolver{Path: agent, SHA256: hex.EncodeToString(sum[:])}
+	_, err = ResolveAll(r)
+	require.NoError(t, err)
+	tmp := filepath.Join(dir, "agent.new")
+	require.NoError(t, os.WriteFile(tmp, []byte("agent v1"), 0o755))
+	require.NoError(t, os.Rename(tmp, agent))
+	got, err = ResolveAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []model.ExeOwner{{Exe: exeID(t, agent)}}, got.Exes)
+
+	// the binary is replaced by the one with another content: it is not trusted
+	require.NoError(t, os.WriteFile(tmp, []byte("agent v2"), 0o755))
+	require.NoError(t, os.Rename(tmp, agent))
+	_, err = ResolveAll(r)
+	require.Error(t, err)
+}
+
+func Test_ParseMountDev(t *testing.T) {
+	// the btrfs subvolume reports st_dev 0:47 but its inodes belong to the super block 0:45
+	const mountinfo = `28 1 254:0 / / rw,relatime - ext4 /dev/vda rw
+35 28 0:45 /@home /home rw,relatime shared:2 - btrfs /dev/vda2 rw,subvol=/@home
+`
+	dev, ok := parseMountDev(strings.NewReader(mountinfo), 35)
+	require.True(t, ok)
+	require.Equal(t, uint32(45), kernelDev(dev))
+	dev, ok = parseMountDev(strings.NewReader(mountinfo), 28)
+	require.True(t, ok)
+	require.Equal(t, uint32(254<<20), kernelDev(dev))
+	_, ok = parseMountDev(strings.NewReader(mountinfo), 2)
+	require.False(t, ok)
+
+	// the id of the file is of the mount it is on
+	var st syscall.Stat_t
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	require.NoError(t, syscall.Stat(path, &st))
+	id := exeID(t, path)
+	require.Equal(t, st.Ino, id.Ino)
+}
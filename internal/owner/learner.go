@@ -0,0 +1,240 @@
+package owner
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Morwran/nft-protect/internal/config"
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// exeSearchDirs are searched for the executable of a process which has exited before it is learned
+var exeSearchDirs = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+type (
+	// Learner records processes which change protected tables and suggests owners for them
+	Learner struct {
+		mu      sync.Mutex
+		started time.Time
+		seen    map[learnKey]*observation
+		exes    map[model.ExeID]string
+		cgroups map[uint64]string
+	}
+
+	learnKey struct {
+		comm     string
+		exe      model.ExeID
+		cgroupID uint64
+		uid      uint32
+	}
+
+	observation struct {
+		learnKey
+		exePath    string
+		cgroupPath string
+		tables     map[string]struct{}
+		msgs       map[string]struct{}
+		count      int
+	}
+)
+
+func NewLearner() *Learner {
+	return &Learner{
+		started: time.Now(),
+		seen:    make(map[learnKey]*observation),
+		exes:    make(map[model.ExeID]string),
+		cgroups: make(map[uint64]string),
+	}
+}
+
+// Record records the process from the event, paths are resolved while the process may be still alive
+func (l *Learner) Record(p model.ProcessInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := learnKey{comm: p.Name, exe: p.Exe, cgroupID: p.CgroupID, uid: p.Uid}
+	obs, ok := l.seen[key]
+	if !ok {
+		obs = &observation{
+			learnKey:   key,
+			exePath:    l.exePath(p.Pid, p.Exe),
+			cgroupPath: l.cgroupPath(p.Pid, p.CgroupID),
+			tables:     make(map[string]struct{}),
+			msgs:       make(map[string]struct{}),
+		}
+		l.seen[key] = obs
+	}
+	obs.count++
+	obs.tables[strings.TrimSpace(p.Family+" "+p.Table)] = struct{}{}
+	obs.msgs[p.MsgType] = struct{}{}
+}
+
+// Suggest adds an owner for every recorded process to the configured owners,
+// a systemd service is suggested by its cgroup, otherwise by the executable or the name.
+// It returns why every owner is suggested.
+func (l *Learner) Suggest(owners *config.Owners) (why map[string][]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	why = make(map[string][]string)
+	observations := make([]*observation, 0, len(l.seen))
+	for _, obs := range l.seen {
+		observations = append(observations, obs)
+	}
+	slices.SortFunc(observations, func(a, b *observation) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	for _, obs := range observations {
+		var (
+			list  *[]string
+			entry string
+		)
+		switch {
+		case strings.HasSuffix(obs.cgroupPath, ".service"):
+			list, entry = &owners.Cgroups, obs.cgroupPath
+		case obs.exePath != "":
+			list, entry = &owners.Exes, obs.exePath
+		default:
+			list, entry = &owners.Names, obs.comm
+		}
+		if !slices.Contains(*list, entry) {
+			*list = append(*list, entry)
+		}
+		why[entry] = append(why[entry], obs.String())
+	}
+	return why
+}
+
+// WriteSuggestion writes the config with suggested owners added, every suggested owner is commented
+// with what it was seen doing so the file can be reviewed before it is enforced
+func (l *Learner) WriteSuggestion(path string, cfg config.Config) error {
+	why := l.Suggest(&cfg.Owners)
+	var doc yaml.Node
+	if err := doc.Encode(cfg); err != nil {
+		return errors.WithMessage(err, "failed to encode suggested config")
+	}
+	doc.HeadComment = fmt.Sprintf("suggested by nft-protector learning from %s to %s,\n"+
+		"review the owners before enforcing", l.started.Format(time.RFC3339), time.Now().Format(time.RFC3339))
+	commentOwners(&doc, why)
+	data, err := yaml.Marshal(&doc)
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode suggested config")
+	}
+	return errors.WithMessagef(os.WriteFile(path, data, 0o600), "failed to write '%s'", path)
+}
+
+func commentOwners(n *yaml.Node, why map[string][]string) {
+	if n.Kind == yaml.ScalarNode {
+		if lines, ok := why[n.Value]; ok {
+			n.HeadComment = strings.Join(lines, "\n")
+		}
+		return
+	}
+	for _, c := range n.Content {
+		commentOwners(c, why)
+	}
+}
+
+func (o *observation) String() string {
+	s := fmt.Sprintf("seen %d times: comm=%s uid=%d", o.count, o.comm, o.uid)
+	if o.exePath != "" {
+		s += " exe=" + o.exePath
+	}
+	if o.cgroupPath != "" {
+		s += " cgroup=" + o.cgroupPath
+	}
+	return s + " msgs=" + joinKeys(o.msgs) + " tables=" + joinKeys(o.tables)
+}
+
+func joinKeys(m map[string]struct{}) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return strings.Join(keys, ",")
+}
+
+// exePath finds the executable by /proc/<pid>/exe or by searching well known dirs
+func (l *Learner) exePath(pid uint32, id model.ExeID) string {
+	if id.IsZero() {
+		return ""
+	}
+	if path, ok := l.exes[id]; ok {
+		return path
+	}
+	path, _ := os.Readlink(filepath.Join(procRoot, strconv.FormatUint(uint64(pid), 10), "exe"))
+	if path == "" || fileExeID(path) != id {
+		path = ""
+		for _, dir := range exeSearchDirs {
+			entries, _ := os.ReadDir(dir)
+			for _, e := range entries {
+				if p := filepath.Join(dir, e.Name()); fileExeID(p) == id {
+					path = p
+					break
+				}
+			}
+			if path != "" {
+				break
+			}
+		}
+	}
+	l.exes[id] = path
+	return path
+}
+
+// cgroupPath finds the cgroup relative to the cgroup v2 root by /proc/<pid>/cgroup or by walking the tree
+func (l *Learner) cgroupPath(pid uint32, id uint64) string {
+	if id == 0 {
+		return ""
+	}
+	if path, ok := l.cgroups[id]; ok {
+		return path
+	}
+	path := procCgroup(pid)
+	if cid, err := cgroupID(filepath.Join(cgroupRoot, path)); path == "" || err != nil || cid != id {
+		path = ""
+		_ = filepath.WalkDir(cgroupRoot, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			if cid, e := cgroupID(p); e == nil && cid == id {
+				path = "/" + strings.TrimPrefix(strings.TrimPrefix(p, cgroupRoot), "/")
+				return filepath.SkipAll
+			}
+			return nil
+		})
+	}
+	l.cgroups[id] = path
+	return path
+}
+
+// procCgroup returns cgroup v2 path of the process, e.g. '/system.slice/fail2ban.service'
+func procCgroup(pid uint32) string {
+	f, err := os.Open(filepath.Join(procRoot, strconv.FormatUint(uint64(pid), 10), "cgroup"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close() //nolint:errcheck
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path
+		}
+	}
+	return ""
+}
+
+func fileExeID(path string) model.ExeID {
+	id, _ := FileID(path)
+	return id
+}
@@ -0,0 +1,64 @@
+package owner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Morwran/nft-protect/internal/config"
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func Test_Learner(t *testing.T) {
+	setupFakeProc(t, map[string]string{"10": "fail2ban-server", "20": "nft"})
+	root := t.TempDir()
+	old := cgroupRoot
+	cgroupRoot = root
+	t.Cleanup(func() { cgroupRoot = old })
+	service := filepath.Join(root, "system.slice", "fail2ban.service")
+	session := filepath.Join(root, "user.slice", "session-1.scope")
+	require.NoError(t, os.MkdirAll(service, 0o755))
+	require.NoError(t, os.MkdirAll(session, 0o755))
+	serviceID, err := cgroupID(service)
+	require.NoError(t, err)
+	sessionID, err := cgroupID(session)
+	require.NoError(t, err)
+
+	nft := filepath.Join(t.TempDir(), "nft")
+	require.NoError(t, os.WriteFile(nft, []byte("binary"), 0o755))
+	require.NoError(t, os.Symlink(nft, filepath.Join(procRoot, "20", "exe")))
+	require.NoError(t, os.WriteFile(filepath.Join(procRoot, "20", "cgroup"),
+		[]byte("0::/user.slice/session-1.scope\n"), 0o644))
+
+	l := NewLearner()
+	evt := model.ProcessInfo{Pid: 10, Name: "fail2ban-server", CgroupID: serviceID,
+		Family: "inet", Table: "filter", MsgType: "NEWSETELEM"}
+	l.Record(evt)
+	l.Record(evt)
+	l.Record(model.ProcessInfo{Pid: 20, Name: "nft", Uid: 1000, CgroupID: sessionID, Exe: fileExeID(nft),
+		Family: "inet", Table: "filter", MsgType: "DELRULE"})
+	l.Record(model.ProcessInfo{Pid: 30, Name: "gone", Family: "ip", Table: "nat", MsgType: "NEWRULE"})
+
+	out := filepath.Join(t.TempDir(), "allowlist.yaml")
+	require.NoError(t, l.WriteSuggestion(out, config.Config{
+		Tables: []string{"inet filter"},
+		Owners: config.Owners{Names: []string{"firewalld"}},
+	}))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	var got config.Config
+	require.NoError(t, yaml.Unmarshal(data, &got))
+	require.Equal(t, config.Config{
+		Tables: []string{"inet filter"},
+		Owners: config.Owners{
+			Names:   []string{"firewalld", "gone"},
+			Cgroups: []string{"/system.slice/fail2ban.service"},
+			Exes:    []string{nft},
+		},
+	}, got)
+	require.Contains(t, string(data), "seen 2 times: comm=fail2ban-server uid=0 cgroup=/system.slice/fail2ban.service")
+	require.Contains(t, string(data), "uid=1000 exe="+nft+" cgroup=/user.slice/session-1.scope msgs=DELRULE")
+}
@@ -0,0 +1,135 @@
+package owner
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/pkg/errors"
+)
+
+const maxCommLen = 15 // TASK_COMM_LEN - 1
+
+var procRoot = "/proc"
+
+type (
+	// Resolver resolves owner identities and appends them to owners
+	Resolver interface {
+		Resolve(owners *model.Owners) error
+		String() string
+	}
+
+	// PidResolver resolves owner by fixed PID while the process is alive
+	PidResolver uint32
+
+	// NameResolver resolves owner by the process name (comm)
+	NameResolver string
+
+	// PidFileResolver resolves owner by the PID written in the PID file
+	PidFileResolver string
+)
+
+// Resolve impl Resolver
+func (r PidResolver) Resolve(owners *model.Owners) error {
+	if isAlive(uint32(r)) {
+		owners.Pids = append(owners.Pids, uint32(r))
+	}
+	return nil
+}
+
+func (r PidResolver) String() string {
+	return "pid:" + strconv.FormatUint(uint64(r), 10)
+}
+
+// Resolve impl Resolver
+func (r NameResolver) Resolve(owners *model.Owners) error {
+	name := string(r)
+	if len(name) > maxCommLen {
+		name = name[:maxCommLen]
+	}
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to read %s", procRoot)
+	}
+	for _, e := range entries {
+		pid, ok := parsePid(e.Name())
+		if !ok || !e.IsDir() {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join(procRoot, e.Name(), "comm"))
+		if err != nil {
+			continue // process has gone
+		}
+		if string(bytes.TrimSpace(comm)) == name {
+			owners.Pids = append(owners.Pids, pid)
+		}
+	}
+	return nil
+}
+
+func (r NameResolver) String() string {
+	return "name:" + string(r)
+}
+
+// Resolve impl Resolver
+func (r PidFileResolver) Resolve(owners *model.Owners) error {
+	data, err := os.ReadFile(string(r))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return errors.WithMessagef(err, "failed to read pid file '%s'", string(r))
+	}
+	pid, ok := parsePid(strings.TrimSpace(string(data)))
+	if !ok {
+		return errors.Errorf("pid file '%s' has no valid pid", string(r))
+	}
+	return PidResolver(pid).Resolve(owners)
+}
+
+func (r PidFileResolver) String() string {
+	return "pidfile:" + string(r)
+}
+
+// ResolveAll resolves owners with all resolvers and returns the normalized set of identities
+func ResolveAll(resolvers ...Resolver) (owners model.Owners, err error) {
+	for _, r := range resolvers {
+		if err = r.Resolve(&owners); err != nil {
+			return owners, errors.WithMessagef(err, "failed to resolve owner '%s'", r)
+		}
+	}
+	owners.Normalize()
+	return owners, nil
+}
+
+// ResolveEach resolves every set of resolvers separately, e.g. subjects of each policy rule
+func ResolveEach(sets [][]Resolver) ([]model.Owners, error) {
+	ret := make([]model.Owners, len(sets))
+	for i := range sets {
+		var err error
+		if ret[i], err = ResolveAll(sets[i]...); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func isAlive(pid uint32) bool {
+	if pid == 0 {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(procRoot, strconv.FormatUint(uint64(pid), 10)))
+	return err == nil
+}
+
+func parsePid(s string) (uint32, bool) {
+	pid, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || pid == 0 {
+		return 0, false
+	}
+	return uint32(pid), true
+}
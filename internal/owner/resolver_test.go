@@ -0,0 +1,131 @@
+package owner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setupFakeProc(t *testing.T, procs map[string]string) {
+	root := t.TempDir()
+	for pid, comm := range procs {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, pid), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(root, pid, "comm"), []byte(comm+"\n"), 0o644))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "self"), 0o755))
+	old := procRoot
+	procRoot = root
+	t.Cleanup(func() { procRoot = old })
+}
+
+func Test_Resolvers(t *testing.T) {
+	setupFakeProc(t, map[string]string{
+		"10": "firewalld",
+		"20": "fw-agent",
+		"21": "fw-agent",
+		"30": "a-very-long-pro", // comm is truncated by kernel
+	})
+	pidFile := filepath.Join(t.TempDir(), "fw.pid")
+	require.NoError(t, os.WriteFile(pidFile, []byte("10\n"), 0o644))
+	stalePidFile := filepath.Join(t.TempDir(), "stale.pid")
+	require.NoError(t, os.WriteFile(stalePidFile, []byte("99"), 0o644))
+	badPidFile := filepath.Join(t.TempDir(), "bad.pid")
+	require.NoError(t, os.WriteFile(badPidFile, []byte("abc"), 0o644))
+
+	testCases := []struct {
+		resolver Resolver
+		want     []uint32
+		wantErr  bool
+	}{
+		{resolver: PidResolver(10), want: []uint32{10}},
+		{resolver: PidResolver(99)},
+		{resolver: NameResolver("fw-agent"), want: []uint32{20, 21}},
+		{resolver: NameResolver("a-very-long-process-name"), want: []uint32{30}},
+		{resolver: NameResolver("nft")},
+		{resolver: PidFileResolver(pidFile), want: []uint32{10}},
+		{resolver: PidFileResolver(stalePidFile)},
+		{resolver: PidFileResolver(filepath.Join(t.TempDir(), "none.pid"))},
+		{resolver: PidFileResolver(badPidFile), wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ResolveAll(tc.resolver)
+		if tc.wantErr {
+			require.Error(t, err, tc.resolver.String())
+			continue
+		}
+		require.NoError(t, err, tc.resolver.String())
+		if len(tc.want) == 0 {
+			require.Empty(t, got.Pids, tc.resolver.String())
+			continue
+		}
+		require.Equal(t, tc.want, got.Pids, tc.resolver.String())
+	}
+
+	got, err := ResolveAll(PidResolver(21), NameResolver("fw-agent"), PidFileResolver(pidFile))
+	require.NoError(t, err)
+	require.Equal(t, []uint32{10, 20, 21}, got.Pids)
+}
+
+func Test_CgroupResolver(t *testing.T) {
+	root := t.TempDir()
+	old := cgroupRoot
+	cgroupRoot = root
+	t.Cleanup(func() { cgroupRoot = old })
+
+	dirs := []string{
+		"system.slice/firewalld.service",
+		"system.slice/fw-agent.service/helper",
+		"user.slice/user-1000.slice/user@1000.service/app.slice/fw-agent.service",
+	}
+	ids := make(map[string]uint64)
+	for _, d := range dirs {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, d), 0o755))
+	}
+	for _, d := range []string{
+		"system.slice/firewalld.service",
+		"system.slice/fw-agent.service",
+		"system.slice/fw-agent.service/helper",
+		"user.slice/user-1000.slice/user@1000.service/app.slice/fw-agent.service",
+	} {
+		id, err := cgroupID(filepath.Join(root, d))
+		require.NoError(t, err)
+		ids[d] = id
+	}
+
+	testCases := []struct {
+		resolver CgroupResolver
+		want     []string
+	}{
+		{resolver: "firewalld.service", want: []string{"system.slice/firewalld.service"}},
+		{resolver: "firewalld", want: []string{"system.slice/firewalld.service"}},
+		{resolver: "/system.slice/firewalld.service", want: []string{"system.slice/firewalld.service"}},
+		{resolver: CgroupResolver(filepath.Join(root, "system.slice/firewalld.service")), want: []string{"system.slice/firewalld.service"}},
+		{resolver: "fw-agent.service", want: []string{
+			"system.slice/fw-agent.service",
+			"system.slice/fw-agent.service/helper",
+		}},
+		{resolver: "/user.slice/user-1000.slice/user@1000.service/app.slice/fw-agent.service", want: []string{
+			"user.slice/user-1000.slice/user@1000.service/app.slice/fw-agent.service",
+		}},
+		{resolver: "nftd.service"},
+		{resolver: "/system.slice/nftd.service"},
+	}
+	for _, tc := range testCases {
+		got, err := ResolveAll(tc.resolver)
+		require.NoError(t, err, tc.resolver.String())
+		var want model.Owners
+		for _, d := range tc.want {
+			want.CgroupIDs = append(want.CgroupIDs, ids[d])
+		}
+		want.Normalize()
+		require.Equal(t, want.CgroupIDs, got.CgroupIDs, tc.resolver.String())
+	}
+	for _, r := range []CgroupResolver{"/system.slice/../user.slice", "system.slice/fw-agent.service/../.."} {
+		_, err := ResolveAll(r)
+		require.Error(t, err, r.String())
+	}
+}
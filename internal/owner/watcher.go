@@ -0,0 +1,129 @@
+package owner
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/pkg/errors"
+)
+
+// Watcher periodically re-resolves owners and subjects of policy rules and reports when their identities change.
+// An executable which doesn't match its SHA256 any more is dropped from owners, the others are kept.
+// If OnChange fails the owners are applied again on the next tick.
+type Watcher struct {
+	Resolvers []Resolver
+	// Subjects are resolvers of each policy rule, e.g. its cgroup and executable
+	Subjects [][]Resolver
+	Interval time.Duration
+	OnChange func(owners model.Owners, subjects []model.Owners) error
+
+	mu        sync.Mutex
+	current   model.Owners
+	subjects  []model.Owners
+	once      bool
+	untrusted []string // resolvers dropped as untrusted, they are logged once
+}
+
+// Run watches owners until ctx is canceled
+func (w *Watcher) Run(ctx context.Context) error {
+	log := logger.FromContext(ctx).Named("owner-watcher")
+	w.refresh(log)
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			w.refresh(log)
+		}
+	}
+}
+
+func (w *Watcher) refresh(log logger.TypeOfLogger) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	owners, subjects, err := w.resolve(log)
+	if err != nil {
+		log.Warnf("failed to resolve owners: %v", err)
+		return
+	}
+	ownersChanged := !w.current.Equal(owners)
+	if w.once && !ownersChanged && slices.EqualFunc(w.subjects, subjects, model.Owners.Equal) {
+		return
+	}
+	if err = w.OnChange(owners, subjects); err != nil {
+		log.Warnf("failed to apply owners, retry in %s: %v", w.Interval, err)
+		return
+	}
+	if ownersChanged {
+		log.Infof("owners have changed: pids %v -> %v, cgroups %v -> %v, exes %d -> %d",
+			w.current.Pids, owners.Pids, w.current.CgroupIDs, owners.CgroupIDs, len(w.current.Exes), len(owners.Exes))
+	} else {
+		log.Info("subjects of policy rules have changed")
+	}
+	w.current, w.subjects, w.once = owners, subjects, true
+}
+
+// resolve resolves owners and subjects like ResolveAll but drops untrusted executables instead of failing
+func (w *Watcher) resolve(log logger.TypeOfLogger) (owners model.Owners, subjects []model.Owners, err error) {
+	var untrusted []string
+	resolveAll := func(resolvers []Resolver) (ret model.Owners, err error) {
+		for _, r := range resolvers {
+			resolved := ret
+			err = r.Resolve(&resolved)
+			if errors.As(err, new(untrustedError)) {
+				untrusted = append(untrusted, r.String())
+				if !slices.Contains(w.untrusted, r.String()) {
+					log.Warnf("owner '%s' is dropped: %v", r, err)
+				}
+				continue
+			}
+			if err != nil {
+				return ret, errors.WithMessagef(err, "failed to resolve owner '%s'", r)
+			}
+			ret = resolved
+		}
+		ret.Normalize()
+		return ret, nil
+	}
+	if owners, err = resolveAll(w.Resolvers); err != nil {
+		return owners, nil, err
+	}
+	subjects = make([]model.Owners, len(w.Subjects))
+	for i := range w.Subjects {
+		if subjects[i], err = resolveAll(w.Subjects[i]); err != nil {
+			return owners, nil, errors.WithMessagef(err, "policy rule #%d", i+1)
+		}
+	}
+	w.untrusted = untrusted
+	return owners, subjects, nil
+}
+
+// Replace resolves the new owners and subjects and passes them to apply, the watcher switches to the new
+// resolvers and applies following changes by apply only if it succeeds. It is serialized with refreshes,
+// so owners resolved by the old resolvers can't overwrite the applied ones.
+func (w *Watcher) Replace(resolvers []Resolver, subjects [][]Resolver,
+	apply func(owners model.Owners, subjects []model.Owners) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	owners, err := ResolveAll(resolvers...)
+	if err != nil {
+		return err
+	}
+	resolved, err := ResolveEach(subjects)
+	if err != nil {
+		return err
+	}
+	if err = apply(owners, resolved); err != nil {
+		return err
+	}
+	w.Resolvers, w.Subjects, w.OnChange = resolvers, subjects, apply
+	w.current, w.subjects, w.once = owners, resolved, true
+	return nil
+}
@@ -0,0 +1,109 @@
+package owner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WatcherReplace(t *testing.T) {
+	setupFakeProc(t, map[string]string{"10": "firewalld", "20": "fw-agent"})
+	w := &Watcher{Resolvers: []Resolver{PidResolver(10)}}
+
+	err := w.Replace([]Resolver{NameResolver("fw-agent")}, nil, func(model.Owners, []model.Owners) error {
+		return errors.New("invalid")
+	})
+	require.Error(t, err)
+	require.Equal(t, []Resolver{PidResolver(10)}, w.Resolvers, "resolvers are kept if owners are not applied")
+
+	var (
+		applied  model.Owners
+		subjects []model.Owners
+	)
+	err = w.Replace([]Resolver{NameResolver("fw-agent")}, [][]Resolver{{PidResolver(10)}},
+		func(o model.Owners, s []model.Owners) error {
+			applied, subjects = o, s
+			return nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, []uint32{20}, applied.Pids)
+	require.Len(t, subjects, 1)
+	require.Equal(t, []uint32{10}, subjects[0].Pids)
+	require.Equal(t, []Resolver{NameResolver("fw-agent")}, w.Resolvers)
+	require.NotNil(t, w.OnChange, "following changes are applied by the new function")
+}
+
+func Test_WatcherRefreshSubjects(t *testing.T) {
+	setupFakeProc(t, map[string]string{"10": "firewalld"})
+	root := t.TempDir()
+	old := cgroupRoot
+	cgroupRoot = root
+	t.Cleanup(func() { cgroupRoot = old })
+	log := logger.FromContext(context.Background())
+
+	var applied [][]model.Owners
+	w := &Watcher{
+		Resolvers: []Resolver{PidResolver(10)},
+		Subjects:  [][]Resolver{{CgroupResolver("fail2ban.service")}},
+		OnChange: func(_ model.Owners, s []model.Owners) error {
+			applied = append(applied, s)
+			return nil
+		},
+	}
+	w.refresh(log)
+	require.Len(t, applied, 1)
+	require.Empty(t, applied[0][0].CgroupIDs, "the unit is not started yet")
+	w.refresh(log)
+	require.Len(t, applied, 1, "nothing has changed")
+
+	dir := filepath.Join(root, "system.slice", "fail2ban.service")
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	id, err := cgroupID(dir)
+	require.NoError(t, err)
+	w.refresh(log)
+	require.Len(t, applied, 2, "the started unit is applied though owners are the same")
+	require.Equal(t, []uint64{id}, applied[1][0].CgroupIDs)
+}
+
+func Test_WatcherRefresh(t *testing.T) {
+	setupFakeProc(t, map[string]string{"10": "firewalld"})
+	agent := filepath.Join(t.TempDir(), "agent")
+	require.NoError(t, os.WriteFile(agent, []byte("agent v1"), 0o755))
+	sum := sha256.Sum256([]byte("agent v1"))
+	log := logger.FromContext(context.Background())
+
+	var applied []model.Owners
+	fail := true
+	w := &Watcher{
+		Resolvers: []Resolver{&ExeResolver{Path: agent, SHA256: hex.EncodeToString(sum[:])}, PidResolver(10)},
+		OnChange: func(o model.Owners, _ []model.Owners) error {
+			if fail {
+				return errors.New("busy")
+			}
+			applied = append(applied, o)
+			return nil
+		},
+	}
+	w.refresh(log)
+	require.Empty(t, applied)
+	fail = false
+	w.refresh(log)
+	require.Len(t, applied, 1, "owners are applied again after the failure")
+	require.Equal(t, []model.ExeOwner{{Exe: exeID(t, agent)}}, applied[0].Exes)
+
+	// the binary is tampered with: it is dropped, other owners are kept
+	require.NoError(t, os.WriteFile(agent, []byte("agent v2.0"), 0o755))
+	w.refresh(log)
+	require.Len(t, applied, 2)
+	require.Empty(t, applied[1].Exes)
+	require.Equal(t, []uint32{10}, applied[1].Pids)
+}
@@ -0,0 +1,165 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Morwran/nft-protect/internal/model"
+
+	"github.com/H-BF/corlib/logger"
+	"github.com/pkg/errors"
+)
+
+type (
+	// Sink receives events of the protector
+	Sink interface {
+		Write(ctx context.Context, p model.ProcessInfo) error
+		Close() error
+	}
+
+	// Spec describes the sink in form 'log', 'json:-' (stdout) or 'json:<path>'
+	Spec struct {
+		Kind string
+		Path string
+	}
+
+	logSink struct{}
+
+	jsonSink struct {
+		mu  sync.Mutex
+		w   io.WriteCloser
+		enc *json.Encoder
+	}
+
+	// jsonEvent is the line written by the json sink
+	jsonEvent struct {
+		Verdict  string `json:"verdict"`
+		Reason   string `json:"reason"`
+		Rule     string `json:"rule,omitempty"`
+		Pid      uint32 `json:"pid"`
+		Process  string `json:"process"`
+		Uid      uint32 `json:"uid"`
+		CgroupID uint64 `json:"cgroup_id,omitempty"`
+		ExeIno   uint64 `json:"exe_ino,omitempty"`
+		ExeDev   uint32 `json:"exe_dev,omitempty"`
+		Msg      string `json:"msg"`
+		Family   string `json:"family"`
+		Table    string `json:"table"`
+		// TargetPid is set for tamper attempts aimed at a process
+		TargetPid uint32 `json:"target_pid,omitempty"`
+		// File is set for tamper attempts aimed at a protected file
+		File string `json:"file,omitempty"`
+	}
+)
+
+const (
+	KindLog  = "log"
+	KindJSON = "json"
+)
+
+// ParseSpec parses the sink description without opening it
+func ParseSpec(s string) (Spec, error) {
+	kind, path, _ := strings.Cut(strings.TrimSpace(s), ":")
+	spec := Spec{Kind: strings.ToLower(kind), Path: path}
+	switch spec.Kind {
+	case KindLog:
+		if path != "" {
+			return spec, errors.Errorf("sink '%s' has no path", s)
+		}
+	case KindJSON:
+		if path == "" {
+			return spec, errors.Errorf("sink '%s' needs a path or '-' for stdout", s)
+		}
+	default:
+		return spec, errors.Errorf("unknown sink '%s', it is one of log|json:<path>|json:-", s)
+	}
+	return spec, nil
+}
+
+func (s Spec) String() string {
+	if s.Path == "" {
+		return s.Kind
+	}
+	return s.Kind + ":" + s.Path
+}
+
+// Open opens the sink, json file is appended
+func (s Spec) Open() (Sink, error) {
+	switch s.Kind {
+	case KindLog:
+		return logSink{}, nil
+	case KindJSON:
+		if s.Path == "-" {
+			return newJSONSink(nopCloser{os.Stdout}), nil
+		}
+		f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to open sink '%s'", s)
+		}
+		return newJSONSink(f), nil
+	}
+	return nil, errors.Errorf("unknown sink '%s'", s)
+}
+
+func (logSink) Write(ctx context.Context, p model.ProcessInfo) error {
+	if p.TargetPid != 0 {
+		logger.Infof(ctx, "verdict=%s, pid=%d, process=%s, msg=%s, target=%d, reason=%s",
+			p.Verdict, p.Pid, p.Name, p.MsgType, p.TargetPid, p.Reason)
+		return nil
+	}
+	if p.File != "" {
+		logger.Infof(ctx, "verdict=%s, pid=%d, process=%s, msg=%s, file=%s, reason=%s",
+			p.Verdict, p.Pid, p.Name, p.MsgType, p.File, p.Reason)
+		return nil
+	}
+	logger.Infof(ctx, "verdict=%s, pid=%d, process=%s, msg=%s, table=%s %s, reason=%s, rule=%s",
+		p.Verdict, p.Pid, p.Name, p.MsgType, p.Family, p.Table, p.Reason, p.Rule)
+	return nil
+}
+
+func (logSink) Close() error {
+	return nil
+}
+
+func newJSONSink(w io.WriteCloser) *jsonSink {
+	return &jsonSink{w: w, enc: json.NewEncoder(w)}
+}
+
+func (s *jsonSink) Write(_ context.Context, p model.ProcessInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(jsonEvent{
+		Verdict:   p.Verdict,
+		Reason:    p.Reason,
+		Rule:      p.Rule,
+		Pid:       p.Pid,
+		Process:   p.Name,
+		Uid:       p.Uid,
+		CgroupID:  p.CgroupID,
+		ExeIno:    p.Exe.Ino,
+		ExeDev:    p.Exe.Dev,
+		Msg:       p.MsgType,
+		Family:    p.Family,
+		Table:     p.Table,
+		TargetPid: p.TargetPid,
+		File:      p.File,
+	})
+}
+
+func (s *jsonSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}